@@ -1,31 +1,209 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 // Config : proxy server config
 type Config struct {
-	AppPort   int             `yaml:"app-port"`
-	StartPage string          `yaml:"start-page"`
-	Hosts     map[string]Host `yaml:"hosts"`
+	AppPort     int          `yaml:"app-port" json:"app-port"`
+	StartPage   string       `yaml:"start-page" json:"start-page"`
+	Auth        *Auth        `yaml:"auth,omitempty" json:"auth,omitempty"`
+	Admin       *Admin       `yaml:"admin,omitempty" json:"admin,omitempty"`
+	Metrics     *Metrics     `yaml:"metrics,omitempty" json:"metrics,omitempty"`
+	AccessLog   *AccessLog   `yaml:"access-log,omitempty" json:"access-log,omitempty"`
+	Tracing     *Tracing     `yaml:"tracing,omitempty" json:"tracing,omitempty"`
+	HealthCheck *HealthCheck `yaml:"health-check,omitempty" json:"health-check,omitempty"`
+	Discovery   []Discovery  `yaml:"discovery,omitempty" json:"discovery,omitempty"`
+	// ForwardProxy : optional HTTP proxy listener for browsers
+	ForwardProxy *ForwardProxy `yaml:"forward-proxy,omitempty" json:"forward-proxy,omitempty"`
+	// Socks : optional SOCKS5 listener for non-HTTP clients
+	Socks *Socks          `yaml:"socks,omitempty" json:"socks,omitempty"`
+	Hosts map[string]Host `yaml:"hosts" json:"hosts"`
+	// HostPatterns : hosts proxied on demand by names like node-{ip}-{port}, they are matched after configured and discovered hosts
+	HostPatterns map[string]HostPattern `yaml:"host-patterns,omitempty" json:"host-patterns,omitempty"`
+	// TCPForwards : plain TCP ports forwarded to remote addresses like ssh -L
+	TCPForwards []TCPForward `yaml:"tcp-forwards,omitempty" json:"tcp-forwards,omitempty"`
+	// RemoteForwards : ports of ssh servers forwarded to local addresses like ssh -R
+	RemoteForwards []RemoteForward `yaml:"remote-forwards,omitempty" json:"remote-forwards,omitempty"`
+	// DiscoveredHosts : hosts found at runtime by their discovery source, it's filled only in redacted config
+	DiscoveredHosts map[string]map[string]Host `yaml:"-" json:"discovered-hosts,omitempty"`
+
+	location  string
+	hostsLock sync.RWMutex
+	// patterns : host patterns compiled in alphabetical order
+	patterns []hostPatternMatcher
+	// discovered : hosts found by discovery sources at runtime, they are never saved
+	discovered map[string]map[string]Host
 }
 
 // Host : host definition in config
 type Host struct {
-	Address    string      `yaml:"address"`
-	Forwarding *Forwarding `yaml:"forwarding"`
+	// Address : host:port or path of unix socket on ssh server like unix:/var/run/docker.sock
+	Address      string      `yaml:"address,omitempty" json:"address,omitempty"`
+	Addresses    []string    `yaml:"addresses,omitempty" json:"addresses,omitempty"`
+	Balancing    *Balancing  `yaml:"balancing,omitempty" json:"balancing,omitempty"`
+	Forwarding   *Forwarding `yaml:"forwarding,omitempty" json:"forwarding,omitempty"`
+	AllowedUsers []string    `yaml:"allowed-users,omitempty" json:"allowed-users,omitempty"`
+	// ConnectTimeout : limits connection to the host directly or through ssh channel
+	ConnectTimeout time.Duration `yaml:"connect-timeout,omitempty" json:"connect-timeout,omitempty"`
+	// ResponseHeaderTimeout : limits waiting for response headers after request is sent
+	ResponseHeaderTimeout time.Duration `yaml:"response-header-timeout,omitempty" json:"response-header-timeout,omitempty"`
+	// OverallTimeout : limits the whole request including reading of response body
+	OverallTimeout time.Duration `yaml:"overall-timeout,omitempty" json:"overall-timeout,omitempty"`
+
+	// pattern : host pattern which the host is taken from
+	pattern string
+}
+
+// Pattern : returns host pattern which name matched the host or empty string for configured and discovered hosts
+func (host Host) Pattern() string {
+	return host.pattern
+}
+
+// HostPattern : settings of hosts which names match the pattern, address of the host is taken from its name.
+// Only addresses of the subnets (CIDR) are proxied
+type HostPattern struct {
+	Host    `yaml:",inline"`
+	Subnets []string `yaml:"subnets" json:"subnets"`
+}
+
+// Auth : authentication required to use the proxy
+type Auth struct {
+	Realm    string  `yaml:"realm,omitempty" json:"realm,omitempty"`
+	Htpasswd *string `yaml:"htpasswd,omitempty" json:"htpasswd,omitempty"`
+	Tokens   []Token `yaml:"tokens,omitempty" json:"tokens,omitempty"`
+	OIDC     *OIDC   `yaml:"oidc,omitempty" json:"oidc,omitempty"`
+}
+
+// OIDC : OpenID Connect provider used to log in users
+type OIDC struct {
+	Issuer       string              `yaml:"issuer" json:"issuer"`
+	ClientID     string              `yaml:"client-id" json:"client-id"`
+	ClientSecret string              `yaml:"client-secret" json:"client-secret"`
+	RedirectURL  string              `yaml:"redirect-url,omitempty" json:"redirect-url,omitempty"`
+	Scopes       []string            `yaml:"scopes,omitempty" json:"scopes,omitempty"`
+	UserClaim    string              `yaml:"user-claim,omitempty" json:"user-claim,omitempty"`
+	GroupsClaim  string              `yaml:"groups-claim,omitempty" json:"groups-claim,omitempty"`
+	Groups       map[string][]string `yaml:"groups,omitempty" json:"groups,omitempty"`
+	CookieSecret string              `yaml:"cookie-secret" json:"cookie-secret"`
+	SessionTTL   time.Duration       `yaml:"session-ttl,omitempty" json:"session-ttl,omitempty"`
+}
+
+// Token : static bearer token issued to user
+type Token struct {
+	User  string `yaml:"user" json:"user"`
+	Token string `yaml:"token" json:"token"`
+}
+
+// Admin : runtime administration API
+type Admin struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Users : users allowed to use the API, "*" allows everyone who passed authentication
+	Users   []string `yaml:"users,omitempty" json:"users,omitempty"`
+	Persist bool     `yaml:"persist" json:"persist"`
+}
+
+// AdminAnyUser : admin users entry allowing everyone who passed authentication
+const AdminAnyUser = "*"
+
+// Metrics : Prometheus metrics endpoint
+type Metrics struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Path    string `yaml:"path,omitempty" json:"path,omitempty"`
+}
+
+// AccessLog : log of proxied requests
+type AccessLog struct {
+	// Format : combined (default), common or json
+	Format     string `yaml:"format" json:"format"`
+	File       string `yaml:"file,omitempty" json:"file,omitempty"`
+	MaxSizeMB  int    `yaml:"max-size-mb,omitempty" json:"max-size-mb,omitempty"`
+	MaxBackups int    `yaml:"max-backups,omitempty" json:"max-backups,omitempty"`
+	MaxAgeDays int    `yaml:"max-age-days,omitempty" json:"max-age-days,omitempty"`
+	Compress   bool   `yaml:"compress,omitempty" json:"compress,omitempty"`
+}
+
+// Formats of access log
+const (
+	AccessLogFormatCombined = "combined"
+	AccessLogFormatCommon   = "common"
+	AccessLogFormatJSON     = "json"
+)
+
+// Tracing : OpenTelemetry tracing of proxied requests
+type Tracing struct {
+	Exporter    string            `yaml:"exporter" json:"exporter"`
+	Endpoint    string            `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+	Insecure    bool              `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+	Headers     map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	File        string            `yaml:"file,omitempty" json:"file,omitempty"`
+	ServiceName string            `yaml:"service-name,omitempty" json:"service-name,omitempty"`
+	SampleRatio *float64          `yaml:"sample-ratio,omitempty" json:"sample-ratio,omitempty"`
 }
 
 // Forwarding : forwarding definition for host
 type Forwarding struct {
-	PrivateKey *string `yaml:"private-key"`
-	Password   *string `yaml:"password"`
-	User       string  `yaml:"user"`
-	Server     string  `yaml:"server"`
+	PrivateKey *string `yaml:"private-key,omitempty" json:"private-key,omitempty"`
+	// Certificate : user certificate signed by CA for private key, it's read again on each connection
+	Certificate *string `yaml:"certificate,omitempty" json:"certificate,omitempty"`
+	Password    *string `yaml:"password,omitempty" json:"password,omitempty"`
+	User        string  `yaml:"user" json:"user"`
+	Server      string  `yaml:"server,omitempty" json:"server,omitempty"`
+	// Servers : equivalent ssh servers, channels are opened through the first healthy one
+	Servers []string `yaml:"servers,omitempty" json:"servers,omitempty"`
+	// ConnectTimeout : limits TCP connection to ssh server
+	ConnectTimeout time.Duration `yaml:"connect-timeout,omitempty" json:"connect-timeout,omitempty"`
+	// SSHHandshakeTimeout : limits ssh handshake including authentication
+	SSHHandshakeTimeout time.Duration `yaml:"ssh-handshake-timeout,omitempty" json:"ssh-handshake-timeout,omitempty"`
+	// Nameserver : internal DNS server queried through ssh connection to resolve names of host addresses
+	Nameserver string `yaml:"nameserver,omitempty" json:"nameserver,omitempty"`
+	// KnownHosts : known_hosts file verifying keys of ssh servers, host certificates are checked with its @cert-authority lines.
+	// Any key is accepted if it isn't set
+	KnownHosts *string `yaml:"known-hosts,omitempty" json:"known-hosts,omitempty"`
+	// KeyboardInteractive : answers to keyboard-interactive prompts like password and one-time code,
+	// it's tried after private key or password
+	KeyboardInteractive []KeyboardInteractiveAnswer `yaml:"keyboard-interactive,omitempty" json:"keyboard-interactive,omitempty"`
+	// AgentSocket : socket of ssh-agent which keys are offered by agent auth method, SSH_AUTH_SOCK is used if it isn't set
+	AgentSocket string `yaml:"agent-socket,omitempty" json:"agent-socket,omitempty"`
+	// AuthMethods : authentication methods offered to ssh server in order, all configured methods are offered if it isn't set
+	AuthMethods []string `yaml:"auth-methods,omitempty" json:"auth-methods,omitempty"`
+}
+
+// Authentication methods of forwarding
+const (
+	AuthAgent               = "agent"
+	AuthCertificate         = "certificate"
+	AuthPrivateKey          = "private-key"
+	AuthPassword            = "password"
+	AuthKeyboardInteractive = "keyboard-interactive"
+)
+
+// KeyboardInteractiveAnswer : answer to prompts of ssh server matching regular expression, one of answer sources is used
+type KeyboardInteractiveAnswer struct {
+	// Prompt : regular expression matched case-insensitively, e.g. password or verification code
+	Prompt string  `yaml:"prompt" json:"prompt"`
+	Answer *string `yaml:"answer,omitempty" json:"answer,omitempty"`
+	// Env : environment variable with answer
+	Env string `yaml:"env,omitempty" json:"env,omitempty"`
+	// TOTP : base32 secret of time-based one-time password generator (RFC 6238)
+	TOTP *string `yaml:"totp,omitempty" json:"totp,omitempty"`
+	// Browser : answer is asked on prompt page of the proxy when connection is established
+	Browser bool `yaml:"browser,omitempty" json:"browser,omitempty"`
 }
 
 // FromFile : creates config from file
@@ -38,12 +216,615 @@ func FromFile(configLocation string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Invalid config: %v", err)
 	}
+	cfg.location = configLocation
 	return cfg, nil
 }
 
 // NewConfig : creates config from bytes
 func NewConfig(yml []byte) (cfg *Config, err error) {
 	cfg = new(Config)
-	err = yaml.Unmarshal(yml, cfg)
+	if err = yaml.Unmarshal(yml, cfg); err != nil {
+		return
+	}
+	if err = cfg.validateHostPatterns(); err != nil {
+		return
+	}
+	if err = cfg.validateAuthMethods(); err != nil {
+		return
+	}
+	if err = cfg.validateBalancing(); err != nil {
+		return
+	}
+	if err = cfg.validateTokens(); err != nil {
+		return
+	}
+	if err = cfg.validateAccessLog(); err != nil {
+		return
+	}
+	if err = cfg.validateAdmin(); err != nil {
+		return
+	}
+	if err = cfg.validateSocks(); err != nil {
+		return
+	}
+	err = cfg.validateForwards()
 	return
 }
+
+// Balancing : choice of backend among equivalent addresses of the host
+type Balancing struct {
+	// Policy : round-robin (default), least-connections or cookie-hash
+	Policy string `yaml:"policy,omitempty" json:"policy,omitempty"`
+	// Cookie : cookie set by proxy to stick client to backend with cookie-hash policy
+	Cookie string `yaml:"cookie,omitempty" json:"cookie,omitempty"`
+	// MaxFails : consecutive failures after which backend is ejected
+	MaxFails int `yaml:"max-fails,omitempty" json:"max-fails,omitempty"`
+	// EjectFor : period while ejected backend doesn't get requests
+	EjectFor time.Duration `yaml:"eject-for,omitempty" json:"eject-for,omitempty"`
+}
+
+// Balancing policies
+const (
+	BalancingRoundRobin       = "round-robin"
+	BalancingLeastConnections = "least-connections"
+	BalancingCookieHash       = "cookie-hash"
+)
+
+// Validate : checks that balancing policy is known
+func (balancing *Balancing) Validate() error {
+	switch balancing.Policy {
+	case "", BalancingRoundRobin, BalancingLeastConnections, BalancingCookieHash:
+		return nil
+	default:
+		return fmt.Errorf("Unknown balancing policy '%s'", balancing.Policy)
+	}
+}
+
+// AddressList : returns addresses of the host, address is the first one if both address and addresses are set
+func (host Host) AddressList() []string {
+	addresses := []string{}
+	if host.Address != "" {
+		addresses = append(addresses, host.Address)
+	}
+	for _, address := range host.Addresses {
+		if address != host.Address {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// Discovery : source of hosts which are added to configured ones at runtime
+type Discovery struct {
+	// Type : spark, yarn, directory, file-sd or dns-srv
+	Type string `yaml:"type" json:"type"`
+	// Host : configured host which API is queried through its forwarding
+	Host     string        `yaml:"host,omitempty" json:"host,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+	// Prefix : prefix of discovered host names
+	Prefix string `yaml:"prefix,omitempty" json:"prefix,omitempty"`
+	// Path : directory of hosts fragments or file_sd JSON file
+	Path string `yaml:"path,omitempty" json:"path,omitempty"`
+	// Name : SRV record which targets are added as hosts
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// Nameserver : DNS server queried through forwarding of the host
+	Nameserver string `yaml:"nameserver,omitempty" json:"nameserver,omitempty"`
+}
+
+// ForwardProxy : HTTP proxy accepting absolute-URI and CONNECT requests, destinations are dialed through ssh by rules
+type ForwardProxy struct {
+	Port int `yaml:"port" json:"port"`
+	// Rules : the first rule matching destination is applied, destinations without rule are dialed directly
+	Rules []ForwardRule `yaml:"rules,omitempty" json:"rules,omitempty"`
+}
+
+// Socks : SOCKS5 server dialing destinations through ssh by rules, username and password are required if auth is configured
+type Socks struct {
+	Port int `yaml:"port" json:"port"`
+	// Rules : the first rule matching destination is applied, destinations without rule are dialed directly
+	Rules []ForwardRule `yaml:"rules,omitempty" json:"rules,omitempty"`
+}
+
+// ForwardRule : destinations dialed through forwarding of configured host
+type ForwardRule struct {
+	// Destinations : CIDR subnets, host names or domains like *.cluster.internal
+	Destinations []string `yaml:"destinations" json:"destinations"`
+	// Host : configured host which forwarding and allowed users are used, destinations are dialed directly if it's empty
+	Host string `yaml:"host,omitempty" json:"host,omitempty"`
+}
+
+// TCPForward : listener which connections are relayed to remote address through forwarding of configured host
+type TCPForward struct {
+	// Listen : local address like localhost:15432
+	Listen string `yaml:"listen" json:"listen"`
+	// Remote : host:port or path of unix socket like unix:/var/run/docker.sock
+	Remote string `yaml:"remote" json:"remote"`
+	// Host : configured host which forwarding is used, remote is dialed directly if the host has no forwarding
+	Host string `yaml:"host" json:"host"`
+}
+
+// UnixAddressPrefix : remote address with this prefix is path of unix socket on ssh server like unix:/var/run/docker.sock,
+// it's dialed with direct-streamlocal@openssh.com channel
+const UnixAddressPrefix = "unix:"
+
+// RemoteNetwork : returns network and address which remote is dialed with, unix socket is recognized only by configured prefix
+func (forward TCPForward) RemoteNetwork() (network, address string) {
+	if strings.HasPrefix(forward.Remote, UnixAddressPrefix) {
+		return "unix", strings.TrimPrefix(forward.Remote, UnixAddressPrefix)
+	}
+	return "tcp", forward.Remote
+}
+
+// RemoteForward : port of ssh server which connections are relayed to local address
+type RemoteForward struct {
+	// Listen : address on ssh server like localhost:18080, other interfaces could be bound if GatewayPorts of sshd allows it
+	Listen string `yaml:"listen" json:"listen"`
+	Local  string `yaml:"local" json:"local"`
+	// Host : configured host which forwarding is used
+	Host string `yaml:"host" json:"host"`
+}
+
+// validateTokens : empty token would authenticate requests with empty bearer token
+// and duplicated one would authenticate any of its users
+func (cfg *Config) validateTokens() error {
+	if cfg.Auth == nil {
+		return nil
+	}
+	tokens := make(map[string]bool)
+	for _, token := range cfg.Auth.Tokens {
+		if token.Token == "" {
+			return fmt.Errorf("Token of user '%s' is empty", token.User)
+		}
+		if tokens[token.Token] {
+			return fmt.Errorf("Token of user '%s' is used by another user", token.User)
+		}
+		tokens[token.Token] = true
+	}
+	return nil
+}
+
+func (cfg *Config) validateAccessLog() error {
+	if cfg.AccessLog == nil {
+		return nil
+	}
+	switch cfg.AccessLog.Format {
+	case "", AccessLogFormatCombined, AccessLogFormatCommon, AccessLogFormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("Unknown access log format '%s'", cfg.AccessLog.Format)
+	}
+}
+
+// validateAdmin : anonymous users would be able to change hosts if any user is allowed without authentication
+func (cfg *Config) validateAdmin() error {
+	if cfg.Admin == nil || !cfg.Admin.Enabled || cfg.Auth != nil {
+		return nil
+	}
+	for _, user := range cfg.Admin.Users {
+		if user == AdminAnyUser {
+			return fmt.Errorf("Admin users can't include \"%s\" without auth", AdminAnyUser)
+		}
+	}
+	return nil
+}
+
+// validateSocks : SOCKS5 clients send only username and password which are checked against htpasswd,
+// users of tokens and OIDC can't use SOCKS listener
+func (cfg *Config) validateSocks() error {
+	if cfg.Socks == nil || cfg.Auth == nil || cfg.Auth.Htpasswd != nil {
+		return nil
+	}
+	return fmt.Errorf("SOCKS listener requires auth.htpasswd as its clients can't use tokens or OIDC")
+}
+
+func (cfg *Config) validateForwards() error {
+	for _, forward := range cfg.TCPForwards {
+		if _, _, err := net.SplitHostPort(forward.Listen); err != nil {
+			return fmt.Errorf("Listen address of tcp forward is invalid: %v", err)
+		}
+		if _, _, err := net.SplitHostPort(forward.Remote); err != nil && !strings.HasPrefix(forward.Remote, UnixAddressPrefix) {
+			return fmt.Errorf("Remote address of tcp forward %s is invalid: %v", forward.Listen, err)
+		}
+		if forward.Host == "" {
+			return fmt.Errorf("Host of tcp forward %s isn't set", forward.Listen)
+		}
+	}
+	for _, forward := range cfg.RemoteForwards {
+		if _, _, err := net.SplitHostPort(forward.Listen); err != nil {
+			return fmt.Errorf("Listen address of remote forward is invalid: %v", err)
+		}
+		if _, _, err := net.SplitHostPort(forward.Local); err != nil {
+			return fmt.Errorf("Local address of remote forward %s is invalid: %v", forward.Listen, err)
+		}
+		if forward.Host == "" {
+			return fmt.Errorf("Host of remote forward %s isn't set", forward.Listen)
+		}
+	}
+	return nil
+}
+
+// HealthCheck : ssh servers are checked with keepalive request or reconnected with interval
+type HealthCheck struct {
+	Interval time.Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// ServerList : returns ssh servers of forwarding, server is the first one if both server and servers are set
+func (forwarding *Forwarding) ServerList() []string {
+	servers := []string{}
+	if forwarding.Server != "" {
+		servers = append(servers, forwarding.Server)
+	}
+	for _, server := range forwarding.Servers {
+		if server != forwarding.Server {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// AuthMethodList : returns authentication methods in order they are offered to ssh server.
+// Configured ones are used if auth-methods isn't set: agent (if agent-socket is set), certificate, private-key, password and keyboard-interactive
+func (forwarding *Forwarding) AuthMethodList() ([]string, error) {
+	if len(forwarding.AuthMethods) == 0 {
+		methods := []string{}
+		if forwarding.AgentSocket != "" {
+			methods = append(methods, AuthAgent)
+		}
+		if forwarding.PrivateKey != nil && forwarding.Certificate != nil {
+			methods = append(methods, AuthCertificate)
+		}
+		if forwarding.PrivateKey != nil {
+			methods = append(methods, AuthPrivateKey)
+		}
+		if forwarding.Password != nil {
+			methods = append(methods, AuthPassword)
+		}
+		if len(forwarding.KeyboardInteractive) > 0 {
+			methods = append(methods, AuthKeyboardInteractive)
+		}
+		return methods, nil
+	}
+	for i, method := range forwarding.AuthMethods {
+		for _, previous := range forwarding.AuthMethods[:i] {
+			if method == previous {
+				return nil, fmt.Errorf("Auth method %s is listed twice", method)
+			}
+		}
+		var configured bool
+		switch method {
+		case AuthAgent:
+			configured = true
+		case AuthCertificate:
+			configured = forwarding.PrivateKey != nil && forwarding.Certificate != nil
+		case AuthPrivateKey:
+			configured = forwarding.PrivateKey != nil
+		case AuthPassword:
+			configured = forwarding.Password != nil
+		case AuthKeyboardInteractive:
+			configured = len(forwarding.KeyboardInteractive) > 0
+		default:
+			return nil, fmt.Errorf("Unknown auth method %s", method)
+		}
+		if !configured {
+			return nil, fmt.Errorf("Auth method %s isn't configured", method)
+		}
+	}
+	return forwarding.AuthMethods, nil
+}
+
+// Identity : hash of authentication, host key and connection timeouts settings, hosts share ssh connection to the same server
+// and user only if their identities are equal so connection opened without host key verification isn't reused by host requiring it
+// and every host gets the timeouts it configured
+func (forwarding *Forwarding) Identity() string {
+	settings, _ := json.Marshal(Forwarding{
+		PrivateKey:          forwarding.PrivateKey,
+		Certificate:         forwarding.Certificate,
+		Password:            forwarding.Password,
+		KnownHosts:          forwarding.KnownHosts,
+		KeyboardInteractive: forwarding.KeyboardInteractive,
+		AgentSocket:         forwarding.AgentSocket,
+		AuthMethods:         forwarding.AuthMethods,
+		ConnectTimeout:      forwarding.ConnectTimeout,
+		SSHHandshakeTimeout: forwarding.SSHHandshakeTimeout,
+	})
+	sum := sha256.Sum256(settings)
+	return hex.EncodeToString(sum[:8])
+}
+
+// validateAuthMethods : checks auth methods of configured hosts and host patterns
+func (cfg *Config) validateAuthMethods() error {
+	for name, host := range cfg.Hosts {
+		if host.Forwarding == nil {
+			continue
+		}
+		if _, err := host.Forwarding.AuthMethodList(); err != nil {
+			return fmt.Errorf("Forwarding of host '%s' is invalid: %v", name, err)
+		}
+	}
+	for pattern, hostPattern := range cfg.HostPatterns {
+		if hostPattern.Forwarding == nil {
+			continue
+		}
+		if _, err := hostPattern.Forwarding.AuthMethodList(); err != nil {
+			return fmt.Errorf("Forwarding of host pattern '%s' is invalid: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) validateBalancing() error {
+	for name, host := range cfg.Hosts {
+		if host.Balancing == nil {
+			continue
+		}
+		if err := host.Balancing.Validate(); err != nil {
+			return fmt.Errorf("Balancing of host '%s' is invalid: %v", name, err)
+		}
+	}
+	for pattern, hostPattern := range cfg.HostPatterns {
+		if hostPattern.Balancing == nil {
+			continue
+		}
+		if err := hostPattern.Balancing.Validate(); err != nil {
+			return fmt.Errorf("Balancing of host pattern '%s' is invalid: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// MetricsPath : returns path of metrics endpoint, /metrics by default
+func (metrics *Metrics) MetricsPath() string {
+	if metrics.Path == "" {
+		return "/metrics"
+	}
+	return metrics.Path
+}
+
+// Host : returns host by name, it's safe to use while hosts are changed at runtime
+func (cfg *Config) Host(name string) (Host, bool) {
+	cfg.hostsLock.RLock()
+	defer cfg.hostsLock.RUnlock()
+	if host, ok := cfg.Hosts[name]; ok {
+		return host, true
+	}
+	for _, source := range cfg.sortedSources() {
+		if host, ok := cfg.discovered[source][name]; ok {
+			return host, true
+		}
+	}
+	return cfg.patternHost(name)
+}
+
+// HostNames : returns sorted names of all hosts including discovered ones
+func (cfg *Config) HostNames() []string {
+	hosts := cfg.AllHosts()
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AllHosts : returns copy of hosts map including discovered hosts
+func (cfg *Config) AllHosts() map[string]Host {
+	cfg.hostsLock.RLock()
+	defer cfg.hostsLock.RUnlock()
+	hosts := make(map[string]Host, len(cfg.Hosts))
+	sources := cfg.sortedSources()
+	for i := len(sources) - 1; i >= 0; i-- {
+		for name, host := range cfg.discovered[sources[i]] {
+			hosts[name] = host
+		}
+	}
+	for name, host := range cfg.Hosts {
+		hosts[name] = host
+	}
+	return hosts
+}
+
+// SetDiscoveredHosts : replaces hosts found by discovery source, configured hosts take precedence over discovered ones.
+// Returns names of added, changed and removed hosts
+func (cfg *Config) SetDiscoveredHosts(source string, hosts map[string]Host) []string {
+	cfg.hostsLock.Lock()
+	defer cfg.hostsLock.Unlock()
+	if cfg.discovered == nil {
+		cfg.discovered = make(map[string]map[string]Host)
+	}
+	previous := cfg.discovered[source]
+	changed := []string{}
+	for name, host := range hosts {
+		if old, ok := previous[name]; !ok || !reflect.DeepEqual(old, host) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := hosts[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	cfg.discovered[source] = hosts
+	sort.Strings(changed)
+	return changed
+}
+
+func (cfg *Config) sortedSources() []string {
+	sources := make([]string, 0, len(cfg.discovered))
+	for source := range cfg.discovered {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// SetHost : adds or replaces host at runtime, returns previous configured host if it's replaced.
+// Discovered hosts and hosts of patterns with the same name aren't replaced, configured host takes precedence over them
+func (cfg *Config) SetHost(name string, host Host) (previous Host, replaced bool) {
+	cfg.hostsLock.Lock()
+	defer cfg.hostsLock.Unlock()
+	if cfg.Hosts == nil {
+		cfg.Hosts = make(map[string]Host)
+	}
+	previous, replaced = cfg.Hosts[name]
+	cfg.Hosts[name] = host
+	return
+}
+
+// RemoveHost : removes host at runtime, returns false if host doesn't exist
+func (cfg *Config) RemoveHost(name string) bool {
+	cfg.hostsLock.Lock()
+	defer cfg.hostsLock.Unlock()
+	_, ok := cfg.Hosts[name]
+	delete(cfg.Hosts, name)
+	return ok
+}
+
+// Save : writes config back to the file it was read from
+func (cfg *Config) Save() error {
+	if cfg.location == "" {
+		return fmt.Errorf("Config wasn't read from file")
+	}
+	cfg.hostsLock.RLock()
+	yml, err := yaml.Marshal(cfg)
+	cfg.hostsLock.RUnlock()
+	if err != nil {
+		return fmt.Errorf("Can't serialize config: %v", err)
+	}
+	if err = writeFileAtomically(cfg.location, yml); err != nil {
+		return fmt.Errorf("Can't write config file: %v", err)
+	}
+	return nil
+}
+
+// writeFileAtomically : writes temporary file next to the file and renames it, so the file is never left
+// partially written. Permissions of existing file are kept
+func writeFileAtomically(location string, content []byte) (err error) {
+	var mode os.FileMode = 0600
+	if info, statErr := os.Stat(location); statErr == nil {
+		mode = info.Mode().Perm()
+	}
+	file, err := ioutil.TempFile(filepath.Dir(location), "."+filepath.Base(location)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()           // nolint
+			os.Remove(file.Name()) // nolint
+		}
+	}()
+	if err = file.Chmod(mode); err != nil {
+		return err
+	}
+	if _, err = file.Write(content); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), location)
+}
+
+// Redacted : returns copy of config without secrets
+func (cfg *Config) Redacted() *Config {
+	redacted := &Config{
+		AppPort:        cfg.AppPort,
+		StartPage:      cfg.StartPage,
+		Admin:          cfg.Admin,
+		Metrics:        cfg.Metrics,
+		AccessLog:      cfg.AccessLog,
+		HealthCheck:    cfg.HealthCheck,
+		Discovery:      cfg.Discovery,
+		ForwardProxy:   cfg.ForwardProxy,
+		Socks:          cfg.Socks,
+		TCPForwards:    cfg.TCPForwards,
+		RemoteForwards: cfg.RemoteForwards,
+		Hosts:          make(map[string]Host, len(cfg.Hosts)),
+	}
+	cfg.hostsLock.RLock()
+	for name, host := range cfg.Hosts {
+		redacted.Hosts[name] = redactHost(host)
+	}
+	for source, hosts := range cfg.discovered {
+		if len(hosts) == 0 {
+			continue
+		}
+		if redacted.DiscoveredHosts == nil {
+			redacted.DiscoveredHosts = make(map[string]map[string]Host, len(cfg.discovered))
+		}
+		redacted.DiscoveredHosts[source] = make(map[string]Host, len(hosts))
+		for name, host := range hosts {
+			redacted.DiscoveredHosts[source][name] = redactHost(host)
+		}
+	}
+	cfg.hostsLock.RUnlock()
+	if cfg.HostPatterns != nil {
+		redacted.HostPatterns = make(map[string]HostPattern, len(cfg.HostPatterns))
+		for pattern, hostPattern := range cfg.HostPatterns {
+			hostPattern.Host = redactHost(hostPattern.Host)
+			redacted.HostPatterns[pattern] = hostPattern
+		}
+	}
+	if cfg.Auth != nil {
+		auth := *cfg.Auth
+		auth.Tokens = make([]Token, len(cfg.Auth.Tokens))
+		for i, token := range cfg.Auth.Tokens {
+			auth.Tokens[i] = Token{User: token.User, Token: redactedValue}
+		}
+		if cfg.Auth.OIDC != nil {
+			oidc := *cfg.Auth.OIDC
+			oidc.ClientSecret = redact(oidc.ClientSecret)
+			oidc.CookieSecret = redact(oidc.CookieSecret)
+			auth.OIDC = &oidc
+		}
+		redacted.Auth = &auth
+	}
+	if cfg.Tracing != nil {
+		tracing := *cfg.Tracing
+		tracing.Headers = make(map[string]string, len(cfg.Tracing.Headers))
+		for name, value := range cfg.Tracing.Headers {
+			tracing.Headers[name] = redact(value)
+		}
+		redacted.Tracing = &tracing
+	}
+	return redacted
+}
+
+func redactHost(host Host) Host {
+	if host.Forwarding == nil {
+		return host
+	}
+	forwarding := *host.Forwarding
+	if forwarding.Password != nil {
+		password := redactedValue
+		forwarding.Password = &password
+	}
+	if forwarding.KeyboardInteractive != nil {
+		forwarding.KeyboardInteractive = make([]KeyboardInteractiveAnswer, len(host.Forwarding.KeyboardInteractive))
+		for i, answer := range host.Forwarding.KeyboardInteractive {
+			redacted := redactedValue
+			if answer.Answer != nil {
+				answer.Answer = &redacted
+			}
+			if answer.TOTP != nil {
+				answer.TOTP = &redacted
+			}
+			forwarding.KeyboardInteractive[i] = answer
+		}
+	}
+	host.Forwarding = &forwarding
+	return host
+}
+
+const redactedValue = "******"
+
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redactedValue
+}
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	assert "github.com/stretchr/testify/require"
 )
@@ -15,6 +19,47 @@ func TestConfig(t *testing.T) {
 	assert.Equal(t, "master", cfg.StartPage)
 	assert.Equal(t, 8080, cfg.AppPort)
 
+	assert.NotNil(t, cfg.Auth)
+	assert.Equal(t, "cluster", cfg.Auth.Realm)
+	assert.Equal(t, "/path/to/htpasswd", *cfg.Auth.Htpasswd)
+	assert.Equal(t, []Token{{User: "ci", Token: "secret-token"}}, cfg.Auth.Tokens)
+	assert.NotNil(t, cfg.Auth.OIDC)
+	assert.Equal(t, "https://accounts.example.com", cfg.Auth.OIDC.Issuer)
+	assert.Equal(t, "proxy", cfg.Auth.OIDC.ClientID)
+	assert.Equal(t, "proxy-secret", cfg.Auth.OIDC.ClientSecret)
+	assert.Equal(t, []string{"openid", "email", "groups"}, cfg.Auth.OIDC.Scopes)
+	assert.Equal(t, []string{"master", "worker-2"}, cfg.Auth.OIDC.Groups["developers"])
+	assert.Equal(t, []string{"*"}, cfg.Auth.OIDC.Groups["admins"])
+	assert.Equal(t, 8*time.Hour, cfg.Auth.OIDC.SessionTTL)
+
+	assert.NotNil(t, cfg.Admin)
+	assert.True(t, cfg.Admin.Enabled)
+	assert.Equal(t, []string{"alice"}, cfg.Admin.Users)
+	assert.False(t, cfg.Admin.Persist)
+
+	assert.NotNil(t, cfg.Metrics)
+	assert.True(t, cfg.Metrics.Enabled)
+	assert.Equal(t, "/metrics", cfg.Metrics.MetricsPath())
+	assert.Equal(t, 15*time.Second, cfg.HealthCheck.Interval)
+	assert.Equal(t, 3*time.Second, cfg.HealthCheck.Timeout)
+	assert.Equal(t, []Discovery{{Type: "spark", Host: "master", Interval: time.Minute, Prefix: "spark-"}}, cfg.Discovery)
+	assert.Equal(t, []TCPForward{{Listen: "localhost:15432", Remote: "10.1.1.5:5432", Host: "worker-1"}}, cfg.TCPForwards)
+	assert.Equal(t, []RemoteForward{{Listen: "localhost:18080", Local: "localhost:8000", Host: "worker-1"}}, cfg.RemoteForwards)
+
+	assert.NotNil(t, cfg.AccessLog)
+	assert.Equal(t, "combined", cfg.AccessLog.Format)
+	assert.Equal(t, "/var/log/http-ssh-proxy/access.log", cfg.AccessLog.File)
+	assert.Equal(t, 100, cfg.AccessLog.MaxSizeMB)
+	assert.Equal(t, 5, cfg.AccessLog.MaxBackups)
+
+	assert.NotNil(t, cfg.Tracing)
+	assert.Equal(t, "otlp", cfg.Tracing.Exporter)
+	assert.Equal(t, "localhost:4318", cfg.Tracing.Endpoint)
+	assert.True(t, cfg.Tracing.Insecure)
+	assert.Equal(t, "Bearer tracing-token", cfg.Tracing.Headers["authorization"])
+	assert.Equal(t, "cluster-proxy", cfg.Tracing.ServiceName)
+	assert.Equal(t, 0.5, *cfg.Tracing.SampleRatio)
+
 	assert.NotNil(t, cfg.Hosts["master"])
 	assert.Equal(t, "1.1.1.1:8080", cfg.Hosts["master"].Address)
 	assert.Nil(t, cfg.Hosts["master"].Forwarding)
@@ -23,13 +68,28 @@ func TestConfig(t *testing.T) {
 	assert.Equal(t, "2.2.2.2:8081", cfg.Hosts["worker-1"].Address)
 	assert.NotNil(t, cfg.Hosts["worker-1"].Forwarding)
 	assert.Equal(t, "/path/to/private_key.pem", *cfg.Hosts["worker-1"].Forwarding.PrivateKey)
+	assert.Equal(t, "/path/to/private_key-cert.pub", *cfg.Hosts["worker-1"].Forwarding.Certificate)
+	assert.Equal(t, "/path/to/known_hosts", *cfg.Hosts["worker-1"].Forwarding.KnownHosts)
 	assert.Nil(t, cfg.Hosts["worker-1"].Forwarding.Password)
 	assert.Equal(t, "3.3.3.3:22", cfg.Hosts["worker-1"].Forwarding.Server)
+	assert.Equal(t, []string{"3.3.3.3:22", "3.3.3.4:22"}, cfg.Hosts["worker-1"].Forwarding.ServerList())
 	assert.Equal(t, "ssh-user", cfg.Hosts["worker-1"].Forwarding.User)
+	assert.Equal(t, []string{"alice"}, cfg.Hosts["worker-1"].AllowedUsers)
+	assert.Equal(t, 3*time.Second, cfg.Hosts["worker-1"].Forwarding.ConnectTimeout)
+	assert.Equal(t, 10*time.Second, cfg.Hosts["worker-1"].Forwarding.SSHHandshakeTimeout)
+	assert.Equal(t, 5*time.Second, cfg.Hosts["worker-1"].ConnectTimeout)
+	assert.Equal(t, 30*time.Second, cfg.Hosts["worker-1"].ResponseHeaderTimeout)
+	assert.Equal(t, 2*time.Minute, cfg.Hosts["worker-1"].OverallTimeout)
 
 	assert.NotNil(t, cfg.Hosts["worker-2"])
 	assert.Equal(t, "4.4.4.4:4040", cfg.Hosts["worker-2"].Address)
 	assert.Nil(t, cfg.Hosts["worker-2"].Forwarding)
+	assert.Empty(t, cfg.Hosts["worker-2"].AllowedUsers)
+	assert.Equal(t, []string{"4.4.4.4:4040", "4.4.4.5:4040"}, cfg.Hosts["worker-2"].AddressList())
+	assert.Equal(t, "cookie-hash", cfg.Hosts["worker-2"].Balancing.Policy)
+	assert.Equal(t, "_proxy_worker", cfg.Hosts["worker-2"].Balancing.Cookie)
+	assert.Equal(t, 2, cfg.Hosts["worker-2"].Balancing.MaxFails)
+	assert.Equal(t, time.Minute, cfg.Hosts["worker-2"].Balancing.EjectFor)
 }
 
 func TestMissingConfig(t *testing.T) {
@@ -42,8 +102,219 @@ func TestInvalidConfig(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestInvalidTCPForward(t *testing.T) {
+	_, err := NewConfig([]byte("tcp-forwards:\n    - listen: 15432\n      remote: 10.1.1.5:5432\n      host: worker-1\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("tcp-forwards:\n    - listen: localhost:15432\n      remote: 10.1.1.5:5432\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("tcp-forwards:\n    - listen: localhost:15432\n      remote: 10.1.1.5:5432\n      host: worker-1\n"))
+	assert.NoError(t, err)
+}
+
+func TestUnixSocketTCPForward(t *testing.T) {
+	cfg, err := NewConfig([]byte("tcp-forwards:\n    - listen: localhost:2375\n      remote: unix:/var/run/docker.sock\n      host: worker-1\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "unix:/var/run/docker.sock", cfg.TCPForwards[0].Remote)
+	network, address := cfg.TCPForwards[0].RemoteNetwork()
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/var/run/docker.sock", address)
+
+	network, address = TCPForward{Remote: "%2Fvar%2Frun%2Fdocker.sock:80"}.RemoteNetwork()
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "%2Fvar%2Frun%2Fdocker.sock:80", address)
+}
+
+func TestInvalidRemoteForward(t *testing.T) {
+	_, err := NewConfig([]byte("remote-forwards:\n    - listen: localhost:18080\n      local: 8000\n      host: worker-1\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("remote-forwards:\n    - listen: localhost:18080\n      local: localhost:8000\n"))
+	assert.Error(t, err)
+}
+
+func TestInvalidBalancingPolicy(t *testing.T) {
+	_, err := NewConfig([]byte("hosts:\n    workers:\n        addresses: [\"10.1.1.5:8081\", \"10.1.1.6:8081\"]\n        balancing:\n            policy: round-robbin\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("host-patterns:\n    node-{ip}-{port}:\n        subnets: [\"10.1.1.0/24\"]\n        balancing:\n            policy: random\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("hosts:\n    workers:\n        addresses: [\"10.1.1.5:8081\", \"10.1.1.6:8081\"]\n        balancing:\n            policy: least-connections\n"))
+	assert.NoError(t, err)
+}
+
+func TestInvalidAccessLogFormat(t *testing.T) {
+	_, err := NewConfig([]byte("access-log:\n    format: jsno\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("access-log:\n    format: json\n"))
+	assert.NoError(t, err)
+}
+
+func TestAdminAnyUser(t *testing.T) {
+	_, err := NewConfig([]byte("admin:\n    enabled: true\n    users: [\"*\"]\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("admin:\n    enabled: true\n    users: [\"*\"]\nauth:\n    htpasswd: testdata/htpasswd\n"))
+	assert.NoError(t, err)
+}
+
+func TestInvalidTokens(t *testing.T) {
+	_, err := NewConfig([]byte("auth:\n    tokens:\n        - user: ci\n          token: \"\"\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("auth:\n    tokens:\n        - user: ci\n          token: secret\n        - user: admin\n          token: secret\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("auth:\n    tokens:\n        - user: ci\n          token: secret\n        - user: admin\n          token: another\n"))
+	assert.NoError(t, err)
+}
+
+func TestSocksAuth(t *testing.T) {
+	_, err := NewConfig([]byte("socks:\n    port: 1080\nauth:\n    tokens:\n        - user: ci\n          token: secret\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("socks:\n    port: 1080\nauth:\n    htpasswd: testdata/htpasswd\n"))
+	assert.NoError(t, err)
+}
+
+func TestIdentity(t *testing.T) {
+	password, otherPassword := "secret", "other"
+	forwarding := Forwarding{User: "ssh-user", Server: "1.1.1.1:22", Password: &password}
+	same := forwarding
+	same.Servers = []string{"2.2.2.2:22"}
+	assert.Equal(t, forwarding.Identity(), same.Identity())
+
+	other := forwarding
+	other.Password = &otherPassword
+	assert.NotEqual(t, forwarding.Identity(), other.Identity())
+	other = forwarding
+	other.ConnectTimeout = time.Second
+	assert.NotEqual(t, forwarding.Identity(), other.Identity())
+}
+
+func TestAuthMethods(t *testing.T) {
+	cfg, err := NewConfig([]byte("hosts:\n  worker:\n    forwarding:\n      private-key: id_rsa\n      password: secret\n" +
+		"      auth-methods: [password, private-key]\n"))
+	assert.NoError(t, err)
+	methods, err := cfg.Hosts["worker"].Forwarding.AuthMethodList()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{AuthPassword, AuthPrivateKey}, methods)
+
+	key, certificate, password := "id_rsa", "id_rsa-cert.pub", "secret"
+	forwarding := Forwarding{PrivateKey: &key, Certificate: &certificate, Password: &password, AgentSocket: "/tmp/agent.sock"}
+	methods, err = forwarding.AuthMethodList()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{AuthAgent, AuthCertificate, AuthPrivateKey, AuthPassword}, methods)
+
+	_, err = NewConfig([]byte("hosts:\n  worker:\n    forwarding:\n      private-key: id_rsa\n      auth-methods: [password]\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("hosts:\n  worker:\n    forwarding:\n      auth-methods: [gssapi]\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("hosts:\n  worker:\n    forwarding:\n      auth-methods: [agent, agent]\n"))
+	assert.Error(t, err)
+}
+
 func TestEmptyConfig(t *testing.T) {
 	var bytes []byte
 	_, err := NewConfig(bytes)
 	assert.NoError(t, err)
 }
+
+func TestRuntimeHosts(t *testing.T) {
+	cfg, err := FromFile("testdata/config.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"master", "worker-1", "worker-2"}, cfg.HostNames())
+
+	cfg.SetHost("worker-3", Host{Address: "5.5.5.5:8081"})
+	host, ok := cfg.Host("worker-3")
+	assert.True(t, ok)
+	assert.Equal(t, "5.5.5.5:8081", host.Address)
+	assert.Len(t, cfg.AllHosts(), 4)
+
+	assert.True(t, cfg.RemoveHost("worker-3"))
+	assert.False(t, cfg.RemoveHost("worker-3"))
+	_, ok = cfg.Host("worker-3")
+	assert.False(t, ok)
+}
+
+func TestDiscoveredHosts(t *testing.T) {
+	cfg, err := FromFile("testdata/config.yml")
+	assert.NoError(t, err)
+
+	changed := cfg.SetDiscoveredHosts("spark#0", map[string]Host{
+		"spark-worker": {Address: "10.0.0.5:8081"},
+		"master":       {Address: "10.0.0.1:8080"},
+	})
+	assert.Equal(t, []string{"master", "spark-worker"}, changed)
+	host, ok := cfg.Host("spark-worker")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.5:8081", host.Address)
+	host, _ = cfg.Host("master")
+	assert.Equal(t, "1.1.1.1:8080", host.Address)
+	assert.Equal(t, "1.1.1.1:8080", cfg.AllHosts()["master"].Address)
+	assert.Equal(t, []string{"master", "spark-worker", "worker-1", "worker-2"}, cfg.HostNames())
+	assert.NotContains(t, cfg.Redacted().Hosts, "spark-worker")
+	assert.Equal(t, "10.0.0.5:8081", cfg.Redacted().DiscoveredHosts["spark#0"]["spark-worker"].Address)
+
+	changed = cfg.SetDiscoveredHosts("spark#0", map[string]Host{"spark-worker": {Address: "10.0.0.5:8081"}})
+	assert.Equal(t, []string{"master"}, changed)
+	assert.False(t, cfg.RemoveHost("spark-worker"))
+	changed = cfg.SetDiscoveredHosts("spark#0", nil)
+	assert.Equal(t, []string{"spark-worker"}, changed)
+	_, ok = cfg.Host("spark-worker")
+	assert.False(t, ok)
+}
+
+func TestSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint
+	location := filepath.Join(dir, "config.yml")
+	yml, _ := ioutil.ReadFile("testdata/config.yml")
+	assert.NoError(t, ioutil.WriteFile(location, yml, 0600))
+
+	cfg, err := FromFile(location)
+	assert.NoError(t, err)
+	cfg.SetHost("worker-3", Host{Address: "5.5.5.5:8081"})
+	cfg.SetDiscoveredHosts("spark#0", map[string]Host{"spark-worker": {Address: "10.0.0.5:8081"}})
+	assert.NoError(t, cfg.Save())
+
+	// temporary file is renamed over the config and permissions are kept
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+	assert.Equal(t, os.FileMode(0600), files[0].Mode().Perm())
+
+	saved, err := FromFile(location)
+	assert.NoError(t, err)
+	assert.Equal(t, "5.5.5.5:8081", saved.Hosts["worker-3"].Address)
+	assert.Equal(t, "/path/to/private_key.pem", *saved.Hosts["worker-1"].Forwarding.PrivateKey)
+	assert.Equal(t, cfg.Auth, saved.Auth)
+	assert.NotContains(t, saved.Hosts, "spark-worker")
+	assert.Nil(t, saved.DiscoveredHosts)
+
+	unsaved, _ := NewConfig(yml)
+	assert.Error(t, unsaved.Save())
+}
+
+func TestRedacted(t *testing.T) {
+	cfg, err := FromFile("testdata/config.yml")
+	assert.NoError(t, err)
+	password := "ssh-password"
+	totp := "JBSWY3DPEHPK3PXP"
+	cfg.SetHost("worker-3", Host{Address: "5.5.5.5:8081", Forwarding: &Forwarding{
+		Password:            &password,
+		KeyboardInteractive: []KeyboardInteractiveAnswer{{Prompt: "password", Answer: &password}, {Prompt: "code", TOTP: &totp}},
+	}})
+
+	cfg.SetDiscoveredHosts("file-sd#1", map[string]Host{"node-1": {Address: "10.0.0.7:8081", Forwarding: &Forwarding{Password: &password}}})
+
+	redacted := cfg.Redacted()
+	assert.Equal(t, "******", *redacted.DiscoveredHosts["file-sd#1"]["node-1"].Forwarding.Password)
+	assert.Equal(t, "******", redacted.Auth.Tokens[0].Token)
+	assert.Equal(t, "ci", redacted.Auth.Tokens[0].User)
+	assert.Equal(t, "******", redacted.Auth.OIDC.ClientSecret)
+	assert.Equal(t, "******", redacted.Auth.OIDC.CookieSecret)
+	assert.Equal(t, "******", *redacted.Hosts["worker-3"].Forwarding.Password)
+	assert.Equal(t, "******", *redacted.Hosts["worker-3"].Forwarding.KeyboardInteractive[0].Answer)
+	assert.Equal(t, "******", *redacted.Hosts["worker-3"].Forwarding.KeyboardInteractive[1].TOTP)
+	assert.Equal(t, "******", redacted.Tracing.Headers["authorization"])
+
+	assert.Equal(t, "secret-token", cfg.Auth.Tokens[0].Token)
+	assert.Equal(t, "proxy-secret", cfg.Auth.OIDC.ClientSecret)
+	assert.Equal(t, "ssh-password", *cfg.Hosts["worker-3"].Forwarding.Password)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", *cfg.Hosts["worker-3"].Forwarding.KeyboardInteractive[1].TOTP)
+	assert.Equal(t, "Bearer tracing-token", cfg.Tracing.Headers["authorization"])
+}
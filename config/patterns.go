@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	patternIP   = "{ip}"
+	patternPort = "{port}"
+)
+
+var patternPlaceholders = strings.NewReplacer(
+	regexp.QuoteMeta(patternIP), `(?P<ip>\d{1,3}(?:\.\d{1,3}){3})`,
+	regexp.QuoteMeta(patternPort), `(?P<port>\d{1,5})`,
+)
+
+// compileHostPattern : regexp matching host names of the pattern, both {ip} and {port} are required
+func compileHostPattern(pattern string) (*regexp.Regexp, error) {
+	if strings.Count(pattern, patternIP) != 1 || strings.Count(pattern, patternPort) != 1 {
+		return nil, fmt.Errorf("Host pattern '%s' has to contain %s and %s once", pattern, patternIP, patternPort)
+	}
+	return regexp.Compile("^" + patternPlaceholders.Replace(regexp.QuoteMeta(pattern)) + "$")
+}
+
+// hostPatternMatcher : host pattern with compiled expression of names and parsed subnets
+type hostPatternMatcher struct {
+	pattern  string
+	expr     *regexp.Regexp
+	networks []*net.IPNet
+}
+
+// validateHostPatterns : checks patterns and subnets of host patterns, they are compiled once for lookups
+func (cfg *Config) validateHostPatterns() error {
+	cfg.patterns = make([]hostPatternMatcher, 0, len(cfg.HostPatterns))
+	for _, pattern := range cfg.sortedPatterns() {
+		hostPattern := cfg.HostPatterns[pattern]
+		expr, err := compileHostPattern(pattern)
+		if err != nil {
+			return err
+		}
+		if len(hostPattern.Subnets) == 0 {
+			return fmt.Errorf("Subnets of host pattern '%s' aren't configured", pattern)
+		}
+		matcher := hostPatternMatcher{pattern: pattern, expr: expr}
+		for _, subnet := range hostPattern.Subnets {
+			_, network, err := net.ParseCIDR(subnet)
+			if err != nil {
+				return fmt.Errorf("Invalid subnet of host pattern '%s': %v", pattern, err)
+			}
+			matcher.networks = append(matcher.networks, network)
+		}
+		cfg.patterns = append(cfg.patterns, matcher)
+	}
+	return nil
+}
+
+// patternHost : host of the first pattern in alphabetical order matching the name, its address is taken from the name
+func (cfg *Config) patternHost(name string) (Host, bool) {
+	for _, matcher := range cfg.patterns {
+		match := matcher.expr.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		ip, port := match[matcher.expr.SubexpIndex("ip")], match[matcher.expr.SubexpIndex("port")]
+		if !matcher.allows(ip) || !validPort(port) {
+			continue
+		}
+		host := cfg.HostPatterns[matcher.pattern].Host
+		host.Address = net.JoinHostPort(ip, port)
+		host.Addresses = nil
+		host.pattern = matcher.pattern
+		return host, true
+	}
+	return Host{}, false
+}
+
+// PatternHostName : returns name of the first host pattern allowing the address, links to such addresses are rewritten to it
+func (cfg *Config) PatternHostName(address string) (string, bool) {
+	ip, port, err := net.SplitHostPort(address)
+	if err != nil || !validPort(port) {
+		return "", false
+	}
+	for _, matcher := range cfg.patterns {
+		if matcher.allows(ip) {
+			return strings.NewReplacer(patternIP, ip, patternPort, port).Replace(matcher.pattern), true
+		}
+	}
+	return "", false
+}
+
+// validPort : names with port out of 1-65535 don't match patterns, so they aren't dialed
+func validPort(port string) bool {
+	number, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && number != 0
+}
+
+func (cfg *Config) sortedPatterns() []string {
+	patterns := make([]string, 0, len(cfg.HostPatterns))
+	for pattern := range cfg.HostPatterns {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// allows : reports whether IP belongs to one of subnets of the pattern
+func (matcher hostPatternMatcher) allows(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range matcher.networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestHostPatterns(t *testing.T) {
+	cfg, err := FromFile("testdata/config.yml")
+	assert.NoError(t, err)
+
+	host, ok := cfg.Host("node-10.1.1.7-8081")
+	assert.True(t, ok)
+	assert.Equal(t, "10.1.1.7:8081", host.Address)
+	assert.Equal(t, "3.3.3.3:22", host.Forwarding.Server)
+	assert.Equal(t, []string{"alice"}, host.AllowedUsers)
+	_, ok = cfg.Host("node-10.1.2.7-8081")
+	assert.False(t, ok)
+	_, ok = cfg.Host("node-10.1.1.7")
+	assert.False(t, ok)
+	for _, name := range []string{"node-10.1.1.7-99999", "node-10.1.1.7-65536", "node-10.1.1.7-0"} {
+		_, ok = cfg.Host(name)
+		assert.False(t, ok, name)
+	}
+	assert.NotContains(t, cfg.HostNames(), "node-10.1.1.7-8081")
+
+	cfg.SetHost("node-10.1.1.7-8081", Host{Address: "10.1.1.8:8081"})
+	host, _ = cfg.Host("node-10.1.1.7-8081")
+	assert.Equal(t, "10.1.1.8:8081", host.Address)
+
+	name, ok := cfg.PatternHostName("10.1.1.9:4040")
+	assert.True(t, ok)
+	assert.Equal(t, "node-10.1.1.9-4040", name)
+	_, ok = cfg.PatternHostName("192.168.0.1:4040")
+	assert.False(t, ok)
+	_, ok = cfg.PatternHostName("10.1.1.9:99999")
+	assert.False(t, ok)
+
+	assert.Equal(t, "******", *cfg.Redacted().HostPatterns["node-{ip}-{port}"].Forwarding.Password)
+	assert.Equal(t, "ssh-password", *cfg.HostPatterns["node-{ip}-{port}"].Forwarding.Password)
+}
+
+func TestInvalidHostPatterns(t *testing.T) {
+	_, err := NewConfig([]byte("host-patterns:\n    node-{ip}:\n        subnets: [10.1.1.0/24]\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("host-patterns:\n    node-{ip}-{port}:\n        subnets: [10.1.1.0]\n"))
+	assert.Error(t, err)
+	_, err = NewConfig([]byte("host-patterns:\n    node-{ip}-{port}:\n        forwarding:\n            server: 3.3.3.3:22\n"))
+	assert.Error(t, err)
+}
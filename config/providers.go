@@ -0,0 +1,202 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Discovery types of host providers of config, the other types query APIs of upstreams and are provided by proxy
+const (
+	DiscoveryDirectory = "directory"
+	DiscoveryFileSD    = "file-sd"
+	DiscoveryDNSSRV    = "dns-srv"
+)
+
+// fileHostLabel : label of file_sd target group which targets are addresses of one host
+const fileHostLabel = "host"
+
+// HostProvider : source of hosts which are found at runtime, they are merged into hosts with SetDiscoveredHosts.
+// Providers are queried with interval of discovery, files are polled rather than watched
+// so changes of network filesystems and of mounted volumes which swap symlinks are picked up as well
+type HostProvider interface {
+	Hosts(ctx context.Context) (map[string]Host, error)
+}
+
+// DialFunc : opens connection the same way as requests to the configured host are sent, directly if host name is empty
+type DialFunc func(ctx context.Context, hostName, network, address string) (net.Conn, error)
+
+// NewHostProvider : provider of directory, file-sd or dns-srv discovery, nameserver of dns-srv is queried with dial
+func (cfg *Config) NewHostProvider(discovery Discovery, dial DialFunc) (HostProvider, error) {
+	switch discovery.Type {
+	case DiscoveryDirectory:
+		if discovery.Path == "" {
+			return nil, fmt.Errorf("Path of %s discovery isn't configured", discovery.Type)
+		}
+		return &directoryProvider{discovery: discovery}, nil
+	case DiscoveryFileSD:
+		if discovery.Path == "" {
+			return nil, fmt.Errorf("Path of %s discovery isn't configured", discovery.Type)
+		}
+		return &fileSDProvider{config: cfg, discovery: discovery}, nil
+	case DiscoveryDNSSRV:
+		if discovery.Name == "" || discovery.Nameserver == "" {
+			return nil, fmt.Errorf("Name and nameserver of SRV record aren't configured")
+		}
+		return &dnsSRVProvider{config: cfg, discovery: discovery, dial: dial}, nil
+	default:
+		return nil, fmt.Errorf("Unknown discovery type '%s'", discovery.Type)
+	}
+}
+
+// DiscoveredHost : host reachable the same way as the host which it was discovered with
+func DiscoveredHost(template Host, address string) Host {
+	return Host{
+		Address:               address,
+		Forwarding:            template.Forwarding,
+		AllowedUsers:          template.AllowedUsers,
+		ConnectTimeout:        template.ConnectTimeout,
+		ResponseHeaderTimeout: template.ResponseHeaderTimeout,
+		OverallTimeout:        template.OverallTimeout,
+	}
+}
+
+// DiscoveredHostName : host name made of address which is safe to be used as the first segment of path, kind is optional
+func DiscoveredHostName(prefix, kind, address string) string {
+	if kind != "" {
+		prefix += kind + "-"
+	}
+	return prefix + strings.NewReplacer(".", "-", ":", "-").Replace(address)
+}
+
+// templateHost : configured host of discovery which discovered hosts are reached like, empty host is reached directly
+func (cfg *Config) templateHost(discovery Discovery) (Host, error) {
+	if discovery.Host == "" {
+		return Host{}, nil
+	}
+	template, ok := cfg.Host(discovery.Host)
+	if !ok {
+		return Host{}, fmt.Errorf("Host '%s' of %s discovery not found", discovery.Host, discovery.Type)
+	}
+	return template, nil
+}
+
+// directoryProvider : reads hosts of YAML fragments of directory
+type directoryProvider struct {
+	discovery Discovery
+}
+
+func (provider *directoryProvider) Hosts(ctx context.Context) (map[string]Host, error) {
+	fragments, err := HostsFromDirectory(provider.discovery.Path)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string]Host, len(fragments))
+	for name, host := range fragments {
+		hosts[provider.discovery.Prefix+name] = host
+	}
+	return hosts, nil
+}
+
+// fileSDProvider : reads hosts of JSON file in Prometheus file_sd format
+type fileSDProvider struct {
+	config    *Config
+	discovery Discovery
+}
+
+func (provider *fileSDProvider) Hosts(ctx context.Context) (map[string]Host, error) {
+	template, err := provider.config.templateHost(provider.discovery)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := TargetGroupsFromFile(provider.discovery.Path)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string]Host)
+	for _, group := range groups {
+		if len(group.Targets) == 0 {
+			continue
+		}
+		if name := group.Labels[fileHostLabel]; name != "" {
+			// targets of the group are balanced addresses of one host
+			name = provider.discovery.Prefix + name
+			host, ok := hosts[name]
+			if !ok {
+				host = DiscoveredHost(template, "")
+			}
+			host.Addresses = append(host.Addresses, group.Targets...)
+			hosts[name] = host
+			continue
+		}
+		for _, target := range group.Targets {
+			hosts[DiscoveredHostName(provider.discovery.Prefix, "", target)] = DiscoveredHost(template, target)
+		}
+	}
+	return hosts, nil
+}
+
+// TargetGroup : group of targets in Prometheus file_sd format
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// HostsFromDirectory : reads hosts of YAML fragments (*.yml, *.yaml) of the directory.
+// Fragments have the same hosts section as config, they are read in alphabetical order and later ones override hosts of earlier ones
+func HostsFromDirectory(dir string) (map[string]Host, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read hosts directory: %v", err)
+	}
+	hosts := make(map[string]Host)
+	for _, file := range files {
+		extension := filepath.Ext(file.Name())
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || (extension != ".yml" && extension != ".yaml") {
+			continue
+		}
+		yml, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Can't read hosts fragment: %v", err)
+		}
+		var fragment struct {
+			Hosts map[string]Host `yaml:"hosts"`
+		}
+		if err = yaml.Unmarshal(yml, &fragment); err != nil {
+			return nil, fmt.Errorf("Invalid hosts fragment %s: %v", file.Name(), err)
+		}
+		for name, host := range fragment.Hosts {
+			if host.Forwarding != nil {
+				if _, err = host.Forwarding.AuthMethodList(); err != nil {
+					return nil, fmt.Errorf("Invalid forwarding of host '%s' in hosts fragment %s: %v", name, file.Name(), err)
+				}
+			}
+			if host.Balancing != nil {
+				if err = host.Balancing.Validate(); err != nil {
+					return nil, fmt.Errorf("Invalid balancing of host '%s' in hosts fragment %s: %v", name, file.Name(), err)
+				}
+			}
+			hosts[name] = host
+		}
+	}
+	return hosts, nil
+}
+
+// TargetGroupsFromFile : reads target groups of JSON file in Prometheus file_sd format
+func TargetGroupsFromFile(path string) ([]TargetGroup, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read targets file: %v", err)
+	}
+	var groups []TargetGroup
+	if err = json.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("Invalid targets file %s: %v", path, err)
+	}
+	return groups, nil
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// dnsSRVProvider : adds targets of SRV record as hosts, nameserver is queried through forwarding of the host
+// so internal DNS names are resolved remotely
+type dnsSRVProvider struct {
+	config    *Config
+	discovery Discovery
+	dial      DialFunc
+}
+
+func (provider *dnsSRVProvider) Hosts(ctx context.Context) (map[string]Host, error) {
+	template, err := provider.config.templateHost(provider.discovery)
+	if err != nil {
+		return nil, err
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		// channels of ssh connection are streams so DNS over TCP is used
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return provider.dial(ctx, provider.discovery.Host, "tcp", provider.discovery.Nameserver)
+		},
+	}
+	_, records, err := resolver.LookupSRV(ctx, "", "", provider.discovery.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Lookup of SRV record '%s' has been failed: %v", provider.discovery.Name, err)
+	}
+
+	hosts := make(map[string]Host)
+	for _, record := range records {
+		address := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		hosts[DiscoveredHostName(provider.discovery.Prefix, "", address)] = DiscoveredHost(template, address)
+	}
+	return hosts, nil
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestHostsFromDirectory(t *testing.T) {
+	hosts, err := HostsFromDirectory("testdata/hosts.d")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]Host{
+		"history":  {Address: "10.0.0.2:18080"},
+		"notebook": {Address: "10.0.0.4:8888", AllowedUsers: []string{"alice"}},
+	}, hosts)
+
+	_, err = HostsFromDirectory("testdata/missing.d")
+	assert.Error(t, err)
+
+	dir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "broken.yml"), []byte("hosts: ["), 0644))
+	_, err = HostsFromDirectory(dir)
+	assert.Error(t, err)
+
+	dir = t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "hosts.yml"),
+		[]byte("hosts:\n  notebook:\n    address: 10.0.0.4:8888\n    forwarding:\n      auth-methods: [password]\n"), 0644))
+	_, err = HostsFromDirectory(dir)
+	assert.Error(t, err)
+}
+
+func TestTargetGroupsFromFile(t *testing.T) {
+	groups, err := TargetGroupsFromFile("testdata/file_sd.json")
+	assert.NoError(t, err)
+	assert.Equal(t, []TargetGroup{
+		{Targets: []string{"10.0.0.5:9100", "10.0.0.6:9100"}},
+		{Targets: []string{"10.0.0.7:8080", "10.0.0.8:8080"}, Labels: map[string]string{"host": "api"}},
+	}, groups)
+
+	_, err = TargetGroupsFromFile("testdata/config.yml")
+	assert.Error(t, err)
+}
+
+func TestFileProviders(t *testing.T) {
+	dir := t.TempDir()
+	cfg, _ := FromFile("testdata/config.yml")
+
+	fragment := filepath.Join(dir, "notebook.yml")
+	assert.NoError(t, ioutil.WriteFile(fragment, []byte("hosts:\n    notebook:\n        address: 10.0.0.3:8888\n"), 0644))
+	provider, err := cfg.NewHostProvider(Discovery{Type: DiscoveryDirectory, Path: dir, Prefix: "dev-"}, nil)
+	assert.NoError(t, err)
+	hosts, err := provider.Hosts(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]Host{"dev-notebook": {Address: "10.0.0.3:8888"}}, hosts)
+
+	assert.NoError(t, ioutil.WriteFile(fragment, []byte("hosts:\n    notebook:\n        address: 10.0.0.4:8888\n"), 0644))
+	hosts, err = provider.Hosts(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.4:8888", hosts["dev-notebook"].Address)
+
+	targets := filepath.Join(dir, "targets.json")
+	assert.NoError(t, ioutil.WriteFile(targets, []byte(`[
+		{"targets": ["10.0.0.5:9100"]},
+		{"targets": ["10.0.0.7:8080"], "labels": {"host": "api"}},
+		{"targets": ["10.0.0.8:8080"], "labels": {"host": "api"}}
+	]`), 0644))
+	provider, err = cfg.NewHostProvider(Discovery{Type: DiscoveryFileSD, Path: targets, Host: "worker-1"}, nil)
+	assert.NoError(t, err)
+	hosts, err = provider.Hosts(context.Background())
+	assert.NoError(t, err)
+	worker, _ := cfg.Host("worker-1")
+	assert.Equal(t, "10.0.0.5:9100", hosts["10-0-0-5-9100"].Address)
+	assert.Equal(t, worker.Forwarding, hosts["10-0-0-5-9100"].Forwarding)
+	assert.Equal(t, []string{"10.0.0.7:8080", "10.0.0.8:8080"}, hosts["api"].AddressList())
+
+	cfg.SetDiscoveredHosts("file-sd#0", hosts)
+	_, ok := cfg.Host("api")
+	assert.True(t, ok)
+
+	_, err = cfg.NewHostProvider(Discovery{Type: DiscoveryFileSD}, nil)
+	assert.Error(t, err)
+	_, err = cfg.NewHostProvider(Discovery{Type: "consul"}, nil)
+	assert.Error(t, err)
+}
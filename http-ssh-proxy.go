@@ -1,17 +1,51 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/nawa/http-ssh-proxy/config"
 	"github.com/nawa/http-ssh-proxy/proxy"
+	"github.com/nawa/http-ssh-proxy/tracing"
 )
 
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	//TODO read config file name from arguments
 	cfg, err := config.FromFile("config.yml")
 	if err != nil {
 		log.Fatal(err)
 	}
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		log.Fatal(err)
+	}
 	httpServer := proxy.NewProxyServer(cfg)
+
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		log.Infof("Shutting down on %v", <-signals)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Warnf("Http server wasn't shut down gracefully: %v", err)
+		}
+		close(stopped)
+	}()
 	httpServer.Start()
+	<-stopped
+
+	// spans of the last batch are exported only on shutdown of tracer provider
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		log.Warnf("Traces weren't flushed: %v", err)
+	}
 }
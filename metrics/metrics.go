@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "http_ssh_proxy"
+
+var (
+	// Requests : proxied requests by host name and response status code
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Proxied requests by host name and response status code.",
+	}, []string{"host", "code"})
+
+	// RequestDuration : duration of proxied requests including links rewriting
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Duration of proxied requests including links rewriting.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"host", "code"})
+
+	// SSHDialDuration : duration of TCP connection establishment to ssh servers
+	SSHDialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ssh_dial_duration_seconds",
+		Help:      "Duration of TCP connection establishment to ssh servers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"server"})
+
+	// SSHHandshakeDuration : duration of ssh handshake including authentication
+	SSHHandshakeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ssh_handshake_duration_seconds",
+		Help:      "Duration of ssh handshake including authentication.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"server"})
+
+	// SSHConnectFailures : failed connections to ssh servers by stage (dial or handshake)
+	SSHConnectFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ssh_connect_failures_total",
+		Help:      "Failed connections to ssh servers by stage.",
+	}, []string{"server", "stage"})
+
+	// SSHOpenChannels : channels currently opened through pooled ssh connections
+	SSHOpenChannels = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ssh_open_channels",
+		Help:      "Channels currently opened through pooled ssh connections.",
+	}, []string{"server", "user"})
+
+	// RewriteDuration : duration of links rewriting in HTML responses
+	RewriteDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rewrite_duration_seconds",
+		Help:      "Duration of links rewriting in HTML responses.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	})
+
+	// RewrittenBytes : size of HTML responses passed through links rewriting
+	RewrittenBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rewritten_bytes_total",
+		Help:      "Size of HTML responses passed through links rewriting.",
+	})
+
+	// Errors : failed proxied requests by error kind
+	Errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "errors_total",
+		Help:      "Failed proxied requests by error kind.",
+	}, []string{"kind"})
+
+	// Panics : panics caught while requests handling by type (http_error or unexpected)
+	Panics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "panics_total",
+		Help:      "Panics caught while requests handling by type.",
+	}, []string{"type"})
+)
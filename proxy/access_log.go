@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// accessLogEntry : proxied request details filled by handlers while request is served
+type accessLogEntry struct {
+	Time            time.Time `json:"time"`
+	Client          string    `json:"client"`
+	User            string    `json:"user,omitempty"`
+	Method          string    `json:"method"`
+	Path            string    `json:"path"`
+	Protocol        string    `json:"protocol"`
+	Host            string    `json:"host,omitempty"`
+	Upstream        string    `json:"upstream,omitempty"`
+	Gateway         string    `json:"gateway,omitempty"`
+	UpstreamPath    string    `json:"upstream_path,omitempty"`
+	Status          int       `json:"status"`
+	BytesIn         int64     `json:"bytes_in"`
+	BytesOut        int64     `json:"bytes_out"`
+	Duration        float64   `json:"duration_ms"`
+	UpstreamLatency float64   `json:"upstream_latency_ms,omitempty"`
+	RewriteLatency  float64   `json:"rewrite_latency_ms,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	Referer         string    `json:"referer,omitempty"`
+	UserAgent       string    `json:"user_agent,omitempty"`
+}
+
+// requestLogEntry : returns access log entry of request or nil if access log is disabled
+func requestLogEntry(r *http.Request) *accessLogEntry {
+	entry, _ := r.Context().Value(accessLogContextKey).(*accessLogEntry)
+	return entry
+}
+
+// accessLogWriter : response writer which remembers status code and size of response
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Hijack : takes over connection of CONNECT request, it's logged as successful
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Connection can't be hijacked")
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return hijacker.Hijack()
+}
+
+// Flush : sends buffered data to client, streamed responses like server-sent events rely on it
+func (w *accessLogWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap : returns original response writer to http.ResponseController
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingReader : request body which counts read bytes
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func accessLogHandler(cfg *config.Config) func(http.Handler) http.Handler {
+	if cfg.AccessLog == nil {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	output := newAccessLogOutput(cfg.AccessLog)
+	format := cfg.AccessLog.Format
+	if format == "" {
+		format = config.AccessLogFormatCombined
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			entry := &accessLogEntry{
+				Time:      time.Now(),
+				Client:    clientIP(r),
+				Method:    r.Method,
+				Path:      r.URL.RequestURI(),
+				Protocol:  r.Proto,
+				Referer:   r.Referer(),
+				UserAgent: r.UserAgent(),
+			}
+			body := &countingReader{ReadCloser: r.Body}
+			if r.Body != nil {
+				r.Body = body
+			}
+			writer := &accessLogWriter{ResponseWriter: w}
+
+			defer func() {
+				entry.Status = writer.status
+				if entry.Status == 0 {
+					entry.Status = http.StatusOK
+				}
+				entry.BytesIn = body.bytes
+				entry.BytesOut = writer.bytes
+				entry.Duration = milliseconds(time.Since(entry.Time))
+				if _, err := io.WriteString(output, formatAccessLogEntry(entry, format)); err != nil {
+					log.Errorf("Can't write access log: %v", err)
+				}
+			}()
+			next.ServeHTTP(writer, r.WithContext(context.WithValue(r.Context(), accessLogContextKey, entry)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func newAccessLogOutput(accessLog *config.AccessLog) io.Writer {
+	if accessLog.File == "" {
+		return os.Stdout
+	}
+	return &lumberjack.Logger{
+		Filename:   accessLog.File,
+		MaxSize:    accessLog.MaxSizeMB,
+		MaxBackups: accessLog.MaxBackups,
+		MaxAge:     accessLog.MaxAgeDays,
+		Compress:   accessLog.Compress,
+	}
+}
+
+func formatAccessLogEntry(entry *accessLogEntry, format string) string {
+	switch format {
+	case config.AccessLogFormatJSON:
+		line, _ := json.Marshal(entry)
+		return string(line) + "\n"
+	case config.AccessLogFormatCommon:
+		return commonLogLine(entry) + "\n"
+	default:
+		return fmt.Sprintf("%s %q %q\n", commonLogLine(entry), dashIfEmpty(entry.Referer), dashIfEmpty(entry.UserAgent))
+	}
+}
+
+func commonLogLine(entry *accessLogEntry) string {
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %d`,
+		entry.Client,
+		dashIfEmpty(entry.User),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method, entry.Path, entry.Protocol,
+		entry.Status,
+		entry.BytesOut)
+}
+
+func dashIfEmpty(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return strings.TrimSpace(r.RemoteAddr)
+	}
+	return host
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
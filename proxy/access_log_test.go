@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestFormatAccessLogEntry(t *testing.T) {
+	entry := &accessLogEntry{
+		Time:      time.Date(2017, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		Client:    "127.0.0.1",
+		User:      "alice",
+		Method:    "GET",
+		Path:      "/worker-1/index.html",
+		Protocol:  "HTTP/1.1",
+		Status:    200,
+		BytesOut:  2326,
+		UserAgent: "Mozilla/5.0",
+	}
+	assert.Equal(t, `127.0.0.1 - alice [10/Oct/2017:13:55:36 -0700] "GET /worker-1/index.html HTTP/1.1" 200 2326`+"\n",
+		formatAccessLogEntry(entry, config.AccessLogFormatCommon))
+	assert.Equal(t, `127.0.0.1 - alice [10/Oct/2017:13:55:36 -0700] "GET /worker-1/index.html HTTP/1.1" 200 2326 "-" "Mozilla/5.0"`+"\n",
+		formatAccessLogEntry(entry, config.AccessLogFormatCombined))
+
+	var decoded map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(formatAccessLogEntry(entry, config.AccessLogFormatJSON)), &decoded))
+	assert.Equal(t, "alice", decoded["user"])
+	assert.Equal(t, float64(2326), decoded["bytes_out"])
+
+	// zero size is a real value unlike missed user
+	entry.User, entry.BytesOut = "", 0
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2017:13:55:36 -0700] "GET /worker-1/index.html HTTP/1.1" 200 0`+"\n",
+		formatAccessLogEntry(entry, config.AccessLogFormatCommon))
+}
+
+func TestAccessLogHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access-log")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.AccessLog = &config.AccessLog{Format: config.AccessLogFormatJSON, File: filepath.Join(dir, "access.log")}
+	handler := alice.New(accessLogHandler(cfg), recoverHandler).
+		ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body) // nolint
+			entry := requestLogEntry(r)
+			entry.Host = "worker-1"
+			entry.Upstream = "2.2.2.2:8081"
+			entry.Gateway = "3.3.3.3:22"
+			if strings.HasSuffix(r.URL.Path, "/missing") {
+				panic(HTTPError{Message: "missing", Code: http.StatusNotFound})
+			}
+			w.Write([]byte("response")) // nolint
+		})
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/worker-1/path", strings.NewReader("request body"))
+	request.RemoteAddr = "10.0.0.1:54321"
+	handler.ServeHTTP(recorder, request)
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/worker-1/missing", http.NoBody)
+	handler.ServeHTTP(recorder, request)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "access.log"))
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 2)
+
+	var entry accessLogEntry
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "10.0.0.1", entry.Client)
+	assert.Equal(t, "POST", entry.Method)
+	assert.Equal(t, "/worker-1/path", entry.Path)
+	assert.Equal(t, "worker-1", entry.Host)
+	assert.Equal(t, "2.2.2.2:8081", entry.Upstream)
+	assert.Equal(t, "3.3.3.3:22", entry.Gateway)
+	assert.Equal(t, http.StatusOK, entry.Status)
+	assert.Equal(t, int64(len("request body")), entry.BytesIn)
+	assert.Equal(t, int64(len("response")), entry.BytesOut)
+
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, http.StatusNotFound, entry.Status)
+}
+
+func TestAccessLogStreaming(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	events := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n")) // nolint
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer events.Close()
+
+	dir, err := ioutil.TempDir("", "access-log")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.AccessLog = &config.AccessLog{Format: config.AccessLogFormatJSON, File: filepath.Join(dir, "access.log")}
+	cfg.SetHost("events", config.Host{Address: strings.TrimPrefix(events.URL, "http://")})
+	proxyServer := httptest.NewServer(alice.New(accessLogHandler(cfg), recoverHandler).
+		Then(proxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore()))))
+	defer proxyServer.Close()
+
+	response, err := http.Get(proxyServer.URL + "/events/stream")
+	assert.NoError(t, err)
+	defer response.Body.Close() // nolint
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	// event must arrive while upstream still holds the response open
+	line := make(chan string, 1)
+	go func() {
+		text, _ := bufio.NewReader(response.Body).ReadString('\n')
+		line <- text
+	}()
+	select {
+	case text := <-line:
+		assert.Equal(t, "data: first\n", text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event isn't flushed through access log")
+	}
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+const adminAPIPath = reservedPathPrefix + "api/"
+
+// adminAPI : JSON API to inspect and change running proxy
+type adminAPI struct {
+	config    *config.Config
+	upstreams *upstreams
+	pool      *ssh.Pool
+}
+
+func adminAPIHandler(config *config.Config, upstreams *upstreams, pool *ssh.Pool) http.Handler {
+	api := &adminAPI{config: config, upstreams: upstreams, pool: pool}
+	return http.HandlerFunc(api.serveHTTP)
+}
+
+func (api *adminAPI) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if api.config.Admin == nil || !api.config.Admin.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if err := api.serve(w, r); err != nil {
+		writeError(w, r, err)
+	}
+}
+
+func (api *adminAPI) serve(w http.ResponseWriter, r *http.Request) *Error {
+	if !api.isAdmin(r) {
+		return apiError(ErrorForbidden, "Administration API isn't allowed")
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, adminAPIPath), "/")
+	switch {
+	case path == "hosts" && r.Method == http.MethodGet:
+		api.listHosts(w)
+	case strings.HasPrefix(path, "hosts/"):
+		hostName := strings.TrimPrefix(path, "hosts/")
+		switch r.Method {
+		case http.MethodGet:
+			return api.getHost(w, hostName)
+		case http.MethodPut:
+			return api.putHost(w, r, hostName)
+		case http.MethodDelete:
+			return api.deleteHost(w, hostName)
+		default:
+			return apiError(ErrorMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		}
+	case path == "clients" && r.Method == http.MethodGet:
+		writeJSONResponse(w, http.StatusOK, api.pool.Statuses())
+	case path == "clients/reconnect" && r.Method == http.MethodPost:
+		return api.reconnect(w, r)
+	case path == "config" && r.Method == http.MethodGet:
+		writeJSONResponse(w, http.StatusOK, api.config.Redacted())
+	default:
+		return apiError(ErrorNotFound, "Unknown API method %s %s", r.Method, r.URL.Path)
+	}
+	return nil
+}
+
+// apiError : failure of administration API request
+func apiError(kind ErrorKind, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// isAdmin : nobody is allowed if admin users aren't configured, anonymous users are never allowed
+func (api *adminAPI) isAdmin(r *http.Request) bool {
+	id := requestIdentity(r)
+	if id == nil {
+		return false
+	}
+	return containsString(api.config.Admin.Users, config.AdminAnyUser) || containsString(api.config.Admin.Users, id.user)
+}
+
+func (api *adminAPI) listHosts(w http.ResponseWriter) {
+	hosts := []hostStatus{}
+	for hostName, host := range api.config.AllHosts() {
+		hosts = append(hosts, newHostStatus(hostName, host, api.config, api.upstreams, api.pool))
+	}
+	sortHostStatuses(hosts)
+	writeJSONResponse(w, http.StatusOK, hosts)
+}
+
+func (api *adminAPI) getHost(w http.ResponseWriter, hostName string) *Error {
+	host, ok := api.config.Host(hostName)
+	if !ok {
+		return unknownHostError(hostName)
+	}
+	writeJSONResponse(w, http.StatusOK, newHostStatus(hostName, host, api.config, api.upstreams, api.pool))
+	return nil
+}
+
+func (api *adminAPI) putHost(w http.ResponseWriter, r *http.Request, hostName string) *Error {
+	if hostName == "" || strings.Contains(hostName, "/") || strings.HasPrefix(hostName, "_") {
+		return apiError(ErrorBadRequest, "Invalid host name '%s'", hostName)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return apiError(ErrorBadRequest, "Can't read request: %v", err)
+	}
+	var host config.Host
+	// JSON is valid YAML, so host could be sent in both formats using config keys
+	if err = yaml.Unmarshal(body, &host); err != nil {
+		return apiError(ErrorBadRequest, "Invalid host: %v", err)
+	}
+	if len(host.AddressList()) == 0 {
+		return apiError(ErrorBadRequest, "Host address is required")
+	}
+	if host.Forwarding != nil {
+		if _, err = host.Forwarding.AuthMethodList(); err != nil {
+			return apiError(ErrorBadRequest, "Invalid forwarding: %v", err)
+		}
+	}
+	if host.Balancing != nil {
+		if err = host.Balancing.Validate(); err != nil {
+			return apiError(ErrorBadRequest, "Invalid balancing: %v", err)
+		}
+	}
+	previous, exists := api.config.SetHost(hostName, host)
+	api.upstreams.remove(hostName)
+	if exists {
+		releaseClients(api.config, api.pool, previous.Forwarding)
+	}
+	log.Infof("Host '%s' has been set to %s using administration API", hostName, strings.Join(host.AddressList(), ", "))
+	if err := api.persist(); err != nil {
+		return err
+	}
+
+	code := http.StatusOK
+	if !exists {
+		code = http.StatusCreated
+	}
+	writeJSONResponse(w, code, newHostStatus(hostName, host, api.config, api.upstreams, api.pool))
+	return nil
+}
+
+func (api *adminAPI) deleteHost(w http.ResponseWriter, hostName string) *Error {
+	host, _ := api.config.Host(hostName)
+	if !api.config.RemoveHost(hostName) {
+		return unknownHostError(hostName)
+	}
+	api.upstreams.remove(hostName)
+	releaseClients(api.config, api.pool, host.Forwarding)
+	log.Infof("Host '%s' has been removed using administration API", hostName)
+	if err := api.persist(); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (api *adminAPI) reconnect(w http.ResponseWriter, r *http.Request) *Error {
+	server := r.URL.Query().Get("server")
+	user := r.URL.Query().Get("user")
+	if server == "" {
+		return apiError(ErrorBadRequest, "Parameter 'server' is required")
+	}
+	statuses := []ssh.Status{}
+	for _, client := range api.pool.Clients() {
+		if client.Server != server || (user != "" && client.User != user) {
+			continue
+		}
+		if err := client.Reconnect(); err != nil {
+			log.Warnf("Can't reconnect to %s@%s: %v", client.User, client.Server, err)
+		}
+		statuses = append(statuses, client.Status())
+	}
+	if len(statuses) == 0 {
+		return apiError(ErrorNotFound, "No ssh connections to '%s'", server)
+	}
+	writeJSONResponse(w, http.StatusOK, statuses)
+	return nil
+}
+
+func (api *adminAPI) persist() *Error {
+	if !api.config.Admin.Persist {
+		return nil
+	}
+	if err := api.config.Save(); err != nil {
+		return apiError(ErrorInternal, "Change is applied but isn't persisted: %v", err)
+	}
+	return nil
+}
+
+func writeJSONResponse(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Errorf("Can't write JSON response: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestAdminAPIHosts(t *testing.T) {
+	cfg, handler := adminAPITestHandler()
+
+	recorder := doTestRequest(handler, "GET", "/_proxy/api/hosts", "", withIdentityOf("alice"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var hosts []hostStatus
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &hosts))
+	assert.Len(t, hosts, 3)
+	assert.Equal(t, "master", hosts[0].Name)
+	assert.Equal(t, "3.3.3.3:22", hosts[1].Gateway)
+
+	recorder = doTestRequest(handler, "PUT", "/_proxy/api/hosts/worker-3",
+		`{"address": "5.5.5.5:8081", "forwarding": {"server": "3.3.3.3:22", "user": "ssh-user"}}`, withIdentityOf("alice"))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	host, ok := cfg.Host("worker-3")
+	assert.True(t, ok)
+	assert.Equal(t, "5.5.5.5:8081", host.Address)
+	assert.Equal(t, "3.3.3.3:22", host.Forwarding.Server)
+
+	recorder = doTestRequest(handler, "GET", "/_proxy/api/hosts/worker-3", "", withIdentityOf("alice"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"address": "5.5.5.5:8081"`)
+
+	recorder = doTestRequest(handler, "PUT", "/_proxy/api/hosts/worker-3", `{"forwarding": {}}`, withIdentityOf("alice"))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = doTestRequest(handler, "PUT", "/_proxy/api/hosts/worker-3",
+		`{"address": "5.5.5.5:8081", "forwarding": {"server": "3.3.3.3:22", "user": "ssh-user", "auth-methods": ["password"]}}`, withIdentityOf("alice"))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	host, _ = cfg.Host("worker-3")
+	assert.Empty(t, host.Forwarding.AuthMethods)
+
+	recorder = doTestRequest(handler, "DELETE", "/_proxy/api/hosts/worker-3", "", withIdentityOf("alice"))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	_, ok = cfg.Host("worker-3")
+	assert.False(t, ok)
+
+	recorder = doTestRequest(handler, "DELETE", "/_proxy/api/hosts/worker-3", "", withIdentityOf("alice"))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestAdminAPIHostMatchingPattern(t *testing.T) {
+	cfg, handler := adminAPITestHandler()
+	_, ok := cfg.Host("node-10.1.1.9-8080")
+	assert.True(t, ok)
+
+	recorder := doTestRequest(handler, "PUT", "/_proxy/api/hosts/node-10.1.1.9-8080", `{"address": "10.1.1.9:8080"}`, withIdentityOf("alice"))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	host, _ := cfg.Host("node-10.1.1.9-8080")
+	assert.Empty(t, host.Pattern())
+	assert.Nil(t, host.Forwarding)
+
+	recorder = doTestRequest(handler, "PUT", "/_proxy/api/hosts/node-10.1.1.9-8080", `{"address": "10.1.1.9:8081"}`, withIdentityOf("alice"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestAdminAPIConfig(t *testing.T) {
+	_, handler := adminAPITestHandler()
+
+	recorder := doTestRequest(handler, "GET", "/_proxy/api/config", "", withIdentityOf("alice"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"token": "******"`)
+	assert.NotContains(t, recorder.Body.String(), "secret-token")
+	assert.NotContains(t, recorder.Body.String(), "proxy-secret")
+}
+
+func TestAdminAPIClients(t *testing.T) {
+	_, handler := adminAPITestHandler()
+
+	recorder := doTestRequest(handler, "GET", "/_proxy/api/clients", "", withIdentityOf("alice"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "[]\n", recorder.Body.String())
+
+	recorder = doTestRequest(handler, "POST", "/_proxy/api/clients/reconnect?server=3.3.3.3:22", "", withIdentityOf("alice"))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = doTestRequest(handler, "POST", "/_proxy/api/clients/reconnect", "", withIdentityOf("alice"))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestAdminAPIAccess(t *testing.T) {
+	cfg, handler := adminAPITestHandler()
+
+	recorder := doTestRequest(handler, "GET", "/_proxy/api/hosts", "", withIdentityOf("bob"))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	recorder = doTestRequest(handler, "GET", "/_proxy/api/hosts", "", withIdentityOf(""))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	cfg.Admin.Users = nil
+	recorder = doTestRequest(handler, "GET", "/_proxy/api/hosts", "", withIdentityOf("alice"))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	cfg.Admin.Users = []string{"*"}
+	recorder = doTestRequest(handler, "GET", "/_proxy/api/hosts", "", withIdentityOf("bob"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	recorder = doTestRequest(handler, "GET", "/_proxy/api/hosts", "", withIdentityOf(""))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	cfg.Admin.Enabled = false
+	recorder = doTestRequest(handler, "GET", "/_proxy/api/hosts", "", withIdentityOf("alice"))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestAdminAPIReleasesClients(t *testing.T) {
+	gateway := newTestSSHServer(t)
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	handler := adminAPIHandler(cfg, upstreams, upstreams.pool)
+	connect := func(hostName string) {
+		host, _ := cfg.Host(hostName)
+		tunnel, err := createTunnel(host, upstreams.pool, upstreams.prompts)
+		assert.NoError(t, err)
+		_, err = upstreams.pool.Client(tunnel).Connect()
+		assert.NoError(t, err)
+	}
+	cfg.SetHost("first", config.Host{Address: "10.1.1.1:8080", Forwarding: gateway.forwarding()})
+	cfg.SetHost("second", config.Host{Address: "10.1.1.2:8080", Forwarding: gateway.forwarding()})
+	connect("first")
+	assert.Len(t, upstreams.pool.Statuses(), 1)
+
+	// connection is still used by the second host
+	recorder := doTestRequest(handler, "DELETE", "/_proxy/api/hosts/first", "", withIdentityOf("alice"))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Len(t, upstreams.pool.Statuses(), 1)
+
+	// connection with old password isn't kept after the last host using it is changed
+	recorder = doTestRequest(handler, "PUT", "/_proxy/api/hosts/second", fmt.Sprintf(
+		`{"address": "10.1.1.2:8080", "forwarding": {"server": "%s", "user": "%s", "password": "changed"}}`, gateway.Address, testSSHUser), withIdentityOf("alice"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Empty(t, upstreams.pool.Statuses())
+}
+
+func adminAPITestHandler() (*config.Config, http.Handler) {
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	return cfg, adminAPIHandler(cfg, upstreams, upstreams.pool)
+}
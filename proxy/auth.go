@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type contextKey int
+
+const (
+	identityContextKey contextKey = iota
+	accessLogContextKey
+	proxyRequestContextKey
+	backendContextKey
+)
+
+const (
+	defaultRealm = "http-ssh-proxy"
+	// passwordCacheTTL : how long verified password is accepted without checking bcrypt hash again
+	passwordCacheTTL = time.Minute
+)
+
+// identity : authenticated user
+type identity struct {
+	user string
+	// hosts allowed to the user, nil means that access isn't restricted
+	hosts []string
+}
+
+// authenticator : checks credentials of incoming requests against configured users
+type authenticator struct {
+	realm     string
+	passwords map[string][]byte
+	tokens    map[string]string
+	loadError error
+	// dummyHash : compared for unknown users so they take as long to reject as wrong passwords
+	dummyHash []byte
+
+	verifiedLock sync.Mutex
+	// verified : expiration time of verified credentials by their digest, bcrypt is too slow for every request
+	verified map[[sha256.Size]byte]time.Time
+}
+
+func newAuthenticator(auth *config.Auth) *authenticator {
+	authenticator := &authenticator{
+		realm:    auth.Realm,
+		tokens:   make(map[string]string),
+		verified: make(map[[sha256.Size]byte]time.Time),
+	}
+	if authenticator.realm == "" {
+		authenticator.realm = defaultRealm
+	}
+	for _, token := range auth.Tokens {
+		authenticator.tokens[token.Token] = token.User
+	}
+	if auth.Htpasswd != nil {
+		authenticator.passwords, authenticator.loadError = readHtpasswd(*auth.Htpasswd)
+		if authenticator.loadError != nil {
+			log.Errorf("Can't load htpasswd file, all requests will be rejected: %v", authenticator.loadError)
+		}
+		authenticator.dummyHash = newDummyHash(authenticator.passwords)
+	}
+	return authenticator
+}
+
+// newDummyHash : returns hash of random password with the same cost as configured ones
+func newDummyHash(passwords map[string][]byte) []byte {
+	cost := bcrypt.DefaultCost
+	for _, hash := range passwords {
+		if hashCost, err := bcrypt.Cost(hash); err == nil {
+			cost = hashCost
+			break
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(randomString()), cost)
+	if err != nil {
+		log.Panicf("Can't generate password hash: %v", err)
+	}
+	return hash
+}
+
+// authenticate : returns user which sent the request or nil if credentials are missed or wrong
+func (authenticator *authenticator) authenticate(r *http.Request) *identity {
+	return authenticator.authenticateHeader(r.Header.Get("Authorization"))
+}
+
+// authenticateProxy : returns user of forward proxy request using Proxy-Authorization header
+func (authenticator *authenticator) authenticateProxy(r *http.Request) *identity {
+	return authenticator.authenticateHeader(r.Header.Get("Proxy-Authorization"))
+}
+
+func (authenticator *authenticator) authenticateHeader(authorization string) *identity {
+	if strings.HasPrefix(authorization, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+		if token == "" {
+			return nil
+		}
+		for expected, user := range authenticator.tokens {
+			if subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1 {
+				return &identity{user: user}
+			}
+		}
+		return nil
+	}
+	user, password, ok := parseBasicAuth(authorization)
+	if !ok {
+		return nil
+	}
+	return authenticator.authenticatePassword(user, password)
+}
+
+// authenticatePassword : returns user of htpasswd file or nil if password is wrong
+func (authenticator *authenticator) authenticatePassword(user, password string) *identity {
+	hash, ok := authenticator.passwords[user]
+	if !ok {
+		if authenticator.dummyHash != nil {
+			bcrypt.CompareHashAndPassword(authenticator.dummyHash, []byte(password)) // nolint
+		}
+		return nil
+	}
+	digest := passwordDigest(user, password, hash)
+	if authenticator.isVerified(digest) {
+		return &identity{user: user}
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return nil
+	}
+	authenticator.setVerified(digest)
+	return &identity{user: user}
+}
+
+// passwordDigest : cache key of credentials, the hash is included so changed password isn't accepted by cache
+func passwordDigest(user, password string, hash []byte) [sha256.Size]byte {
+	return sha256.Sum256([]byte(user + "\x00" + password + "\x00" + string(hash)))
+}
+
+func (authenticator *authenticator) isVerified(digest [sha256.Size]byte) bool {
+	authenticator.verifiedLock.Lock()
+	defer authenticator.verifiedLock.Unlock()
+	expires, ok := authenticator.verified[digest]
+	return ok && time.Now().Before(expires)
+}
+
+func (authenticator *authenticator) setVerified(digest [sha256.Size]byte) {
+	authenticator.verifiedLock.Lock()
+	defer authenticator.verifiedLock.Unlock()
+	now := time.Now()
+	for cached, expires := range authenticator.verified {
+		if !now.Before(expires) {
+			delete(authenticator.verified, cached)
+		}
+	}
+	authenticator.verified[digest] = now.Add(passwordCacheTTL)
+}
+
+func authHandler(cfg *config.Config) func(http.Handler) http.Handler {
+	if cfg.Auth == nil {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	authenticator := newAuthenticator(cfg.Auth)
+	var oidcAuthenticator *oidcAuthenticator
+	if cfg.Auth.OIDC != nil {
+		oidcAuthenticator = newOIDCAuthenticator(cfg.Auth.OIDC)
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if authenticator.loadError != nil {
+				writeError(w, r, &Error{Kind: ErrorInternal, Err: fmt.Errorf("Authentication is misconfigured")})
+				return
+			}
+			if oidcAuthenticator != nil && r.URL.Path == oidcCallbackPath {
+				oidcAuthenticator.handleCallback(w, r)
+				return
+			}
+			id := authenticator.authenticate(r)
+			if id == nil && oidcAuthenticator != nil {
+				id = oidcAuthenticator.authenticate(r)
+			}
+			if id == nil && r.URL.Path == pacPath {
+				// browsers fetch PAC file without credentials, anonymous user gets only routes allowed to everybody
+				id = &identity{}
+			}
+			if id == nil {
+				if oidcAuthenticator != nil && r.Method == http.MethodGet && r.Header.Get("Authorization") == "" {
+					oidcAuthenticator.redirectToLogin(w, r)
+					return
+				}
+				if authenticator.passwords != nil {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, authenticator.realm))
+				}
+				writeError(w, r, &Error{Kind: ErrorUnauthorized, Err: fmt.Errorf("%s", http.StatusText(http.StatusUnauthorized))})
+				return
+			}
+			if !isInternalPath(cfg, r.URL.Path) {
+				hostName, _ := parseHostName(r.URL, cfg)
+				if !isUserAllowed(cfg, hostName, id) {
+					writeError(w, r, &Error{Kind: ErrorForbidden, Host: hostName,
+						Err: fmt.Errorf("User '%s' isn't allowed to access '%s'", id.user, hostName)})
+					return
+				}
+			}
+			if entry := requestLogEntry(r); entry != nil {
+				entry.User = id.user
+			}
+			// proxy credentials must not leak to proxied hosts
+			r.Header.Del("Authorization")
+			removeCookies(r, sessionCookieName, oidcStateCookieName)
+			next.ServeHTTP(w, r.WithContext(withIdentity(r, id)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// parseBasicAuth : returns credentials of Basic authorization header value
+func parseBasicAuth(authorization string) (user, password string, ok bool) {
+	const prefix = "Basic "
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return
+	}
+	decoded, err := base64.StdEncoding.DecodeString(authorization[len(prefix):])
+	if err != nil {
+		return
+	}
+	user, password, ok = strings.Cut(string(decoded), ":")
+	return
+}
+
+func isUserAllowed(cfg *config.Config, hostName string, id *identity) bool {
+	if id.hosts != nil && !containsString(id.hosts, hostName) && !containsString(id.hosts, "*") {
+		return false
+	}
+	host, ok := cfg.Host(hostName)
+	if !ok || len(host.AllowedUsers) == 0 {
+		return true
+	}
+	return containsString(host.AllowedUsers, id.user)
+}
+
+func withIdentity(r *http.Request, id *identity) context.Context {
+	return context.WithValue(r.Context(), identityContextKey, id)
+}
+
+// requestIdentity : returns authenticated user or nil if authentication is disabled
+func requestIdentity(r *http.Request) *identity {
+	id, _ := r.Context().Value(identityContextKey).(*identity)
+	return id
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func removeCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if !containsString(names, cookie.Name) {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+func readHtpasswd(location string) (map[string][]byte, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // nolint
+
+	passwords := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid htpasswd line for '%s'", parts[0])
+		}
+		if !strings.HasPrefix(parts[1], "$2") {
+			log.Warnf("Password of user '%s' isn't hashed with bcrypt and will be ignored", parts[0])
+			continue
+		}
+		passwords[parts[0]] = []byte(parts[1])
+	}
+	return passwords, scanner.Err()
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/nawa/http-ssh-proxy/config"
+	assert "github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestReadHtpasswd(t *testing.T) {
+	passwords, err := readHtpasswd("testdata/htpasswd")
+	assert.NoError(t, err)
+	assert.Len(t, passwords, 2)
+	assert.Contains(t, passwords, "alice")
+	assert.Contains(t, passwords, "bob")
+
+	_, err = readHtpasswd("testdata/htpasswd_missing")
+	assert.Error(t, err)
+}
+
+func TestAuthHandler(t *testing.T) {
+	handler := authTestHandler(htpasswdAuth("testdata/htpasswd"))
+
+	recorder := doTestRequest(handler, "GET", "/worker-2/", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, `Basic realm="cluster"`, recorder.HeaderMap.Get("WWW-Authenticate"))
+
+	recorder = doTestRequest(handler, "GET", "/worker-2/", "", func(r *http.Request) {
+		r.SetBasicAuth("alice", "wrong-password")
+	})
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	recorder = doTestRequest(handler, "GET", "/worker-2/", "", func(r *http.Request) {
+		r.SetBasicAuth("bob", "bob-password")
+	})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "bob", recorder.Body.String())
+
+	recorder = doTestRequest(handler, "GET", "/worker-1/", "", func(r *http.Request) {
+		r.SetBasicAuth("bob", "bob-password")
+	})
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	recorder = doTestRequest(handler, "GET", "/worker-1/", "", func(r *http.Request) {
+		r.SetBasicAuth("alice", "alice-password")
+	})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "alice", recorder.Body.String())
+
+	recorder = doTestRequest(handler, "GET", "/worker-2/", "", func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer secret-token")
+	})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "ci", recorder.Body.String())
+
+	recorder = doTestRequest(handler, "GET", "/worker-2/", "", func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer wrong-token")
+	})
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestEmptyBearerToken(t *testing.T) {
+	authenticator := newAuthenticator(&config.Auth{Tokens: []config.Token{{User: "ci", Token: ""}}})
+	assert.Nil(t, authenticator.authenticateHeader("Bearer "))
+	assert.Nil(t, authenticator.authenticateHeader("Bearer  "))
+}
+
+func TestAuthenticatePassword(t *testing.T) {
+	htpasswd := "testdata/htpasswd"
+	authenticator := newAuthenticator(&config.Auth{Htpasswd: &htpasswd})
+	cost, err := bcrypt.Cost(authenticator.dummyHash)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, cost)
+
+	assert.Nil(t, authenticator.authenticatePassword("nobody", "alice-password"))
+	assert.Nil(t, authenticator.authenticatePassword("alice", "wrong-password"))
+	assert.Empty(t, authenticator.verified)
+
+	assert.Equal(t, "alice", authenticator.authenticatePassword("alice", "alice-password").user)
+	assert.Len(t, authenticator.verified, 1)
+	assert.Equal(t, "alice", authenticator.authenticatePassword("alice", "alice-password").user)
+	assert.Nil(t, authenticator.authenticatePassword("alice", "wrong-password"))
+
+	// expired entries are checked against the hash again and dropped
+	for digest := range authenticator.verified {
+		authenticator.verified[digest] = time.Now().Add(-time.Second)
+	}
+	assert.Equal(t, "bob", authenticator.authenticatePassword("bob", "bob-password").user)
+	assert.Len(t, authenticator.verified, 1)
+	assert.Equal(t, "alice", authenticator.authenticatePassword("alice", "alice-password").user)
+	assert.Len(t, authenticator.verified, 2)
+}
+
+func TestAuthHandlerMisconfigured(t *testing.T) {
+	handler := authTestHandler(htpasswdAuth("testdata/htpasswd_missing"))
+
+	recorder := doTestRequest(handler, "GET", "/worker-2/", "", func(r *http.Request) {
+		r.SetBasicAuth("alice", "alice-password")
+	})
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+}
+
+func TestAuthHandlerErrors(t *testing.T) {
+	handler := authTestHandler(htpasswdAuth("testdata/htpasswd"))
+	var response errorResponse
+
+	recorder := doTestRequest(handler, "GET", "/worker-2/", "", func(r *http.Request) {
+		r.Header.Set("Accept", "application/json")
+	})
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, ErrorUnauthorized, response.Kind)
+
+	recorder = doTestRequest(handler, "GET", "/worker-1/", "", func(r *http.Request) {
+		r.Header.Set("Accept", "application/json")
+		r.SetBasicAuth("bob", "bob-password")
+	})
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, ErrorForbidden, response.Kind)
+	assert.Equal(t, "worker-1", response.Host)
+
+	recorder = doTestRequest(authTestHandler(htpasswdAuth("testdata/htpasswd_missing")), "GET", "/worker-2/", "", func(r *http.Request) {
+		r.Header.Set("Accept", "application/json")
+	})
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, ErrorInternal, response.Kind)
+}
+
+func htpasswdAuth(htpasswd string) func(auth *config.Auth) {
+	return func(auth *config.Auth) {
+		auth.Htpasswd = &htpasswd
+		auth.OIDC = nil
+	}
+}
+
+// authTestHandler : handler behind authentication of test config which responds with name of authenticated user,
+// configure changes auth settings before the handler is created
+func authTestHandler(configure func(auth *config.Auth)) http.Handler {
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	configure(cfg.Auth)
+	return alice.New(recoverHandler, authHandler(cfg)).
+		ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "" {
+				http.Error(w, "credentials were forwarded", http.StatusInternalServerError)
+				return
+			}
+			if _, err := r.Cookie(sessionCookieName); err == nil {
+				http.Error(w, "session cookie was forwarded", http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(requestIdentity(r).user)) // nolint
+		})
+}
+
+// doTestRequest : serves request to proxy at localhost:8888, prepare adds credentials, cookies or identity to it
+func doTestRequest(handler http.Handler, method, path, body string, prepare func(r *http.Request)) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest(method, path, strings.NewReader(body))
+	request.Host = "localhost:8888"
+	if prepare != nil {
+		prepare(request)
+	}
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// withIdentityOf : request of the user authenticated before it reaches the handler, empty user is anonymous
+func withIdentityOf(user string) func(r *http.Request) {
+	return func(r *http.Request) {
+		if user != "" {
+			*r = *r.WithContext(withIdentity(r, &identity{user: user}))
+		}
+	}
+}
+
+// withCookies : request of browser with the cookies
+func withCookies(cookies []*http.Cookie) func(r *http.Request) {
+	return func(r *http.Request) {
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+)
+
+const (
+	defaultBalancingCookie = "_proxy_backend"
+	defaultMaxFails        = 3
+	defaultEjectFor        = 30 * time.Second
+)
+
+// backends : equivalent addresses of the host and their state
+type backends struct {
+	policy   string
+	cookie   string
+	maxFails int
+	ejectFor time.Duration
+
+	lock  sync.Mutex
+	items []*backend
+	next  int
+}
+
+// backend : address of the host which gets requests while it doesn't fail
+type backend struct {
+	address      string
+	active       int
+	fails        int
+	ejectedUntil time.Time
+}
+
+// backendStatus : state of backend shown on status page
+type backendStatus struct {
+	Address      string    `json:"address"`
+	Active       int       `json:"active"`
+	Ejected      bool      `json:"ejected"`
+	EjectedUntil time.Time `json:"ejected-until,omitempty"`
+}
+
+func newBackends(host config.Host) *backends {
+	backends := &backends{
+		policy:   config.BalancingRoundRobin,
+		cookie:   defaultBalancingCookie,
+		maxFails: defaultMaxFails,
+		ejectFor: defaultEjectFor,
+	}
+	if balancing := host.Balancing; balancing != nil {
+		if balancing.Policy != "" {
+			backends.policy = balancing.Policy
+		}
+		if balancing.Cookie != "" {
+			backends.cookie = balancing.Cookie
+		}
+		if balancing.MaxFails > 0 {
+			backends.maxFails = balancing.MaxFails
+		}
+		backends.ejectFor = durationOrDefault(balancing.EjectFor, defaultEjectFor)
+	}
+	for _, address := range host.AddressList() {
+		backends.items = append(backends.items, &backend{address: address})
+	}
+	return backends
+}
+
+// acquire : chooses backend for the request, it has to be released after request is done
+func (backends *backends) acquire(w http.ResponseWriter, r *http.Request, hostName string) *backend {
+	var stickyKey string
+	if backends.policy == config.BalancingCookieHash {
+		if cookie, err := r.Cookie(backends.cookie); err == nil && cookie.Value != "" {
+			stickyKey = cookie.Value
+		} else {
+			stickyKey = randomString()
+			http.SetCookie(w, &http.Cookie{Name: backends.cookie, Value: stickyKey, Path: "/" + hostName, HttpOnly: true})
+		}
+	}
+
+	backends.lock.Lock()
+	defer backends.lock.Unlock()
+	available := backends.available()
+	var chosen *backend
+	switch backends.policy {
+	case config.BalancingCookieHash:
+		chosen = rendezvous(available, stickyKey)
+	case config.BalancingLeastConnections:
+		chosen = backends.roundRobin(available, true)
+	default:
+		chosen = backends.roundRobin(available, false)
+	}
+	chosen.active++
+	return chosen
+}
+
+// release : finishes request to backend ejecting it after too many consecutive failures
+func (backends *backends) release(chosen *backend, failed bool) {
+	backends.lock.Lock()
+	defer backends.lock.Unlock()
+	chosen.active--
+	if !failed {
+		chosen.fails = 0
+		return
+	}
+	chosen.fails++
+	if chosen.fails >= backends.maxFails && len(backends.items) > 1 {
+		chosen.fails = 0
+		chosen.ejectedUntil = time.Now().Add(backends.ejectFor)
+		log.Warnf("Backend %s has been ejected for %v after %d failures", chosen.address, backends.ejectFor, backends.maxFails)
+	}
+}
+
+func (backends *backends) statuses() []backendStatus {
+	backends.lock.Lock()
+	defer backends.lock.Unlock()
+	now := time.Now()
+	statuses := make([]backendStatus, 0, len(backends.items))
+	for _, item := range backends.items {
+		status := backendStatus{Address: item.address, Active: item.active}
+		if item.ejectedUntil.After(now) {
+			status.Ejected = true
+			status.EjectedUntil = item.ejectedUntil
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// available : returns backends which aren't ejected or all of them if every backend is ejected
+func (backends *backends) available() []*backend {
+	now := time.Now()
+	available := make([]*backend, 0, len(backends.items))
+	for _, item := range backends.items {
+		if !item.ejectedUntil.After(now) {
+			available = append(available, item)
+		}
+	}
+	if len(available) == 0 {
+		return backends.items
+	}
+	return available
+}
+
+// roundRobin : returns the next backend in turn, the least loaded one is preferred if leastConnections is set
+func (backends *backends) roundRobin(available []*backend, leastConnections bool) *backend {
+	start := backends.next % len(available)
+	backends.next++
+	chosen := available[start]
+	if leastConnections {
+		for i := 1; i < len(available); i++ {
+			candidate := available[(start+i)%len(available)]
+			if candidate.active < chosen.active {
+				chosen = candidate
+			}
+		}
+	}
+	return chosen
+}
+
+// rendezvous : consistent choice of backend by key, only keys of ejected backend are moved to others
+func rendezvous(available []*backend, key string) *backend {
+	var chosen *backend
+	var maxWeight uint64
+	for _, item := range available {
+		hash := fnv.New64a()
+		hash.Write([]byte(key + "\x00" + item.address)) // nolint
+		if weight := hash.Sum64(); chosen == nil || weight > maxWeight {
+			chosen, maxWeight = item, weight
+		}
+	}
+	return chosen
+}
+
+func withBackend(ctx context.Context, chosen *backend) context.Context {
+	return context.WithValue(ctx, backendContextKey, chosen)
+}
+
+// backendDirector : sends request to the backend chosen for it instead of the default address of reverse proxy
+func backendDirector(director func(*http.Request)) func(*http.Request) {
+	return func(r *http.Request) {
+		director(r)
+		if chosen, ok := r.Context().Value(backendContextKey).(*backend); ok {
+			r.URL.Host = ssh.URLHost(chosen.address)
+		}
+	}
+}
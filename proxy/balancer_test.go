@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestBalancingPolicies(t *testing.T) {
+	host := config.Host{Address: "a:80", Addresses: []string{"b:80", "c:80"}}
+	request, _ := http.NewRequest("GET", "/pool/", nil)
+
+	roundRobin := newBackends(host)
+	var chosen []string
+	for i := 0; i < 4; i++ {
+		backend := roundRobin.acquire(httptest.NewRecorder(), request, "pool")
+		roundRobin.release(backend, false)
+		chosen = append(chosen, backend.address)
+	}
+	assert.Equal(t, []string{"a:80", "b:80", "c:80", "a:80"}, chosen)
+
+	host.Balancing = &config.Balancing{Policy: config.BalancingLeastConnections}
+	leastConnections := newBackends(host)
+	first := leastConnections.acquire(httptest.NewRecorder(), request, "pool")
+	second := leastConnections.acquire(httptest.NewRecorder(), request, "pool")
+	leastConnections.release(first, false)
+	third := leastConnections.acquire(httptest.NewRecorder(), request, "pool")
+	fourth := leastConnections.acquire(httptest.NewRecorder(), request, "pool")
+	assert.Equal(t, "a:80", first.address)
+	assert.Equal(t, "b:80", second.address)
+	assert.Equal(t, "c:80", third.address)
+	assert.Equal(t, "a:80", fourth.address)
+
+	host.Balancing = &config.Balancing{Policy: config.BalancingCookieHash, Cookie: "sticky"}
+	cookieHash := newBackends(host)
+	recorder := httptest.NewRecorder()
+	sticky := cookieHash.acquire(recorder, request, "pool")
+	cookieHash.release(sticky, false)
+	cookie := recorder.Result().Cookies()[0]
+	assert.Equal(t, "sticky", cookie.Name)
+	assert.Equal(t, "/pool", cookie.Path)
+	request.AddCookie(cookie)
+	for i := 0; i < 5; i++ {
+		recorder = httptest.NewRecorder()
+		backend := cookieHash.acquire(recorder, request, "pool")
+		cookieHash.release(backend, false)
+		assert.Equal(t, sticky.address, backend.address)
+		assert.Empty(t, recorder.Result().Cookies())
+	}
+}
+
+func TestBackendEjection(t *testing.T) {
+	host := config.Host{
+		Address:   "a:80",
+		Addresses: []string{"b:80"},
+		Balancing: &config.Balancing{Policy: config.BalancingCookieHash, MaxFails: 2, EjectFor: time.Minute},
+	}
+	request, _ := http.NewRequest("GET", "/pool/", nil)
+	request.AddCookie(&http.Cookie{Name: defaultBalancingCookie, Value: "client"})
+	backends := newBackends(host)
+
+	failing := backends.acquire(httptest.NewRecorder(), request, "pool")
+	backends.release(failing, true)
+	assert.Equal(t, failing, backends.acquire(httptest.NewRecorder(), request, "pool"))
+	backends.release(failing, true)
+
+	other := backends.acquire(httptest.NewRecorder(), request, "pool")
+	backends.release(other, false)
+	assert.NotEqual(t, failing.address, other.address)
+	for _, status := range backends.statuses() {
+		assert.Equal(t, status.Address == failing.address, status.Ejected)
+	}
+}
+
+func TestBalancingThroughSSH(t *testing.T) {
+	var servers []*httptest.Server
+	for _, name := range []string{"first", "second"} {
+		name := name
+		servers = append(servers, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name)) // nolint
+		})))
+	}
+	defer servers[0].Close()
+	defer servers[1].Close()
+	gateway := newTestSSHServer(t)
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("pool", config.Host{
+		Addresses: []string{
+			strings.TrimPrefix(servers[0].URL, "http://"),
+			strings.TrimPrefix(servers[1].URL, "http://"),
+		},
+		Forwarding: gateway.forwarding(),
+	})
+	handler := recoverHandler(proxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())))
+
+	var bodies []string
+	for i := 0; i < 3; i++ {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/pool/", nil)
+		handler.ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		bodies = append(bodies, recorder.Body.String())
+	}
+	assert.Equal(t, []string{"first", "second", "first"}, bodies)
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+)
+
+const (
+	discoverySpark = "spark"
+	discoveryYARN  = "yarn"
+
+	defaultDiscoveryInterval     = 30 * time.Second
+	defaultFileDiscoveryInterval = 5 * time.Second
+	discoveryTimeout             = 20 * time.Second
+)
+
+// newDiscoverer : provider of hosts which queries API of upstream for spark and yarn, other types are provided by config
+func newDiscoverer(cfg *config.Config, upstreams *upstreams, discovery config.Discovery) (config.HostProvider, error) {
+	switch discovery.Type {
+	case discoverySpark:
+		if discovery.Host == "" {
+			return nil, fmt.Errorf("Host of Spark master isn't configured")
+		}
+		return &sparkDiscoverer{config: cfg, upstreams: upstreams, discovery: discovery}, nil
+	case discoveryYARN:
+		if discovery.Host == "" {
+			return nil, fmt.Errorf("Host of ResourceManager isn't configured")
+		}
+		return &yarnDiscoverer{config: cfg, upstreams: upstreams, discovery: discovery}, nil
+	default:
+		return cfg.NewHostProvider(discovery, discoveryDialer(cfg, upstreams))
+	}
+}
+
+// discoveryDialer : dials through forwarding of the configured host for host providers of config
+func discoveryDialer(cfg *config.Config, upstreams *upstreams) config.DialFunc {
+	return func(ctx context.Context, hostName, network, address string) (net.Conn, error) {
+		var host config.Host
+		if hostName != "" {
+			var ok bool
+			if host, ok = cfg.Host(hostName); !ok {
+				return nil, fmt.Errorf("Host not found for '%s'", hostName)
+			}
+		}
+		dial, err := upstreams.dialer(hostName, host)
+		if err != nil {
+			return nil, err
+		}
+		return dial(ctx, network, address)
+	}
+}
+
+// startDiscovery : refreshes hosts of all discovery sources with their intervals until returned function is called.
+// Files are polled rather than watched, which needs no platform specific notifications and works for network filesystems
+func startDiscovery(cfg *config.Config, upstreams *upstreams) (stop func()) {
+	done := make(chan struct{})
+	for i, discovery := range cfg.Discovery {
+		source := fmt.Sprintf("%s#%d", discovery.Type, i)
+		discoverer, err := newDiscoverer(cfg, upstreams, discovery)
+		if err != nil {
+			log.Errorf("Discovery %s is disabled: %v", source, err)
+			continue
+		}
+		interval := durationOrDefault(discovery.Interval, defaultDiscoveryInterval)
+		if discovery.Type == config.DiscoveryDirectory || discovery.Type == config.DiscoveryFileSD {
+			interval = durationOrDefault(discovery.Interval, defaultFileDiscoveryInterval)
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				refreshDiscoveredHosts(cfg, upstreams, source, discoverer) // nolint
+				select {
+				case <-ticker.C:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// refreshDiscoveredHosts : replaces hosts of the source, previous hosts are kept if discovery fails
+func refreshDiscoveredHosts(cfg *config.Config, upstreams *upstreams, source string, discoverer config.HostProvider) error {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+	hosts, err := discoverer.Hosts(ctx)
+	if err != nil {
+		log.Warnf("Discovery %s has been failed: %v", source, err)
+		return err
+	}
+	changed := cfg.SetDiscoveredHosts(source, hosts)
+	for _, name := range changed {
+		upstreams.remove(name)
+	}
+	if len(changed) > 0 {
+		log.Infof("Discovery %s has found %d hosts, changed: %s", source, len(hosts), strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// fetch : performs GET request to the configured host the same way as proxied requests are done
+func fetch(ctx context.Context, cfg *config.Config, upstreams *upstreams, hostName, path, accept string) ([]byte, error) {
+	host, ok := cfg.Host(hostName)
+	if !ok {
+		return nil, fmt.Errorf("Host not found for '%s'", hostName)
+	}
+	reverseProxy, err := upstreams.reverseProxy(ctx, hostName, host)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	pr := NewProxyRequest()
+	pr.serveUpstream(reverseProxy, request.WithContext(context.WithValue(ctx, proxyRequestContextKey, pr)))
+	if pr.upstreamError != nil {
+		return nil, pr.upstreamError
+	}
+	if pr.responseRecorder.Code != http.StatusOK {
+		return nil, fmt.Errorf("Request to %s%s returned %d", hostName, path, pr.responseRecorder.Code)
+	}
+	return ioutil.ReadAll(pr.responseRecorder.Body)
+}
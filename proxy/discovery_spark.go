@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+)
+
+const sparkWorkerAlive = "ALIVE"
+
+var sparkAppUILinkRegexp = regexp.MustCompile(`<a[^>]+href=["']([^"']+)["'][^>]*>\s*Application Detail UI\s*</a>`)
+
+// sparkDiscoverer : finds workers and UIs of running applications using Spark master
+type sparkDiscoverer struct {
+	config    *config.Config
+	upstreams *upstreams
+	discovery config.Discovery
+}
+
+// sparkMasterState : part of Spark master /json response
+type sparkMasterState struct {
+	Workers []struct {
+		ID           string `json:"id"`
+		WebUIAddress string `json:"webuiaddress"`
+		State        string `json:"state"`
+	} `json:"workers"`
+	ActiveApps []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"activeapps"`
+}
+
+func (discoverer *sparkDiscoverer) Hosts(ctx context.Context) (map[string]config.Host, error) {
+	master, ok := discoverer.config.Host(discoverer.discovery.Host)
+	if !ok {
+		return nil, fmt.Errorf("Host of Spark master '%s' not found", discoverer.discovery.Host)
+	}
+	body, err := fetch(ctx, discoverer.config, discoverer.upstreams, discoverer.discovery.Host, "/json/", "")
+	if err != nil {
+		return nil, err
+	}
+	var state sparkMasterState
+	if err = json.Unmarshal(body, &state); err != nil {
+		return nil, fmt.Errorf("Invalid Spark master state: %v", err)
+	}
+
+	hosts := make(map[string]config.Host)
+	for _, worker := range state.Workers {
+		if worker.State != sparkWorkerAlive {
+			continue
+		}
+		webUI, err := url.Parse(worker.WebUIAddress)
+		if err != nil || webUI.Host == "" {
+			log.Warnf("Spark worker %s has invalid web UI address '%s'", worker.ID, worker.WebUIAddress)
+			continue
+		}
+		hosts[config.DiscoveredHostName(discoverer.discovery.Prefix, "worker", webUI.Host)] = config.DiscoveredHost(master, webUI.Host)
+	}
+	for _, app := range state.ActiveApps {
+		address, err := discoverer.appUIAddress(ctx, app.ID)
+		if err != nil {
+			log.Warnf("UI of Spark application %s (%s) can't be found: %v", app.ID, app.Name, err)
+			continue
+		}
+		hosts[discoverer.discovery.Prefix+app.ID] = config.DiscoveredHost(master, address)
+	}
+	return hosts, nil
+}
+
+// appUIAddress : returns address of application UI linked from application page of master
+func (discoverer *sparkDiscoverer) appUIAddress(ctx context.Context, appID string) (string, error) {
+	body, err := fetch(ctx, discoverer.config, discoverer.upstreams, discoverer.discovery.Host,
+		"/app/?appId="+url.QueryEscape(appID), "")
+	if err != nil {
+		return "", err
+	}
+	match := sparkAppUILinkRegexp.FindSubmatch(body)
+	if match == nil {
+		return "", fmt.Errorf("Application Detail UI link not found")
+	}
+	link, err := url.Parse(html.UnescapeString(string(match[1])))
+	if err != nil || link.Host == "" {
+		return "", fmt.Errorf("Invalid application UI link '%s'", match[1])
+	}
+	return link.Host, nil
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	assert "github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestSparkDiscovery(t *testing.T) {
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("worker")) // nolint
+	}))
+	defer worker.Close()
+	driver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("driver")) // nolint
+	}))
+	defer driver.Close()
+	workerAddress := strings.TrimPrefix(worker.URL, "http://")
+	driverAddress := strings.TrimPrefix(driver.URL, "http://")
+
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json/":
+			fmt.Fprintf(w, `{"workers": [
+				{"id": "worker-1", "webuiaddress": "http://%s", "state": "ALIVE"},
+				{"id": "worker-2", "webuiaddress": "http://10.0.0.9:8081", "state": "DEAD"}
+			], "activeapps": [
+				{"id": "app-20171010135536-0000", "name": "etl"},
+				{"id": "app-20171010135536-0001", "name": "finishing"}
+			]}`, workerAddress)
+		case "/app/":
+			if r.URL.Query().Get("appId") != "app-20171010135536-0000" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, `<li><strong><a href="http://%s">Application Detail UI</a></strong></li>`, driverAddress)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, `<a href="http://%s">worker-1</a>`, workerAddress)
+		}
+	}))
+	defer master.Close()
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("spark-master", config.Host{Address: strings.TrimPrefix(master.URL, "http://"), AllowedUsers: []string{"alice"}})
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	discoverer, err := newDiscoverer(cfg, upstreams, config.Discovery{Type: discoverySpark, Host: "spark-master", Prefix: "spark-"})
+	assert.NoError(t, err)
+	assert.NoError(t, refreshDiscoveredHosts(cfg, upstreams, "spark#0", discoverer))
+
+	workerName := config.DiscoveredHostName("spark-", "worker", workerAddress)
+	host, ok := cfg.Host(workerName)
+	assert.True(t, ok)
+	assert.Equal(t, workerAddress, host.Address)
+	assert.Equal(t, []string{"alice"}, host.AllowedUsers)
+	host, ok = cfg.Host("spark-app-20171010135536-0000")
+	assert.True(t, ok)
+	assert.Equal(t, driverAddress, host.Address)
+	_, ok = cfg.Host("spark-app-20171010135536-0001")
+	assert.False(t, ok)
+
+	handler := recoverHandler(proxyHandler(cfg, upstreams))
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/"+workerName+"/", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, "worker", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "http://proxy:8080/spark-master/", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Contains(t, recorder.Body.String(), `href="http://proxy:8080/`+workerName+`"`)
+
+	master.Close()
+	assert.Error(t, refreshDiscoveredHosts(cfg, upstreams, "spark#0", discoverer))
+	_, ok = cfg.Host(workerName)
+	assert.True(t, ok)
+}
+
+func TestYARNDiscovery(t *testing.T) {
+	var resourceManagerAddress string
+	resourceManager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ws/v1/cluster/nodes":
+			assert.Equal(t, "application/json", r.Header.Get("Accept"))
+			w.Write([]byte(`{"nodes": {"node": [
+				{"id": "nm1:45454", "state": "RUNNING", "nodeHTTPAddress": "nm1.cluster:8042"},
+				{"id": "nm2:45454", "state": "LOST", "nodeHTTPAddress": "nm2.cluster:8042"}
+			]}}`)) // nolint
+		case "/ws/v1/cluster/apps":
+			assert.Equal(t, "RUNNING", r.URL.Query().Get("states"))
+			fmt.Fprintf(w, `{"apps": {"app": [
+				{"id": "application_1500000000000_0001", "name": "spark", "trackingUrl": "http://10.0.0.7:4040"},
+				{"id": "application_1500000000000_0002", "name": "mapreduce",
+					"trackingUrl": "http://%s/proxy/application_1500000000000_0002/"}
+			]}}`, resourceManagerAddress)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="http://10.0.0.7:4040">ApplicationMaster</a><a href="http://nm1.cluster:8042/node">nm1</a>`)) // nolint
+		}
+	}))
+	defer resourceManager.Close()
+	resourceManagerAddress = strings.TrimPrefix(resourceManager.URL, "http://")
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("rm", config.Host{Address: resourceManagerAddress})
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	discoverer, err := newDiscoverer(cfg, upstreams, config.Discovery{Type: discoveryYARN, Host: "rm"})
+	assert.NoError(t, err)
+	assert.NoError(t, refreshDiscoveredHosts(cfg, upstreams, "yarn#0", discoverer))
+
+	names := cfg.HostNames()
+	assert.Contains(t, names, "node-nm1-cluster-8042")
+	assert.NotContains(t, names, "node-nm2-cluster-8042")
+	assert.Contains(t, names, "application_1500000000000_0001")
+	assert.NotContains(t, names, "application_1500000000000_0002")
+	host, _ := cfg.Host("application_1500000000000_0001")
+	assert.Equal(t, "10.0.0.7:4040", host.Address)
+
+	handler := recoverHandler(proxyHandler(cfg, upstreams))
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://proxy:8080/rm/cluster", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Contains(t, recorder.Body.String(), `href="http://proxy:8080/application_1500000000000_0001"`)
+	assert.Contains(t, recorder.Body.String(), `href="http://proxy:8080/node-nm1-cluster-8042/node"`)
+}
+
+func TestDNSSRVDiscovery(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream")) // nolint
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+	nameserver := newTestDNSServer(t, map[string][]dnsmessage.ResourceBody{
+		"_http._tcp.spark.cluster.": {&dnsmessage.SRVResource{Port: 8081, Target: dnsmessage.MustNewName("worker-1.spark.cluster.")}},
+		"_ui._tcp.spark.cluster.":   {&dnsmessage.SRVResource{Port: parsePort(t, port), Target: dnsmessage.MustNewName("localhost.")}},
+	})
+	gateway := newTestSSHServer(t)
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("gateway", config.Host{Forwarding: gateway.forwarding()})
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	discoverer, err := newDiscoverer(cfg, upstreams, config.Discovery{
+		Type: config.DiscoveryDNSSRV, Host: "gateway", Name: "_http._tcp.spark.cluster", Nameserver: nameserver,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, refreshDiscoveredHosts(cfg, upstreams, "dns-srv#0", discoverer))
+	host, ok := cfg.Host("worker-1-spark-cluster-8081")
+	assert.True(t, ok)
+	assert.Equal(t, "worker-1.spark.cluster:8081", host.Address)
+	assert.Equal(t, gateway.Address, host.Forwarding.Server)
+
+	discoverer, err = newDiscoverer(cfg, upstreams, config.Discovery{
+		Type: config.DiscoveryDNSSRV, Host: "gateway", Name: "_ui._tcp.spark.cluster", Nameserver: nameserver, Prefix: "ui-",
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, refreshDiscoveredHosts(cfg, upstreams, "dns-srv#1", discoverer))
+	handler := recoverHandler(proxyHandler(cfg, upstreams))
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/ui-localhost-"+port+"/", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, "upstream", recorder.Body.String())
+
+	gateway.Close()
+	assert.Error(t, refreshDiscoveredHosts(cfg, upstreams, "dns-srv#1", discoverer))
+	_, ok = cfg.Host("ui-localhost-" + port)
+	assert.True(t, ok)
+
+	_, err = newDiscoverer(cfg, upstreams, config.Discovery{Type: config.DiscoveryDNSSRV, Name: "_http._tcp.spark.cluster"})
+	assert.Error(t, err)
+}
+
+// newTestDNSServer : DNS over TCP server answering queries with given records of SRV, A and PTR types
+func newTestDNSServer(t *testing.T, records map[string][]dnsmessage.ResourceBody) string {
+	address, _ := newCountingTestDNSServer(t, records)
+	return address
+}
+
+// newCountingTestDNSServer : test DNS server which counts received queries
+func newCountingTestDNSServer(t *testing.T, records map[string][]dnsmessage.ResourceBody) (string, *int32) {
+	queries := new(int32)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() }) // nolint
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestDNS(conn, records, queries)
+		}
+	}()
+	return listener.Addr().String(), queries
+}
+
+func serveTestDNS(conn net.Conn, records map[string][]dnsmessage.ResourceBody, queries *int32) {
+	defer conn.Close() // nolint
+	for {
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		var parser dnsmessage.Parser
+		header, err := parser.Start(query)
+		if err != nil {
+			return
+		}
+		question, err := parser.Question()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(queries, 1)
+		answers, ok := records[question.Name.String()]
+		response := dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true}
+		if !ok {
+			response.RCode = dnsmessage.RCodeNameError
+		}
+		builder := dnsmessage.NewBuilder(nil, response)
+		builder.StartQuestions()   // nolint
+		builder.Question(question) // nolint
+		builder.StartAnswers()     // nolint
+		for _, answer := range answers {
+			resourceHeader := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60}
+			switch body := answer.(type) {
+			case *dnsmessage.SRVResource:
+				if question.Type == dnsmessage.TypeSRV {
+					builder.SRVResource(resourceHeader, *body) // nolint
+				}
+			case *dnsmessage.AResource:
+				if question.Type == dnsmessage.TypeA {
+					builder.AResource(resourceHeader, *body) // nolint
+				}
+			case *dnsmessage.PTRResource:
+				if question.Type == dnsmessage.TypePTR {
+					builder.PTRResource(resourceHeader, *body) // nolint
+				}
+			}
+		}
+		message, err := builder.Finish()
+		if err != nil {
+			return
+		}
+		binary.Write(conn, binary.BigEndian, uint16(len(message))) // nolint
+		conn.Write(message)                                        // nolint
+	}
+}
+
+func parsePort(t *testing.T, value string) uint16 {
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint16(number)
+}
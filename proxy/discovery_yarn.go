@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+)
+
+// yarnDiscoverer : finds NodeManager UIs and tracking UIs of running applications using YARN ResourceManager
+type yarnDiscoverer struct {
+	config    *config.Config
+	upstreams *upstreams
+	discovery config.Discovery
+}
+
+// yarnNodes : ResourceManager /ws/v1/cluster/nodes response
+type yarnNodes struct {
+	Nodes struct {
+		Node []struct {
+			ID              string `json:"id"`
+			State           string `json:"state"`
+			NodeHTTPAddress string `json:"nodeHTTPAddress"`
+		} `json:"node"`
+	} `json:"nodes"`
+}
+
+// yarnApps : ResourceManager /ws/v1/cluster/apps response
+type yarnApps struct {
+	Apps struct {
+		App []struct {
+			ID          string `json:"id"`
+			Name        string `json:"name"`
+			TrackingURL string `json:"trackingUrl"`
+		} `json:"app"`
+	} `json:"apps"`
+}
+
+func (discoverer *yarnDiscoverer) Hosts(ctx context.Context) (map[string]config.Host, error) {
+	resourceManager, ok := discoverer.config.Host(discoverer.discovery.Host)
+	if !ok {
+		return nil, fmt.Errorf("Host of ResourceManager '%s' not found", discoverer.discovery.Host)
+	}
+	var nodes yarnNodes
+	if err := discoverer.get(ctx, "/ws/v1/cluster/nodes", &nodes); err != nil {
+		return nil, err
+	}
+	var apps yarnApps
+	if err := discoverer.get(ctx, "/ws/v1/cluster/apps?states=RUNNING", &apps); err != nil {
+		return nil, err
+	}
+
+	hosts := make(map[string]config.Host)
+	for _, node := range nodes.Nodes.Node {
+		if (node.State != "RUNNING" && node.State != "UNHEALTHY") || node.NodeHTTPAddress == "" {
+			continue
+		}
+		hosts[config.DiscoveredHostName(discoverer.discovery.Prefix, "node", node.NodeHTTPAddress)] =
+			config.DiscoveredHost(resourceManager, node.NodeHTTPAddress)
+	}
+	for _, app := range apps.Apps.App {
+		tracking, err := url.Parse(app.TrackingURL)
+		if err != nil || tracking.Host == "" {
+			log.Warnf("YARN application %s (%s) has invalid tracking URL '%s'", app.ID, app.Name, app.TrackingURL)
+			continue
+		}
+		if containsString(resourceManager.AddressList(), tracking.Host) {
+			// tracking UI is served by web proxy of ResourceManager which is proxied already
+			continue
+		}
+		hosts[discoverer.discovery.Prefix+app.ID] = config.DiscoveredHost(resourceManager, tracking.Host)
+	}
+	return hosts, nil
+}
+
+func (discoverer *yarnDiscoverer) get(ctx context.Context, path string, value interface{}) error {
+	body, err := fetch(ctx, discoverer.config, discoverer.upstreams, discoverer.discovery.Host, path, "application/json")
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(body, value); err != nil {
+		return fmt.Errorf("Invalid ResourceManager response of %s: %v", path, err)
+	}
+	return nil
+}
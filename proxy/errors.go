@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ErrorKind : class of proxying failure which defines response status code
+type ErrorKind string
+
+const (
+	// ErrorUnknownHost : requested host isn't configured
+	ErrorUnknownHost ErrorKind = "unknown-host"
+	// ErrorSSHAuthFailed : ssh gateway rejected credentials
+	ErrorSSHAuthFailed ErrorKind = "ssh-auth-failed"
+	// ErrorForwardingConfig : forwarding of the host is invalid or its key, certificate or known hosts can't be loaded
+	ErrorForwardingConfig ErrorKind = "forwarding-config"
+	// ErrorSSHUnreachable : ssh gateway can't be reached or the connection to it is broken
+	ErrorSSHUnreachable ErrorKind = "ssh-unreachable"
+	// ErrorBackendRefused : backend refused connection or failed to respond
+	ErrorBackendRefused ErrorKind = "backend-refused"
+	// ErrorBackendTimeout : backend or ssh gateway didn't respond in time
+	ErrorBackendTimeout ErrorKind = "backend-timeout"
+	// ErrorRewriteFailure : backend response can't be read to rewrite links
+	ErrorRewriteFailure ErrorKind = "rewrite-failure"
+	// ErrorBadRequest : request can't be proxied as it is
+	ErrorBadRequest ErrorKind = "bad-request"
+	// ErrorUnauthorized : client didn't send valid credentials or login failed
+	ErrorUnauthorized ErrorKind = "unauthorized"
+	// ErrorProxyAuthRequired : forward proxy client didn't send valid credentials
+	ErrorProxyAuthRequired ErrorKind = "proxy-auth-required"
+	// ErrorForbidden : user isn't allowed to access the host
+	ErrorForbidden ErrorKind = "forbidden"
+	// ErrorIdentityProvider : OpenID Connect issuer can't be reached or rejected the login
+	ErrorIdentityProvider ErrorKind = "identity-provider"
+	// ErrorInternal : proxy itself failed or is misconfigured
+	ErrorInternal ErrorKind = "internal"
+	// ErrorNotFound : requested resource of the proxy itself doesn't exist
+	ErrorNotFound ErrorKind = "not-found"
+	// ErrorMethodNotAllowed : resource of the proxy itself doesn't support request method
+	ErrorMethodNotAllowed ErrorKind = "method-not-allowed"
+	// ErrorClientClosed : client went away before response was received from backend
+	ErrorClientClosed ErrorKind = "client-closed"
+)
+
+// statusClientClosedRequest : non-standard status of requests canceled by client, the same as nginx uses
+const statusClientClosedRequest = 499
+
+// Error : proxying failure of a request to the host
+type Error struct {
+	Kind ErrorKind
+	Host string
+	Err  error
+}
+
+func (err *Error) Error() string {
+	return err.Err.Error()
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// Code : response status code for the error
+func (err *Error) Code() int {
+	switch err.Kind {
+	case ErrorUnknownHost, ErrorNotFound:
+		return http.StatusNotFound
+	case ErrorMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case ErrorBackendTimeout:
+		return http.StatusGatewayTimeout
+	case ErrorBadRequest:
+		return http.StatusBadRequest
+	case ErrorUnauthorized:
+		return http.StatusUnauthorized
+	case ErrorProxyAuthRequired:
+		return http.StatusProxyAuthRequired
+	case ErrorForbidden:
+		return http.StatusForbidden
+	case ErrorInternal, ErrorForwardingConfig:
+		return http.StatusInternalServerError
+	case ErrorClientClosed:
+		return statusClientClosedRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// Title : short human readable description of the error kind
+func (err *Error) Title() string {
+	switch err.Kind {
+	case ErrorUnknownHost:
+		return "Unknown host"
+	case ErrorSSHAuthFailed:
+		return "SSH authentication failed"
+	case ErrorSSHUnreachable:
+		return "SSH gateway is unreachable"
+	case ErrorBackendRefused:
+		return "Backend refused connection"
+	case ErrorBackendTimeout:
+		return "Backend timeout"
+	case ErrorRewriteFailure:
+		return "Response can't be rewritten"
+	case ErrorUnauthorized:
+		return "Authentication required"
+	case ErrorForbidden:
+		return "Access denied"
+	case ErrorIdentityProvider:
+		return "Login failed"
+	case ErrorForwardingConfig:
+		return "Forwarding is misconfigured"
+	case ErrorClientClosed:
+		return "Client closed request"
+	default:
+		return http.StatusText(err.Code())
+	}
+}
+
+// upstreamError : classifies error of connection to the host directly or through ssh gateway
+func upstreamError(hostName string, err error) *Error {
+	var proxyError *Error
+	if errors.As(err, &proxyError) {
+		return proxyError
+	}
+	kind := ErrorBackendRefused
+	var connectError *ssh.ConnectError
+	var addressError *ssh.AddressError
+	var openChannelError *gossh.OpenChannelError
+	var netError net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		kind = ErrorClientClosed
+	case errors.As(err, &addressError):
+		kind = ErrorBadRequest
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netError) && netError.Timeout():
+		kind = ErrorBackendTimeout
+	case errors.As(err, &connectError) && connectError.AuthFailed():
+		kind = ErrorSSHAuthFailed
+	case errors.As(err, &connectError):
+		kind = ErrorSSHUnreachable
+	case errors.As(err, &openChannelError), errors.Is(err, syscall.ECONNREFUSED):
+		kind = ErrorBackendRefused
+	}
+	return &Error{Kind: kind, Host: hostName, Err: err}
+}
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Code}} {{.Title}} - http-ssh-proxy</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.code { color: #b22222; }
+.message { background: #f6f6f6; border: 1px solid #ddd; padding: 0.6em 1em; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1><span class="code">{{.Code}}</span> {{.Title}}</h1>
+{{if .Host}}<p>Host: <b>{{.Host}}</b></p>{{end}}
+<p class="message">{{.Message}}</p>
+<p><a href="/_proxy/">Proxied hosts</a></p>
+</body>
+</html>
+`))
+
+// errorResponse : body of error response in HTML or JSON form
+type errorResponse struct {
+	Code    int       `json:"code"`
+	Kind    ErrorKind `json:"kind,omitempty"`
+	Title   string    `json:"title"`
+	Host    string    `json:"host,omitempty"`
+	Message string    `json:"message"`
+}
+
+// writeError : writes styled error page or JSON error if client accepts it
+func writeError(w http.ResponseWriter, r *http.Request, err *Error) {
+	if entry := requestLogEntry(r); entry != nil {
+		entry.Error = string(err.Kind)
+	}
+	writeErrorResponse(w, r, errorResponse{
+		Code:    err.Code(),
+		Kind:    err.Kind,
+		Title:   err.Title(),
+		Host:    err.Host,
+		Message: err.Error(),
+	})
+}
+
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, response errorResponse) {
+	w.Header().Del("Content-Encoding")
+	w.Header().Del("Content-Length")
+	if acceptsJSON(r) {
+		writeJSONResponse(w, response.Code, response)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(response.Code)
+	if err := errorPageTemplate.Execute(w, response); err != nil {
+		log.Errorf("Can't render error page: %v", err)
+	}
+}
+
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header["Accept"] {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType := strings.TrimSpace(strings.Split(mediaRange, ";")[0])
+			if mediaType == "application/json" {
+				return true
+			}
+			if mediaType == "text/html" {
+				return false
+			}
+		}
+	}
+	return false
+}
+
+func unknownHostError(hostName string) *Error {
+	return &Error{
+		Kind: ErrorUnknownHost,
+		Host: hostName,
+		Err:  fmt.Errorf("Host not found for '%s'", hostName),
+	}
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	assert "github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestUpstreamErrorKinds(t *testing.T) {
+	authError := &ssh.ConnectError{Stage: ssh.StageAuth,
+		Err: errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password]")}
+	hostKeyError := &ssh.ConnectError{Stage: ssh.StageHandshake, Err: errors.New("ssh: handshake failed: knownhosts: key mismatch")}
+	dialError := &ssh.ConnectError{Stage: ssh.StageDial, Err: errors.New("connection refused")}
+
+	cases := []struct {
+		err  error
+		kind ErrorKind
+		code int
+	}{
+		{authError, ErrorSSHAuthFailed, http.StatusBadGateway},
+		{hostKeyError, ErrorSSHUnreachable, http.StatusBadGateway},
+		{fmt.Errorf("Remote dial error: %w", context.Canceled), ErrorClientClosed, 499},
+		{fmt.Errorf("Remote dial error: %w", dialError), ErrorSSHUnreachable, http.StatusBadGateway},
+		{fmt.Errorf("Remote dial error: %w", &gossh.OpenChannelError{Reason: gossh.ConnectionFailed}),
+			ErrorBackendRefused, http.StatusBadGateway},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, ErrorBackendTimeout, http.StatusGatewayTimeout},
+		{context.DeadlineExceeded, ErrorBackendTimeout, http.StatusGatewayTimeout},
+		{ssh.ValidateAddress("tcp", "10.1.1.5:99999"), ErrorBadRequest, http.StatusBadRequest},
+		{&Error{Kind: ErrorRewriteFailure, Err: errors.New("gzip: invalid header")}, ErrorRewriteFailure, http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		proxyError := upstreamError("worker-1", c.err)
+		assert.Equal(t, c.kind, proxyError.Kind, c.err.Error())
+		assert.Equal(t, c.code, proxyError.Code(), c.err.Error())
+	}
+	assert.Equal(t, http.StatusNotFound, unknownHostError("worker-9").Code())
+}
+
+func TestErrorResponses(t *testing.T) {
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refusedAddress := strings.TrimPrefix(refused.URL, "http://")
+	refused.Close()
+	brokenGzip := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte("<html>not gzipped</html>")) // nolint
+	}))
+	defer brokenGzip.Close()
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("refused", config.Host{Address: refusedAddress})
+	cfg.SetHost("broken-gzip", config.Host{Address: strings.TrimPrefix(brokenGzip.URL, "http://")})
+	handler := recoverHandler(proxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())))
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/refused/", nil)
+	request.Header.Set("Accept", "text/html,application/json;q=0.9")
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, recorder.Body.String(), "Backend refused connection")
+	assert.Contains(t, recorder.Body.String(), "<b>refused</b>")
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/broken-gzip/", nil)
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("Content-Encoding"))
+	var response errorResponse
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, ErrorRewriteFailure, response.Kind)
+	assert.Equal(t, "broken-gzip", response.Host)
+
+	cfg.StartPage = "missing"
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept", "application/json")
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, ErrorUnknownHost, response.Kind)
+}
+
+func TestTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			w.Write([]byte("<html>")) // nolint
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	address := strings.TrimPrefix(slow.URL, "http://")
+	cfg.SetHost("slow-headers", config.Host{Address: address, ResponseHeaderTimeout: 50 * time.Millisecond})
+	cfg.SetHost("slow-body", config.Host{Address: address, OverallTimeout: 100 * time.Millisecond})
+	handler := recoverHandler(proxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())))
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/slow-headers/", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/slow-body/slow-body", nil)
+	request.Header.Set("Accept", "application/json")
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"kind": "backend-timeout"`)
+}
+
+func TestForwardingErrors(t *testing.T) {
+	gateway := newTestSSHServer(t)
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	wrongPassword := "wrong-password"
+	missingKey := "/missing/id_ed25519"
+	cfg.SetHost("wrong-password", config.Host{Address: "10.1.1.1:8080",
+		Forwarding: &config.Forwarding{User: testSSHUser, Password: &wrongPassword, Server: gateway.Address}})
+	cfg.SetHost("missing-key", config.Host{Address: "10.1.1.1:8080",
+		Forwarding: &config.Forwarding{User: testSSHUser, PrivateKey: &missingKey, Server: gateway.Address}})
+	handler := recoverHandler(proxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())))
+	doRequest := func(hostName string) errorResponse {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/"+hostName+"/", nil)
+		request.Header.Set("Accept", "application/json")
+		handler.ServeHTTP(recorder, request)
+		var response errorResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, recorder.Code, response.Code)
+		return response
+	}
+
+	// server rejects password after its host key was accepted
+	response := doRequest("wrong-password")
+	assert.Equal(t, ErrorSSHAuthFailed, response.Kind)
+	assert.Equal(t, http.StatusBadGateway, response.Code)
+
+	response = doRequest("missing-key")
+	assert.Equal(t, ErrorForwardingConfig, response.Kind)
+	assert.Equal(t, http.StatusInternalServerError, response.Code)
+}
+
+func TestClientClosedRequest(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	received := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("slow", config.Host{Address: strings.TrimPrefix(slow.URL, "http://")})
+	handler := recoverHandler(proxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequestWithContext(ctx, "GET", "/slow/", nil)
+	request.Header.Set("Accept", "application/json")
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, 499, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"kind": "client-closed"`)
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+)
+
+// forwardProxy : HTTP proxy which dials destinations through ssh gateways chosen by rules, connections of pool are shared with reverse proxies
+type forwardProxy struct {
+	config        *config.Config
+	authenticator *authenticator
+	dialer        *ruleDialer
+	reverseProxy  *httputil.ReverseProxy
+}
+
+// ruleDialer : dials destinations through forwarding of the host of the first matching rule or directly
+type ruleDialer struct {
+	config    *config.Config
+	upstreams *upstreams
+	rules     []config.ForwardRule
+}
+
+func forwardProxyHandler(cfg *config.Config, upstreams *upstreams) http.Handler {
+	forwardProxy := &forwardProxy{
+		config: cfg,
+		dialer: &ruleDialer{config: cfg, upstreams: upstreams, rules: cfg.ForwardProxy.Rules},
+	}
+	if cfg.Auth != nil {
+		forwardProxy.authenticator = newAuthenticator(cfg.Auth)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = forwardProxy.dialer.DialContext
+	forwardProxy.reverseProxy = &httputil.ReverseProxy{
+		// absolute URI of request is already the destination
+		Director:  func(r *http.Request) {},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Errorf("Forward proxy request to %s has been failed. Error: %v", r.URL.Host, err)
+			writeError(w, r, upstreamError(r.URL.Host, err))
+		},
+	}
+	return forwardProxy
+}
+
+func (forwardProxy *forwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	destination := r.Host
+	if r.Method != http.MethodConnect {
+		if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+			writeError(w, r, &Error{Kind: ErrorBadRequest, Err: fmt.Errorf("Absolute http URI or CONNECT is required")})
+			return
+		}
+		destination = r.URL.Host
+		if r.URL.Port() == "" {
+			destination = net.JoinHostPort(r.URL.Hostname(), "80")
+		}
+	}
+	// invalid port would fail dial of shared ssh connection, so it's rejected as client error
+	if err := ssh.ValidateAddress("tcp", destination); err != nil {
+		writeError(w, r, &Error{Kind: ErrorBadRequest, Err: err})
+		return
+	}
+	hostName, gateway, err := forwardProxy.dialer.route(destination)
+	if err != nil {
+		writeError(w, r, upstreamError(destination, err))
+		return
+	}
+
+	entry := requestLogEntry(r)
+	if entry != nil {
+		entry.Host = destination
+	}
+	if forwardProxy.authenticator != nil {
+		id, proxyError := forwardProxy.authorize(w, r, hostName, destination)
+		if proxyError != nil {
+			writeError(w, r, proxyError)
+			return
+		}
+		if entry != nil {
+			entry.User = id.user
+		}
+	}
+	if entry != nil && gateway.Forwarding != nil {
+		entry.Gateway = activeGateway(gateway.Forwarding, forwardProxy.dialer.upstreams.pool)
+	}
+	r.Header.Del("Proxy-Authorization")
+
+	if r.Method == http.MethodConnect {
+		forwardProxy.connect(w, r)
+		return
+	}
+	forwardProxy.reverseProxy.ServeHTTP(w, r)
+}
+
+// authorize : returns user of Proxy-Authorization header who is allowed to access the host of destination
+func (forwardProxy *forwardProxy) authorize(w http.ResponseWriter, r *http.Request, hostName, destination string) (*identity, *Error) {
+	if forwardProxy.authenticator.loadError != nil {
+		return nil, &Error{Kind: ErrorInternal, Err: fmt.Errorf("Authentication is misconfigured")}
+	}
+	id := forwardProxy.authenticator.authenticateProxy(r)
+	if id == nil {
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf(`Basic realm="%s"`, forwardProxy.authenticator.realm))
+		return nil, &Error{Kind: ErrorProxyAuthRequired, Err: fmt.Errorf("%s", http.StatusText(http.StatusProxyAuthRequired))}
+	}
+	if hostName != "" && !isUserAllowed(forwardProxy.config, hostName, id) {
+		return nil, &Error{Kind: ErrorForbidden, Host: hostName,
+			Err: fmt.Errorf("User '%s' isn't allowed to access '%s'", id.user, destination)}
+	}
+	return id, nil
+}
+
+// connect : opens tunnel to destination of CONNECT request and copies data until one of sides closes connection
+func (forwardProxy *forwardProxy) connect(w http.ResponseWriter, r *http.Request) {
+	remote, err := forwardProxy.dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		log.Errorf("Forward proxy connection to %s has been failed. Error: %v", r.Host, err)
+		writeError(w, r, upstreamError(r.Host, err))
+		return
+	}
+	defer remote.Close() // nolint
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, r, &Error{Kind: ErrorInternal, Err: fmt.Errorf("Connection can't be hijacked")})
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		writeError(w, r, &Error{Kind: ErrorInternal, Err: err})
+		return
+	}
+	defer conn.Close() // nolint
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	relay(conn, buffered.Reader, remote)
+}
+
+// relay : copies data between client and remote connections until one of sides closes connection
+func relay(conn net.Conn, reader io.Reader, remote net.Conn) {
+	go func() {
+		io.Copy(remote, reader) // nolint
+		remote.Close()          // nolint
+		conn.Close()            // nolint
+	}()
+	io.Copy(conn, remote) // nolint
+}
+
+// DialContext : opens connection to the address through forwarding of its route or directly
+func (dialer *ruleDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	hostName, gateway, err := dialer.route(address)
+	if err != nil {
+		return nil, err
+	}
+	dial, err := dialer.upstreams.dialer(hostName, gateway)
+	if err != nil {
+		return nil, err
+	}
+	return dial(ctx, network, address)
+}
+
+// route : returns host which forwarding is used to dial the address. It's host of the first matching rule,
+// configured host with the address or host pattern allowing it. Empty name means that address is dialed directly
+func (dialer *ruleDialer) route(address string) (string, config.Host, error) {
+	if err := ssh.ValidateAddress("tcp", address); err != nil {
+		return "", config.Host{}, err
+	}
+	hostname, _, _ := net.SplitHostPort(address)
+	if rule := dialer.rule(hostname); rule != nil {
+		if rule.Host == "" {
+			return "", config.Host{}, nil
+		}
+		host, ok := dialer.config.Host(rule.Host)
+		if !ok {
+			return "", config.Host{}, unknownHostError(rule.Host)
+		}
+		return rule.Host, host, nil
+	}
+	hosts := dialer.config.AllHosts()
+	for _, name := range dialer.config.HostNames() {
+		if host := hosts[name]; host.Forwarding != nil && containsString(host.AddressList(), address) {
+			return name, host, nil
+		}
+	}
+	if name, ok := dialer.config.PatternHostName(address); ok {
+		if host, ok := dialer.config.Host(name); ok && host.Forwarding != nil {
+			return name, host, nil
+		}
+	}
+	return "", config.Host{}, nil
+}
+
+// rule : the first rule matching destination host or nil
+func (dialer *ruleDialer) rule(hostname string) *config.ForwardRule {
+	rules := dialer.rules
+	for i := range rules {
+		for _, destination := range rules[i].Destinations {
+			if destinationMatches(destination, hostname) {
+				return &rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// destinationMatches : checks host against CIDR subnet, exact host name or domain like *.cluster.internal
+func destinationMatches(destination, hostname string) bool {
+	if _, network, err := net.ParseCIDR(destination); err == nil {
+		ip := net.ParseIP(hostname)
+		return ip != nil && network.Contains(ip)
+	}
+	if strings.HasPrefix(destination, "*.") {
+		return strings.HasSuffix(strings.ToLower(hostname), strings.ToLower(destination[1:]))
+	}
+	return strings.EqualFold(destination, hostname)
+}
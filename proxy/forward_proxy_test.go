@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestForwardProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path)) // nolint
+	}))
+	defer upstream.Close()
+	tlsUpstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tls upstream")) // nolint
+	}))
+	defer tlsUpstream.Close()
+	gateway := newTestSSHServer(t)
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.Auth = nil
+	cfg.SetHost("gateway", config.Host{Forwarding: gateway.forwarding()})
+	cfg.ForwardProxy = &config.ForwardProxy{Rules: []config.ForwardRule{
+		{Destinations: []string{"127.0.0.0/8"}, Host: "gateway"},
+	}}
+	forwardProxy := httptest.NewServer(forwardProxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())))
+	defer forwardProxy.Close()
+	proxyURL, _ := url.Parse(forwardProxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	response, err := client.Get(upstream.URL + "/jobs")
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close() // nolint
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "upstream /jobs", string(body))
+
+	tlsClient := tlsUpstream.Client()
+	tlsClient.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+	response, err = tlsClient.Get(tlsUpstream.URL)
+	assert.NoError(t, err)
+	body, _ = ioutil.ReadAll(response.Body)
+	response.Body.Close() // nolint
+	assert.Equal(t, "tls upstream", string(body))
+
+	// destinations of the rule are dialed only through gateway, others are dialed directly
+	gateway.Close()
+	client.CloseIdleConnections()
+	response, err = client.Get(upstream.URL + "/jobs")
+	assert.NoError(t, err)
+	response.Body.Close() // nolint
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+	response, err = client.Get(strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1) + "/jobs")
+	assert.NoError(t, err)
+	response.Body.Close() // nolint
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	response, err = http.Get(forwardProxy.URL + "/jobs")
+	assert.NoError(t, err)
+	response.Body.Close() // nolint
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	// target of CONNECT without valid port is client error, nothing is dialed
+	for _, target := range []string{"localhost", "localhost:abc", "localhost:70000", "127.0.0.1:0"} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("CONNECT", "http://localhost/", nil)
+		request.Host = target
+		forwardProxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())).ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, target)
+	}
+	_, _, err = (&ruleDialer{config: cfg, rules: cfg.ForwardProxy.Rules}).route("127.0.0.1:99999")
+	assert.Equal(t, ErrorBadRequest, upstreamError("127.0.0.1:99999", err).Kind)
+}
+
+func TestForwardProxyAuth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+		w.Write([]byte("upstream")) // nolint
+	}))
+	defer upstream.Close()
+
+	htpasswd := "testdata/htpasswd"
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.Auth = &config.Auth{Htpasswd: &htpasswd}
+	cfg.SetHost("restricted", config.Host{AllowedUsers: []string{"alice"}})
+	cfg.ForwardProxy = &config.ForwardProxy{Rules: []config.ForwardRule{
+		{Destinations: []string{"127.0.0.1"}, Host: "restricted"},
+	}}
+	forwardProxy := httptest.NewServer(forwardProxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())))
+	defer forwardProxy.Close()
+
+	get := func(user, password string) *http.Response {
+		proxyURL, _ := url.Parse(forwardProxy.URL)
+		if user != "" {
+			proxyURL.User = url.UserPassword(user, password)
+		}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		response, err := client.Get(upstream.URL)
+		assert.NoError(t, err)
+		response.Body.Close() // nolint
+		return response
+	}
+	response := get("", "")
+	assert.Equal(t, http.StatusProxyAuthRequired, response.StatusCode)
+	assert.Contains(t, response.Header.Get("Proxy-Authenticate"), "Basic")
+	assert.Equal(t, http.StatusProxyAuthRequired, get("alice", "wrong-password").StatusCode)
+	assert.Equal(t, http.StatusForbidden, get("bob", "bob-password").StatusCode)
+	assert.Equal(t, http.StatusOK, get("alice", "alice-password").StatusCode)
+}
+
+func TestDestinationMatches(t *testing.T) {
+	assert.True(t, destinationMatches("10.1.0.0/16", "10.1.2.3"))
+	assert.False(t, destinationMatches("10.1.0.0/16", "10.2.2.3"))
+	assert.False(t, destinationMatches("10.1.0.0/16", "node.cluster"))
+	assert.True(t, destinationMatches("*.cluster.internal", "Node-1.cluster.internal"))
+	assert.False(t, destinationMatches("*.cluster.internal", "cluster.internal"))
+	assert.True(t, destinationMatches("master", "master"))
+	assert.False(t, destinationMatches("master", "master-2"))
+}
+
+func TestForwardProxyRoute(t *testing.T) {
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.ForwardProxy = &config.ForwardProxy{Rules: []config.ForwardRule{
+		{Destinations: []string{"2.2.2.2"}},
+		{Destinations: []string{"10.1.0.0/16"}, Host: "unknown"},
+	}}
+	dialer := &ruleDialer{config: cfg, upstreams: newUpstreams(ssh.NewPool(), newPromptStore()), rules: cfg.ForwardProxy.Rules}
+
+	hostName, gateway, err := dialer.route("2.2.2.2:80")
+	assert.NoError(t, err)
+	assert.Empty(t, hostName)
+	assert.Nil(t, gateway.Forwarding)
+	_, _, err = dialer.route("10.1.2.3:80")
+	assert.Error(t, err)
+
+	// destinations without rule are dialed through forwarding of the host with this address
+	dialer.rules = nil
+	hostName, gateway, err = dialer.route("2.2.2.2:8081")
+	assert.NoError(t, err)
+	assert.Equal(t, "worker-1", hostName)
+	assert.NotNil(t, gateway.Forwarding)
+	hostName, _, err = dialer.route("2.2.2.2:80")
+	assert.NoError(t, err)
+	assert.Empty(t, hostName)
+}
+
+func TestRuleDialerTunnel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	gateway := newTestSSHServer(t)
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("gateway", config.Host{Forwarding: gateway.forwarding()})
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	dialer := &ruleDialer{config: cfg, upstreams: upstreams, rules: []config.ForwardRule{
+		{Destinations: []string{"127.0.0.0/8"}, Host: "gateway"},
+	}}
+	tunnel := func() *ssh.Tunnel {
+		conn, err := dialer.DialContext(context.Background(), "tcp", strings.TrimPrefix(upstream.URL, "http://"))
+		assert.NoError(t, err)
+		conn.Close() // nolint
+		upstreams.lock.Lock()
+		defer upstreams.lock.Unlock()
+		return upstreams.items["gateway"].tunnel
+	}
+
+	// connections share tunnel of the gateway until its config is changed
+	first := tunnel()
+	assert.Same(t, first, tunnel())
+	cfg.SetHost("gateway", config.Host{Forwarding: gateway.forwarding()})
+	changed := tunnel()
+	assert.NotSame(t, first, changed)
+	upstreams.remove("gateway")
+	assert.NotSame(t, changed, tunnel())
+}
@@ -3,35 +3,54 @@ package proxy
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/nawa/http-ssh-proxy/metrics"
+	"github.com/nawa/http-ssh-proxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+var tracer = tracing.Tracer("proxy")
+
 var absLinkRegexp = regexp.MustCompile(`<[^>]+\b(href|src)[ \t\n]*=[ \t\n]*["'](/[^"']+)["'][^>]*>`)
 var relativeLinkRegexp = regexp.MustCompile(`<[^>]+\b(href|src)[ \t\n]*=[ \t\n]*["']([^/][^"']+)["'][^>]*>`)
+var ipLinkRegexp = regexp.MustCompile(`<[^>]+\b(href|src)[ \t\n]*=[ \t\n]*["'](https?)://(\d{1,3}(?:\.\d{1,3}){3}(?::\d{1,5})?)[/"'?#][^>]*>`)
 
 // Request : proxy http request that handles original
 // request and returns response with replaced links
 type Request struct {
 	responseRecorder *httptest.ResponseRecorder
+	upstreamError    error
+	upstreamLatency  time.Duration
+	rewriteLatency   time.Duration
 }
 
-// Replacement : replacement pattern in text`
-type Replacement struct {
-	From string
-	To   string
+// LinkReplacer : replaces addresses of hosts in external links with their proxy paths,
+// all addresses are matched by one regexp compiled when the replacer is created
+type LinkReplacer struct {
+	regexp *regexp.Regexp
+	// hostNames : name of host by its address
+	hostNames map[string]string
 }
 
 // ReplacementConfig : replacement configuration in response body
 type ReplacementConfig struct {
-	LinksBasePath             *url.URL
-	ExpectedLocationHeader    string
-	ExternalLinksReplacements []Replacement
+	LinksBasePath          *url.URL
+	ExpectedLocationHeader string
+	ExternalLinks          *LinkReplacer
+	// PatternHostName : optional name of host pattern for the address of external link which isn't replaced by host address
+	PatternHostName func(address string) (string, bool)
 }
 
 // NewProxyRequest : proxy request constructor
@@ -41,18 +60,48 @@ func NewProxyRequest() *Request {
 	}
 }
 
-// PerformRequest : performs proxy request and writes response with replacements
+// PerformRequest : performs proxy request and writes response with replacements.
+// Failures of upstream request and links rewriting are returned as *Error before anything is written to response
 func (pr *Request) PerformRequest(requestHandler http.Handler,
 	w http.ResponseWriter, request *http.Request, replaceConfig ReplacementConfig) error {
-	requestHandler.ServeHTTP(pr.responseRecorder, request)
+	startedAt := time.Now()
+	request = request.WithContext(context.WithValue(request.Context(), proxyRequestContextKey, pr))
+	pr.serveUpstream(requestHandler, request)
+	pr.upstreamLatency = time.Since(startedAt)
+	if pr.upstreamError != nil {
+		return upstreamError("", pr.upstreamError)
+	}
 
-	return pr.writeToResponse(w, replaceConfig)
+	return pr.writeToResponse(request.Context(), w, replaceConfig)
 }
 
-func (pr *Request) writeToResponse(responseWriter http.ResponseWriter, replaceConfig ReplacementConfig) error {
-	for k, v := range pr.responseRecorder.HeaderMap {
-		responseWriter.Header()[k] = v
+// serveUpstream : performs request to the host, response is treated as failed if request is expired or canceled
+// while it's read because reverse proxy just truncates the body or aborts with panic in this case
+func (pr *Request) serveUpstream(requestHandler http.Handler, request *http.Request) {
+	defer func() {
+		recovered := recover()
+		if recovered != nil && recovered != http.ErrAbortHandler {
+			panic(recovered)
+		}
+		if err := request.Context().Err(); err != nil && pr.upstreamError == nil {
+			pr.upstreamError = err
+		} else if recovered != nil && pr.upstreamError == nil {
+			pr.upstreamError = fmt.Errorf("Response body can't be read")
+		}
+	}()
+	requestHandler.ServeHTTP(pr.responseRecorder, request)
+}
+
+// upstreamErrorHandler : remembers error of reverse proxy to respond with classified error instead of bare 502
+func upstreamErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if pr, ok := r.Context().Value(proxyRequestContextKey).(*Request); ok {
+		pr.upstreamError = err
+		return
 	}
+	writeError(w, r, upstreamError("", err))
+}
+
+func (pr *Request) writeToResponse(ctx context.Context, responseWriter http.ResponseWriter, replaceConfig ReplacementConfig) error {
 	isHTML := false
 	for _, contentType := range pr.responseRecorder.HeaderMap["Content-Type"] {
 		if strings.Contains(contentType, "html") {
@@ -60,10 +109,24 @@ func (pr *Request) writeToResponse(responseWriter http.ResponseWriter, replaceCo
 			break
 		}
 	}
+	var body string
+	if isHTML {
+		startedAt := time.Now()
+		var err error
+		body, err = rewriteHTMLBody(ctx, pr.responseRecorder, replaceConfig)
+		pr.rewriteLatency = time.Since(startedAt)
+		if err != nil {
+			return &Error{Kind: ErrorRewriteFailure, Err: fmt.Errorf("Can't read HTML response: %v", err)}
+		}
+	}
+
+	for k, v := range pr.responseRecorder.HeaderMap {
+		responseWriter.Header()[k] = v
+	}
 	replaceLocationHeader(pr, replaceConfig.ExpectedLocationHeader, replaceConfig.LinksBasePath)
 	var writeError error
 	if isHTML {
-		writeError = writeHTMLBody(pr.responseRecorder, responseWriter, replaceConfig)
+		writeError = writeHTMLBody(pr.responseRecorder, responseWriter, body)
 	} else {
 		writeError = writeNonHTMLBody(responseWriter, pr)
 	}
@@ -80,30 +143,55 @@ func writeNonHTMLBody(responseWriter http.ResponseWriter, pr *Request) (err erro
 	return
 }
 
-func writeHTMLBody(responseRecorder *httptest.ResponseRecorder, responseWriter http.ResponseWriter, replaceConfig ReplacementConfig) (err error) {
-	isGzip := false
+func isGzipEncoded(responseRecorder *httptest.ResponseRecorder) bool {
 	for _, contentEncoding := range responseRecorder.HeaderMap["Content-Encoding"] {
 		if contentEncoding == "gzip" {
-			isGzip = true
-			break
+			return true
 		}
 	}
+	return false
+}
+
+// rewriteHTMLBody : reads HTML response decompressing it if it's needed and replaces links in it
+func rewriteHTMLBody(ctx context.Context, responseRecorder *httptest.ResponseRecorder,
+	replaceConfig ReplacementConfig) (string, error) {
+	_, span := tracer.Start(ctx, "rewrite html")
+	defer span.End()
+
+	isGzip := isGzipEncoded(responseRecorder)
 	var sBody string
 	if isGzip {
-		reader, _ := gzip.NewReader(responseRecorder.Body)
+		reader, err := gzip.NewReader(responseRecorder.Body)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return "", err
+		}
 		defer reader.Close() // nolint
 		buf := new(bytes.Buffer)
 		_, readErr := buf.ReadFrom(reader)
 		if readErr != nil {
-			return readErr
+			span.SetStatus(codes.Error, readErr.Error())
+			return "", readErr
 		}
 		sBody = buf.String()
 	} else {
 		sBody = responseRecorder.Body.String()
 	}
+	rewriteStartedAt := time.Now()
 	sBody = replaceAbsoluteLinks(sBody, replaceConfig.LinksBasePath.String())
-	sBody = replaceExternalLinks(sBody, replaceConfig.ExternalLinksReplacements)
+	sBody = replaceConfig.ExternalLinks.Replace(sBody, replaceConfig.LinksBasePath.Host)
+	if replaceConfig.PatternHostName != nil {
+		sBody = replacePatternLinks(sBody, replaceConfig.LinksBasePath.Host, replaceConfig.PatternHostName)
+	}
 	sBody = replaceRelativeLinks(sBody, replaceConfig.LinksBasePath.String())
+	metrics.RewriteDuration.Observe(time.Since(rewriteStartedAt).Seconds())
+	metrics.RewrittenBytes.Add(float64(len(sBody)))
+	span.SetAttributes(attribute.Int("rewrite.bytes", len(sBody)), attribute.Bool("rewrite.gzip", isGzip))
+	return sBody, nil
+}
+
+func writeHTMLBody(responseRecorder *httptest.ResponseRecorder, responseWriter http.ResponseWriter, sBody string) (err error) {
+	isGzip := isGzipEncoded(responseRecorder)
 	responseWriter.WriteHeader(responseRecorder.Code)
 	if isGzip {
 		gzipWriter := gzip.NewWriter(responseWriter)
@@ -133,13 +221,67 @@ func replaceAbsoluteLinks(html, basePath string) string {
 		})
 }
 
-func replaceExternalLinks(html string, replacements []Replacement) (result string) {
-	result = html
-	for _, replacement := range replacements {
-		linkRegexp := regexp.MustCompile(`<[^>]+\b(href|src)[ \t\n]*=[ \t\n]*["'].*(` + replacement.From + `).*["'][^>]*>`)
-		result = replaceByRegexp(result, replacement.To, linkRegexp, 4, 5)
+// NewLinkReplacer : link replacer constructor, hostNames maps addresses to names of hosts
+func NewLinkReplacer(hostNames map[string]string) *LinkReplacer {
+	replacer := &LinkReplacer{hostNames: hostNames}
+	if len(hostNames) == 0 {
+		return replacer
 	}
-	return
+	addresses := make([]string, 0, len(hostNames))
+	for address := range hostNames {
+		addresses = append(addresses, regexp.QuoteMeta(address))
+	}
+	// the first alternative wins, so longer addresses go first and 1.1.1.1:8080 isn't matched as 1.1.1.1:80
+	sort.Slice(addresses, func(i, j int) bool {
+		if len(addresses[i]) != len(addresses[j]) {
+			return len(addresses[i]) > len(addresses[j])
+		}
+		return addresses[i] < addresses[j]
+	})
+	replacer.regexp = regexp.MustCompile(`<[^>]+\b(href|src)[ \t\n]*=[ \t\n]*["'].*(` + strings.Join(addresses, "|") + `).*["'][^>]*>`)
+	return replacer
+}
+
+// Replace : replaces addresses of hosts in links with proxyHost/name of the host
+func (replacer *LinkReplacer) Replace(html, proxyHost string) string {
+	if replacer == nil || replacer.regexp == nil {
+		return html
+	}
+	lastIndex := 0
+	var buffer bytes.Buffer
+	for _, v := range replacer.regexp.FindAllStringSubmatchIndex(html, -1) {
+		buffer.WriteString(html[lastIndex:v[4]])
+		buffer.WriteString(proxyHost + "/" + replacer.hostNames[html[v[4]:v[5]]])
+		lastIndex = v[5]
+	}
+	buffer.WriteString(html[lastIndex:])
+	return buffer.String()
+}
+
+// replacePatternLinks : replaces IP addresses of links with proxy address and name of host pattern allowing them.
+// https links are kept as pattern hosts are dialed with plain http
+func replacePatternLinks(html, proxyHost string, patternHostName func(address string) (string, bool)) string {
+	lastIndex := 0
+	var buffer bytes.Buffer
+	for _, v := range ipLinkRegexp.FindAllStringSubmatchIndex(html, -1) {
+		address := html[v[6]:v[7]]
+		if address == proxyHost || html[v[4]:v[5]] == "https" {
+			// link is already replaced with proxy address or it can't be served through the proxy
+			continue
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "80")
+		}
+		name, ok := patternHostName(address)
+		if !ok {
+			continue
+		}
+		buffer.WriteString(html[lastIndex:v[6]])
+		buffer.WriteString(proxyHost + "/" + name)
+		lastIndex = v[7]
+	}
+	buffer.WriteString(html[lastIndex:])
+	return buffer.String()
 }
 
 func replaceRelativeLinks(html, basePath string) string {
@@ -170,15 +312,3 @@ func addPrefixByRegexp(s string, regexp *regexp.Regexp, groupStartIndex, groupEn
 	buffer.WriteString(s[lastIndex:])
 	return buffer.String()
 }
-
-func replaceByRegexp(s, replaceTo string, regexp *regexp.Regexp, groupStartIndex, groupEndIndex int) string {
-	lastIndex := 0
-	var buffer bytes.Buffer
-	for _, v := range regexp.FindAllStringSubmatchIndex(s, -1) {
-		buffer.WriteString(s[lastIndex:v[groupStartIndex]])
-		buffer.WriteString(replaceTo)
-		lastIndex = v[groupEndIndex]
-	}
-	buffer.WriteString(s[lastIndex:])
-	return buffer.String()
-}
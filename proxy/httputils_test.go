@@ -1,8 +1,11 @@
 package proxy
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
 	assert "github.com/stretchr/testify/require"
 )
 
@@ -20,10 +23,40 @@ func TestReplaceAbsoluteLinks(t *testing.T) {
 }
 
 func TestReplaceLinks(t *testing.T) {
-	s := `sdsds <tag href="http://prefix:9999/replaceFrom/path/to/something">`
-	expected := `sdsds <tag href="http://prefix:9999/replaceTo/path/to/something">`
-	replacements := []Replacement{
-		{From: "replaceFrom", To: "replaceTo"},
+	s := `sdsds <tag href="http://1.1.1.1:80/path/to/something"> <img src="http://1.1.1.1:8080/x.png">` +
+		` <a href="http://3.3.3.3:80/">other</a>`
+	expected := `sdsds <tag href="http://proxy:8080/short/path/to/something"> <img src="http://proxy:8080/long/x.png">` +
+		` <a href="http://3.3.3.3:80/">other</a>`
+	replacer := NewLinkReplacer(map[string]string{"1.1.1.1:80": "short", "1.1.1.1:8080": "long"})
+	assert.Equal(t, expected, replacer.Replace(s, "proxy:8080"))
+
+	assert.Equal(t, s, NewLinkReplacer(nil).Replace(s, "proxy:8080"))
+}
+
+func TestLinkReplacerIsReused(t *testing.T) {
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	replacer := upstreams.linkReplacer(cfg)
+	assert.Equal(t, "master", replacer.hostNames["1.1.1.1:8080"])
+	assert.True(t, replacer == upstreams.linkReplacer(cfg))
+
+	cfg.SetHost("added", config.Host{Address: "5.5.5.5:80"})
+	changed := upstreams.linkReplacer(cfg)
+	assert.False(t, replacer == changed)
+	assert.Equal(t, "added", changed.hostNames["5.5.5.5:80"])
+}
+
+func TestReplacePatternLinks(t *testing.T) {
+	s := `<a href="http://10.1.1.7:8081/logs">logs</a> <a href="http://10.1.1.8/">ui</a> <img src="http://192.168.0.1:80/x.png">` +
+		` <a href="http://proxy:8080/master">master</a> <a href="https://10.1.1.8/">secure</a>`
+	expected := `<a href="http://proxy:8080/node-10.1.1.7-8081/logs">logs</a> <a href="http://proxy:8080/node-10.1.1.8-80/">ui</a>` +
+		` <img src="http://192.168.0.1:80/x.png"> <a href="http://proxy:8080/master">master</a>` +
+		` <a href="https://10.1.1.8/">secure</a>`
+	patternHostName := func(address string) (string, bool) {
+		if !strings.HasPrefix(address, "10.1.1.") {
+			return "", false
+		}
+		return "node-" + strings.Replace(address, ":", "-", 1), true
 	}
-	assert.Equal(t, expected, replaceExternalLinks(s, replacements))
+	assert.Equal(t, expected, replacePatternLinks(s, "proxy:8080", patternHostName))
 }
@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" // nolint: gosec
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+)
+
+const promptsPath = reservedPathPrefix + "prompts"
+
+// TOTP parameters of RFC 6238 used by authenticator apps
+const (
+	totpPeriod  = 30
+	totpDigits  = 6
+	totpModulus = 1000000
+)
+
+// promptTimeout : waiting for answer on prompt page, handshake timeout of ssh servers asking such answers is extended with it
+const promptTimeout = 2 * time.Minute
+
+var promptsPageTemplate = template.Must(template.New("prompts").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>http-ssh-proxy prompts</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+form { margin-bottom: 1.5em; }
+.idle { color: #888; }
+</style>
+</head>
+<body>
+<h1>SSH prompts</h1>
+{{range .}}<form method="post">
+<p>{{.Gateway}} <span class="idle">asked at {{.AskedAt.Format "15:04:05"}}</span></p>
+<label>{{.Question}} <input name="answer" type="{{if .Echo}}text{{else}}password{{end}}" autocomplete="one-time-code" autofocus></label>
+<input name="id" type="hidden" value="{{.ID}}">
+<button type="submit">Send</button>
+</form>
+{{else}}<p class="idle">No prompts are waiting for answers</p>
+{{end}}</body>
+</html>
+`))
+
+// prompt : question of ssh server asked on prompt page
+type prompt struct {
+	ID       string
+	Gateway  string
+	Question string
+	Echo     bool
+	AskedAt  time.Time
+	answers  chan string
+	// forwarding : settings of ssh connection asking the question
+	forwarding *config.Forwarding
+}
+
+type promptStore struct {
+	lock  sync.Mutex
+	items map[string]*prompt
+	// codes : one-time codes generated for ssh servers instead of asking them on prompt page
+	codes *totpCodes
+}
+
+func newPromptStore() *promptStore {
+	return &promptStore{items: make(map[string]*prompt), codes: newTOTPCodes()}
+}
+
+// totpCodes : periods of one-time codes sent to ssh servers, servers reject code which is already used,
+// so the next period is waited for when connection is established again in the same period
+type totpCodes struct {
+	lock sync.Mutex
+	// sent : counter of the last code by account on ssh server and secret
+	sent  map[string]uint64
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newTOTPCodes() *totpCodes {
+	return &totpCodes{sent: make(map[string]uint64), now: time.Now, sleep: time.Sleep}
+}
+
+// next : returns code of the current period which wasn't sent to the account yet, waiting for the next period if needed
+func (codes *totpCodes) next(account, secret string) (string, error) {
+	key := account + "\x00" + secret
+	codes.lock.Lock()
+	now := codes.now()
+	counter := uint64(now.Unix() / totpPeriod)
+	if sent, ok := codes.sent[key]; ok && counter <= sent {
+		counter = sent + 1
+	}
+	codes.sent[key] = counter
+	codes.lock.Unlock()
+	if start := time.Unix(int64(counter)*totpPeriod, 0); start.After(now) {
+		codes.sleep(start.Sub(now))
+	}
+	return totpCounterCode(secret, counter)
+}
+
+// ask : waits for answer submitted on prompt page
+func (store *promptStore) ask(forwarding *config.Forwarding, gateway, question string, echo bool, timeout time.Duration) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	item := &prompt{
+		ID:         hex.EncodeToString(id),
+		Gateway:    gateway,
+		Question:   question,
+		Echo:       echo,
+		AskedAt:    time.Now(),
+		answers:    make(chan string, 1),
+		forwarding: forwarding,
+	}
+	store.lock.Lock()
+	store.items[item.ID] = item
+	store.lock.Unlock()
+	defer func() {
+		store.lock.Lock()
+		delete(store.items, item.ID)
+		store.lock.Unlock()
+	}()
+
+	log.Warnf("SSH server %s asks '%s', answer it on %s", gateway, strings.TrimSpace(question), promptsPath)
+	select {
+	case answer := <-item.answers:
+		return answer, nil
+	case <-time.After(timeout):
+		return "", fmt.Errorf("Prompt '%s' hasn't been answered in %v", strings.TrimSpace(question), timeout)
+	}
+}
+
+// answer : passes answer to waiting connection, false means that prompt is already answered, expired or isn't allowed
+func (store *promptStore) answer(id, answer string, allowed func(item *prompt) bool) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	item, ok := store.items[id]
+	if !ok || !allowed(item) {
+		return false
+	}
+	delete(store.items, id)
+	item.answers <- answer
+	return true
+}
+
+// pending : prompts waiting for answers in order they are asked
+func (store *promptStore) pending() []*prompt {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	items := make([]*prompt, 0, len(store.items))
+	for _, item := range store.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].AskedAt.Before(items[j].AskedAt)
+	})
+	return items
+}
+
+// visiblePrompts : prompts which user is allowed to see and answer
+func visiblePrompts(cfg *config.Config, store *promptStore, id *identity) []*prompt {
+	var items []*prompt
+	for _, item := range store.pending() {
+		if isPromptAllowed(cfg, item, id) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// isPromptAllowed : prompt is shown to users allowed to access one of hosts sharing ssh connection which asks it
+func isPromptAllowed(cfg *config.Config, item *prompt, id *identity) bool {
+	if id == nil {
+		return true
+	}
+	for hostName, host := range cfg.AllHosts() {
+		if sharesConnection(host.Forwarding, item.forwarding) && isUserAllowed(cfg, hostName, id) {
+			return true
+		}
+	}
+	// names of pattern hosts aren't known, so only users allowed to access any host are checked
+	if id.hosts != nil && !containsString(id.hosts, "*") {
+		return false
+	}
+	for _, hostPattern := range cfg.HostPatterns {
+		if sharesConnection(hostPattern.Forwarding, item.forwarding) &&
+			(len(hostPattern.AllowedUsers) == 0 || containsString(hostPattern.AllowedUsers, id.user)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharesConnection : checks that forwardings use the same pooled ssh connection
+func sharesConnection(forwarding, other *config.Forwarding) bool {
+	if forwarding == nil || other == nil {
+		return false
+	}
+	return forwarding.User == other.User && reflect.DeepEqual(forwarding.ServerList(), other.ServerList()) &&
+		forwarding.Identity() == other.Identity()
+}
+
+// promptsHandler : page listing questions of ssh servers which answers are entered by user,
+// users see only prompts of connections to hosts they're allowed to access
+func promptsHandler(cfg *config.Config, store *promptStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := servePrompts(cfg, store, w, r); err != nil {
+			writeError(w, r, err)
+		}
+	}
+}
+
+func servePrompts(cfg *config.Config, store *promptStore, w http.ResponseWriter, r *http.Request) *Error {
+	id := requestIdentity(r)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		allowed := func(item *prompt) bool {
+			return isPromptAllowed(cfg, item, id)
+		}
+		if !store.answer(r.PostFormValue("id"), r.PostFormValue("answer"), allowed) {
+			return apiError(ErrorNotFound, "Prompt is already answered or expired")
+		}
+		http.Redirect(w, r, promptsPath, http.StatusSeeOther)
+		return nil
+	default:
+		return apiError(ErrorMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := promptsPageTemplate.Execute(w, visiblePrompts(cfg, store, id)); err != nil {
+		log.Errorf("Can't render prompts page: %v", err)
+	}
+	return nil
+}
+
+// keyboardInteractiveChallenge : answers each question with the first answer which prompt matches it
+func keyboardInteractiveChallenge(forwarding *config.Forwarding, store *promptStore) (ssh.KeyboardInteractiveChallenge, error) {
+	patterns := make([]*regexp.Regexp, len(forwarding.KeyboardInteractive))
+	for i, answer := range forwarding.KeyboardInteractive {
+		pattern, err := regexp.Compile("(?i)" + answer.Prompt)
+		if err != nil {
+			return nil, fmt.Errorf("Keyboard-interactive prompt is invalid: %v", err)
+		}
+		patterns[i] = pattern
+	}
+	gateway := forwarding.User + "@" + strings.Join(forwarding.ServerList(), ",")
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			matched := false
+			for j, pattern := range patterns {
+				if !pattern.MatchString(question) {
+					continue
+				}
+				answer, err := keyboardInteractiveAnswer(forwarding, forwarding.KeyboardInteractive[j], gateway, question, echos[i], store)
+				if err != nil {
+					return nil, err
+				}
+				answers[i] = answer
+				matched = true
+				break
+			}
+			if !matched {
+				return nil, fmt.Errorf("No answer is configured for prompt '%s'", strings.TrimSpace(question))
+			}
+		}
+		return answers, nil
+	}, nil
+}
+
+func keyboardInteractiveAnswer(forwarding *config.Forwarding, answer config.KeyboardInteractiveAnswer, gateway, question string, echo bool, store *promptStore) (string, error) {
+	switch {
+	case answer.Answer != nil:
+		return *answer.Answer, nil
+	case answer.Env != "":
+		value, ok := os.LookupEnv(answer.Env)
+		if !ok {
+			return "", fmt.Errorf("Environment variable %s with answer isn't set", answer.Env)
+		}
+		return value, nil
+	case answer.TOTP != nil:
+		return store.codes.next(gateway, *answer.TOTP)
+	case answer.Browser:
+		return store.ask(forwarding, gateway, question, echo, promptTimeout)
+	}
+	return "", fmt.Errorf("Source of answer to prompt '%s' isn't configured", answer.Prompt)
+}
+
+// hasTOTPAnswers : checks that connection could wait for the next period of one-time code
+func hasTOTPAnswers(forwarding *config.Forwarding) bool {
+	for _, answer := range forwarding.KeyboardInteractive {
+		if answer.TOTP != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBrowserPrompts : checks that connection could wait for answers from prompt page
+func hasBrowserPrompts(forwarding *config.Forwarding) bool {
+	for _, answer := range forwarding.KeyboardInteractive {
+		if answer.Browser {
+			return true
+		}
+	}
+	return false
+}
+
+// totpCode : time-based one-time password of RFC 6238 with HMAC-SHA1, 30 seconds period and 6 digits
+func totpCode(secret string, now time.Time) (string, error) {
+	return totpCounterCode(secret, uint64(now.Unix()/totpPeriod))
+}
+
+// totpCounterCode : one-time password of the period with the counter
+func totpCounterCode(secret string, counter uint64) (string, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return "", fmt.Errorf("TOTP secret isn't valid base32: %v", err)
+	}
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message) // nolint
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%totpModulus), nil
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	assert "github.com/stretchr/testify/require"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors of RFC 6238 for SHA1 truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for unix, code := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 20000000000: "353130"} {
+		actual, err := totpCode(secret, time.Unix(unix, 0))
+		assert.NoError(t, err)
+		assert.Equal(t, code, actual)
+	}
+	actual, err := totpCode("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", time.Unix(59, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, "287082", actual)
+	_, err = totpCode("not base32!", time.Now())
+	assert.Error(t, err)
+}
+
+func TestTOTPCodesAreNotReused(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	var slept time.Duration
+	codes := newTOTPCodes()
+	codes.now = func() time.Time { return now }
+	codes.sleep = func(d time.Duration) { slept += d }
+
+	code, err := codes.next("user@bastion:22", testTOTPSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, "081804", code)
+	assert.Zero(t, slept)
+
+	// the same account waits for the next period, others get the current code
+	code, _ = codes.next("user@bastion:22", testTOTPSecret)
+	expected, _ := totpCode(testTOTPSecret, now.Add(totpPeriod*time.Second))
+	assert.Equal(t, expected, code)
+	assert.Equal(t, time.Second, slept)
+	code, _ = codes.next("other@bastion:22", testTOTPSecret)
+	assert.Equal(t, "081804", code)
+	assert.Equal(t, time.Second, slept)
+}
+
+func TestKeyboardInteractive(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream")) // nolint
+	}))
+	defer upstream.Close()
+	gateway := newTestOTPServer(t)
+
+	secret := testTOTPSecret
+	os.Setenv("TEST_SSH_PASSWORD", testSSHPassword) // nolint
+	defer os.Unsetenv("TEST_SSH_PASSWORD")          // nolint
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("bastion", config.Host{
+		Address: strings.TrimPrefix(upstream.URL, "http://"),
+		Forwarding: &config.Forwarding{User: testSSHUser, Server: gateway.Address, KeyboardInteractive: []config.KeyboardInteractiveAnswer{
+			{Prompt: "^password", Env: "TEST_SSH_PASSWORD"},
+			{Prompt: "verification code", TOTP: &secret},
+		}},
+	})
+	pool := ssh.NewPool()
+	store := newPromptStore()
+	// waiting for the next period of one-time code only moves clock of generator, gateway accepts adjacent periods
+	var offset int64
+	store.codes.now = func() time.Time { return time.Now().Add(time.Duration(atomic.LoadInt64(&offset))) }
+	store.codes.sleep = func(d time.Duration) { atomic.AddInt64(&offset, int64(d)) }
+	handler := recoverHandler(proxyHandler(cfg, newUpstreams(pool, store)))
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/bastion/", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "upstream", recorder.Body.String())
+
+	// health check doesn't log in again after connection is lost, the next request does
+	gateway.Disconnect()
+	assert.Eventually(t, func() bool { return !pool.Statuses()[0].Connected }, 5*time.Second, 10*time.Millisecond)
+	pool.CheckHealth(time.Second)
+	assert.False(t, pool.Statuses()[0].Connected)
+	assert.False(t, pool.Statuses()[0].Healthy)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, pool.Statuses()[0].Healthy)
+
+	wrong := "wrong-password"
+	cfg.SetHost("wrong", config.Host{
+		Address: strings.TrimPrefix(upstream.URL, "http://"),
+		Forwarding: &config.Forwarding{User: "other-user", Server: gateway.Address, KeyboardInteractive: []config.KeyboardInteractiveAnswer{
+			{Prompt: "^password", Answer: &wrong},
+			{Prompt: "verification code", TOTP: &secret},
+		}},
+	})
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/wrong/", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+}
+
+func TestBrowserPrompt(t *testing.T) {
+	gateway := newTestOTPServer(t)
+	store := newPromptStore()
+	password := testSSHPassword
+	forwarding := &config.Forwarding{User: testSSHUser, Server: gateway.Address, KeyboardInteractive: []config.KeyboardInteractiveAnswer{
+		{Prompt: "^password", Answer: &password},
+		{Prompt: "code", Browser: true},
+	}}
+	methods, err := authMethods(forwarding, store)
+	assert.NoError(t, err)
+	tunnel := ssh.NewTunnelByAuthMethods(gateway.Address, "", testSSHUser, methods...)
+	tunnel.Pool = ssh.NewPool()
+
+	connected := make(chan error, 1)
+	go func() {
+		_, err := tunnel.Pool.Client(tunnel).Connect()
+		connected <- err
+	}()
+	var pending []*prompt
+	for deadline := time.Now().Add(5 * time.Second); len(pending) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		pending = store.pending()
+	}
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "Verification code: ", pending[0].Question)
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("bastion", config.Host{Address: "10.0.0.1:80", Forwarding: forwarding})
+	handler := promptsHandler(cfg, store)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", promptsPath, nil))
+	assert.Contains(t, recorder.Body.String(), `value="`+pending[0].ID+`"`)
+
+	code, _ := totpCode(testTOTPSecret, time.Now())
+	form := url.Values{"id": {pending[0].ID}, "answer": {code}}
+
+	// prompt isn't shown to user limited to other hosts and can't be answered by such user
+	limited := &identity{user: "ci", hosts: []string{"worker-2"}}
+	request := httptest.NewRequest("GET", promptsPath, nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request.WithContext(withIdentity(request, limited)))
+	assert.NotContains(t, recorder.Body.String(), pending[0].ID)
+	assert.Empty(t, visiblePrompts(cfg, store, limited))
+	assert.Len(t, visiblePrompts(cfg, store, &identity{user: "ci", hosts: []string{"bastion"}}), 1)
+	request = httptest.NewRequest("POST", promptsPath, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request.WithContext(withIdentity(request, limited)))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Len(t, store.pending(), 1)
+
+	request = httptest.NewRequest("POST", promptsPath, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusSeeOther, recorder.Code)
+	assert.NoError(t, <-connected)
+	assert.Empty(t, store.pending())
+
+	// answered prompt can't be answered again
+	request = httptest.NewRequest("POST", promptsPath, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("DELETE", promptsPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
+
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// newTestOTPServer : gateway asking password and one-time code with keyboard-interactive authentication,
+// like real servers it doesn't accept the same code twice
+func newTestOTPServer(t *testing.T) *testSSHServer {
+	var lock sync.Mutex
+	var lastCounter uint64
+	acceptCode := func(code string) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		// codes of adjacent periods are accepted as clocks could differ or code could be changed during handshake
+		current := uint64(time.Now().Unix() / totpPeriod)
+		for counter := current - 1; counter <= current+1; counter++ {
+			expected, _ := totpCounterCode(testTOTPSecret, counter)
+			if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 && counter > lastCounter {
+				lastCounter = counter
+				return true
+			}
+		}
+		return false
+	}
+	return newTestSSHServer(t, func(config *cryptossh.ServerConfig) {
+		config.PasswordCallback = nil
+		config.KeyboardInteractiveCallback = func(conn cryptossh.ConnMetadata, client cryptossh.KeyboardInteractiveChallenge) (*cryptossh.Permissions, error) {
+			answers, err := client("", "", []string{"Password: ", "Verification code: "}, []bool{false, true})
+			if err != nil {
+				return nil, err
+			}
+			if conn.User() != testSSHUser || len(answers) != 2 ||
+				subtle.ConstantTimeCompare([]byte(answers[0]), []byte(testSSHPassword)) != 1 || !acceptCode(answers[1]) {
+				return nil, fmt.Errorf("Wrong answers")
+			}
+			return nil, nil
+		}
+	})
+}
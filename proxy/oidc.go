@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc"
+	"github.com/nawa/http-ssh-proxy/config"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcCallbackPath    = reservedPathPrefix + "oidc/callback"
+	sessionCookieName   = "_proxy_session"
+	oidcStateCookieName = "_proxy_oidc_state"
+	defaultSessionTTL   = 12 * time.Hour
+	oidcLoginTimeout    = 10 * time.Minute
+
+	// purposes bound into cookie signatures so a value signed for one cookie isn't accepted as another
+	sessionPurpose = "session"
+	loginPurpose   = "login"
+)
+
+// oidcAuthenticator : logs in users using OpenID Connect authorization code flow with PKCE
+type oidcAuthenticator struct {
+	config     *config.OIDC
+	secret     []byte
+	sessionTTL time.Duration
+
+	providerLock sync.Mutex
+	provider     *oidc.Provider
+}
+
+// oidcSession : logged in user stored in signed session cookie
+type oidcSession struct {
+	User    string   `json:"user"`
+	Groups  []string `json:"groups,omitempty"`
+	Expires int64    `json:"exp"`
+}
+
+// oidcLogin : login in progress stored in signed cookie until user is redirected back from issuer
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return"`
+	Expires  int64  `json:"exp"`
+}
+
+func newOIDCAuthenticator(oidcConfig *config.OIDC) *oidcAuthenticator {
+	authenticator := &oidcAuthenticator{
+		config:     oidcConfig,
+		secret:     []byte(oidcConfig.CookieSecret),
+		sessionTTL: oidcConfig.SessionTTL,
+	}
+	if len(authenticator.secret) == 0 {
+		log.Warn("OpenID Connect cookie secret isn't configured, sessions won't survive restart")
+		authenticator.secret = []byte(randomString())
+	}
+	if authenticator.sessionTTL == 0 {
+		authenticator.sessionTTL = defaultSessionTTL
+	}
+	return authenticator
+}
+
+func (authenticator *oidcAuthenticator) getProvider(ctx context.Context) (*oidc.Provider, error) {
+	authenticator.providerLock.Lock()
+	defer authenticator.providerLock.Unlock()
+	if authenticator.provider == nil {
+		provider, err := oidc.NewProvider(ctx, authenticator.config.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		authenticator.provider = provider
+	}
+	return authenticator.provider, nil
+}
+
+func (authenticator *oidcAuthenticator) oauth2Config(r *http.Request, provider *oidc.Provider) *oauth2.Config {
+	redirectURL := authenticator.config.RedirectURL
+	if redirectURL == "" {
+		redirectURL = "http://" + r.Host + oidcCallbackPath
+	}
+	scopes := authenticator.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+	return &oauth2.Config{
+		ClientID:     authenticator.config.ClientID,
+		ClientSecret: authenticator.config.ClientSecret,
+		RedirectURL:  redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       scopes,
+	}
+}
+
+// authenticate : returns user logged in with session cookie or nil if session is missed or expired
+func (authenticator *oidcAuthenticator) authenticate(r *http.Request) *identity {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	var session oidcSession
+	if err = authenticator.verify(sessionPurpose, cookie.Value, &session); err != nil {
+		log.Debugf("Invalid session cookie: %v", err)
+		return nil
+	}
+	if session.User == "" || time.Now().Unix() > session.Expires {
+		return nil
+	}
+	return &identity{user: session.User, hosts: authenticator.allowedHosts(session.Groups)}
+}
+
+func (authenticator *oidcAuthenticator) allowedHosts(groups []string) []string {
+	if len(authenticator.config.Groups) == 0 {
+		return nil
+	}
+	hosts := []string{}
+	for _, group := range groups {
+		hosts = append(hosts, authenticator.config.Groups[group]...)
+	}
+	return hosts
+}
+
+func (authenticator *oidcAuthenticator) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := authenticator.getProvider(r.Context())
+	if err != nil {
+		writeError(w, r, apiError(ErrorIdentityProvider, "Can't reach OpenID Connect issuer: %v", err))
+		return
+	}
+	login := oidcLogin{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: oauth2.GenerateVerifier(),
+		ReturnTo: r.URL.RequestURI(),
+		Expires:  time.Now().Add(oidcLoginTimeout).Unix(),
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    authenticator.sign(loginPurpose, login),
+		Path:     oidcCallbackPath,
+		Expires:  time.Unix(login.Expires, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	authURL := authenticator.oauth2Config(r, provider).AuthCodeURL(login.State,
+		oidc.Nonce(login.Nonce), oauth2.S256ChallengeOption(login.Verifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (authenticator *oidcAuthenticator) handleCallback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil {
+		writeError(w, r, apiError(ErrorBadRequest, "Login session is missed, try to open the page again"))
+		return
+	}
+	var login oidcLogin
+	if err = authenticator.verify(loginPurpose, cookie.Value, &login); err != nil || time.Now().Unix() > login.Expires {
+		writeError(w, r, apiError(ErrorBadRequest, "Login session is expired, try to open the page again"))
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("state") != login.State {
+		writeError(w, r, apiError(ErrorBadRequest, "Login state doesn't match"))
+		return
+	}
+	if loginErr := query.Get("error"); loginErr != "" {
+		writeError(w, r, apiError(ErrorUnauthorized, "Login failed: %s %s", loginErr, query.Get("error_description")))
+		return
+	}
+
+	provider, err := authenticator.getProvider(r.Context())
+	if err != nil {
+		writeError(w, r, apiError(ErrorIdentityProvider, "Can't reach OpenID Connect issuer: %v", err))
+		return
+	}
+	token, err := authenticator.oauth2Config(r, provider).Exchange(r.Context(), query.Get("code"),
+		oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		writeError(w, r, apiError(ErrorIdentityProvider, "Can't exchange authorization code: %v", err))
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		writeError(w, r, apiError(ErrorIdentityProvider, "ID token is missed in token response"))
+		return
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: authenticator.config.ClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil {
+		writeError(w, r, apiError(ErrorUnauthorized, "Invalid ID token: %v", err))
+		return
+	}
+	if idToken.Nonce != login.Nonce {
+		writeError(w, r, apiError(ErrorUnauthorized, "ID token nonce doesn't match"))
+		return
+	}
+	var claims map[string]interface{}
+	if err = idToken.Claims(&claims); err != nil {
+		writeError(w, r, apiError(ErrorUnauthorized, "Can't read ID token claims: %v", err))
+		return
+	}
+	if authenticator.userClaim() == "email" && isFalseClaim(claims["email_verified"]) {
+		// anybody could register unverified email of other user at some issuers
+		writeError(w, r, apiError(ErrorUnauthorized, "Email '%v' isn't verified by OpenID Connect issuer", claims["email"]))
+		return
+	}
+
+	session := oidcSession{
+		User:    authenticator.userFromClaims(claims, idToken.Subject),
+		Groups:  authenticator.groupsFromClaims(claims),
+		Expires: time.Now().Add(authenticator.sessionTTL).Unix(),
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    authenticator.sign(sessionPurpose, session),
+		Path:     "/",
+		Expires:  time.Unix(session.Expires, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcStateCookieName,
+		Path:   oidcCallbackPath,
+		MaxAge: -1,
+	})
+	log.Infof("User '%s' logged in using OpenID Connect", session.User)
+
+	http.Redirect(w, r, localReturnTo(login.ReturnTo), http.StatusFound)
+}
+
+// localReturnTo : returns path of the proxy to open after login or / if it could lead to other site,
+// browsers treat backslash as slash so /\evil.com is the same as //evil.com
+func localReturnTo(returnTo string) string {
+	normalized := strings.Replace(returnTo, "\\", "/", -1)
+	if !strings.HasPrefix(normalized, "/") || strings.HasPrefix(normalized, "//") {
+		return "/"
+	}
+	parsed, err := url.Parse(normalized)
+	if err != nil || parsed.Scheme != "" || parsed.Host != "" {
+		return "/"
+	}
+	return returnTo
+}
+
+func (authenticator *oidcAuthenticator) userClaim() string {
+	if authenticator.config.UserClaim == "" {
+		return "email"
+	}
+	return authenticator.config.UserClaim
+}
+
+func (authenticator *oidcAuthenticator) userFromClaims(claims map[string]interface{}, subject string) string {
+	if user, ok := claims[authenticator.userClaim()].(string); ok && user != "" {
+		return user
+	}
+	return subject
+}
+
+// isFalseClaim : some issuers send boolean claims as strings
+func isFalseClaim(value interface{}) bool {
+	switch value := value.(type) {
+	case bool:
+		return !value
+	case string:
+		return strings.EqualFold(value, "false")
+	}
+	return false
+}
+
+func (authenticator *oidcAuthenticator) groupsFromClaims(claims map[string]interface{}) (groups []string) {
+	groupsClaim := authenticator.config.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	switch value := claims[groupsClaim].(type) {
+	case string:
+		groups = append(groups, value)
+	case []interface{}:
+		for _, group := range value {
+			if s, ok := group.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	return
+}
+
+// sign : serializes value to cookie value protected by HMAC bound to the purpose of the cookie
+func (authenticator *oidcAuthenticator) sign(purpose string, value interface{}) string {
+	payload, _ := json.Marshal(value)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(authenticator.mac(purpose, encoded))
+}
+
+// verify : checks HMAC of cookie value signed for the purpose and deserializes it
+func (authenticator *oidcAuthenticator) verify(purpose string, signed string, value interface{}) error {
+	parts := strings.SplitN(signed, ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Malformed signed value")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(signature, authenticator.mac(purpose, parts[0])) {
+		return fmt.Errorf("Signature doesn't match")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, value)
+}
+
+func (authenticator *oidcAuthenticator) mac(purpose string, payload string) []byte {
+	mac := hmac.New(sha256.New, authenticator.secret)
+	mac.Write([]byte(purpose + "." + payload)) // nolint
+	return mac.Sum(nil)
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Panicf("Can't generate random value: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	assert "github.com/stretchr/testify/require"
+)
+
+// fakeIssuer : minimal OpenID Connect provider which logs in configured user without any prompt
+type fakeIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	email  string
+	groups []string
+	// claims : additional claims of ID token
+	claims map[string]interface{}
+
+	lock  sync.Mutex
+	codes map[string]fakeAuthorization
+}
+
+type fakeAuthorization struct {
+	challenge string
+	nonce     string
+	clientID  string
+}
+
+func newFakeIssuer(t *testing.T, email string, groups []string) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	issuer := &fakeIssuer{key: key, email: email, groups: groups, codes: make(map[string]fakeAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/keys", issuer.keys)
+	mux.HandleFunc("/auth", issuer.authorize)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (issuer *fakeIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"issuer":                                issuer.server.URL,
+		"authorization_endpoint":                issuer.server.URL + "/auth",
+		"token_endpoint":                        issuer.server.URL + "/token",
+		"jwks_uri":                              issuer.server.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (issuer *fakeIssuer) keys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(issuer.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(issuer.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (issuer *fakeIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "PKCE is required", http.StatusBadRequest)
+		return
+	}
+	code := randomString()
+	issuer.lock.Lock()
+	issuer.codes[code] = fakeAuthorization{
+		challenge: query.Get("code_challenge"),
+		nonce:     query.Get("nonce"),
+		clientID:  query.Get("client_id"),
+	}
+	issuer.lock.Unlock()
+
+	redirectURL, _ := url.Parse(query.Get("redirect_uri"))
+	redirectQuery := redirectURL.Query()
+	redirectQuery.Set("code", code)
+	redirectQuery.Set("state", query.Get("state"))
+	redirectURL.RawQuery = redirectQuery.Encode()
+	http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+}
+
+func (issuer *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	issuer.lock.Lock()
+	authorization, ok := issuer.codes[r.FormValue("code")]
+	delete(issuer.codes, r.FormValue("code"))
+	issuer.lock.Unlock()
+
+	verifierHash := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != authorization.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`)) // nolint
+		return
+	}
+	claims := map[string]interface{}{
+		"iss":    issuer.server.URL,
+		"sub":    "user-id",
+		"aud":    authorization.clientID,
+		"iat":    time.Now().Unix(),
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"nonce":  authorization.nonce,
+		"email":  issuer.email,
+		"groups": issuer.groups,
+	}
+	for name, value := range issuer.claims {
+		claims[name] = value
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     issuer.signIDToken(claims),
+	})
+}
+
+func (issuer *fakeIssuer) signIDToken(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, issuer.key, crypto.SHA256, hash[:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value) // nolint
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newFakeIssuer(t, "alice@example.com", []string{"developers"})
+	defer issuer.server.Close()
+	handler := authTestHandler(oidcAuth(issuer))
+
+	recorder := doTestRequest(handler, "GET", "/worker-2/path?query=1", "", nil)
+	assert.Equal(t, http.StatusFound, recorder.Code)
+	assert.True(t, strings.HasPrefix(recorder.HeaderMap.Get("Location"), issuer.server.URL+"/auth?"))
+	stateCookies := recorder.Result().Cookies()
+	assert.Len(t, stateCookies, 1)
+
+	callbackURL := followIssuerRedirect(t, recorder.HeaderMap.Get("Location"))
+	assert.Equal(t, oidcCallbackPath, callbackURL.Path)
+
+	recorder = doTestRequest(handler, "GET", callbackURL.RequestURI(), "", withCookies(stateCookies))
+	assert.Equal(t, http.StatusFound, recorder.Code)
+	assert.Equal(t, "/worker-2/path?query=1", recorder.HeaderMap.Get("Location"))
+	var sessionCookies []*http.Cookie
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			sessionCookies = append(sessionCookies, cookie)
+		}
+	}
+	assert.Len(t, sessionCookies, 1)
+
+	recorder = doTestRequest(handler, "GET", "/worker-2/path?query=1", "", withCookies(sessionCookies))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "alice@example.com", recorder.Body.String())
+
+	recorder = doTestRequest(handler, "GET", "/master/", "", withCookies(sessionCookies))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = doTestRequest(handler, "GET", "/worker-1/", "", withCookies(sessionCookies))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestOIDCCallbackWithoutLogin(t *testing.T) {
+	issuer := newFakeIssuer(t, "alice@example.com", nil)
+	defer issuer.server.Close()
+	handler := authTestHandler(oidcAuth(issuer))
+
+	recorder := doTestRequest(handler, "GET", oidcCallbackPath+"?code=code&state=state", "", nil)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = doTestRequest(handler, "GET", oidcCallbackPath+"?code=code&state=state", "", withCookies([]*http.Cookie{
+		{Name: oidcStateCookieName, Value: "forged.value"},
+	}))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestOIDCForgedSession(t *testing.T) {
+	issuer := newFakeIssuer(t, "alice@example.com", nil)
+	defer issuer.server.Close()
+	handler := authTestHandler(oidcAuth(issuer))
+
+	forger := newOIDCAuthenticator(&config.OIDC{CookieSecret: "another-secret"})
+	recorder := doTestRequest(handler, "GET", "/worker-2/", "", withCookies([]*http.Cookie{{
+		Name:  sessionCookieName,
+		Value: forger.sign(sessionPurpose, oidcSession{User: "mallory", Expires: time.Now().Add(time.Hour).Unix()}),
+	}}))
+	assert.Equal(t, http.StatusFound, recorder.Code)
+}
+
+func TestOIDCStateCookieAsSession(t *testing.T) {
+	issuer := newFakeIssuer(t, "alice@example.com", nil)
+	defer issuer.server.Close()
+	handler := authTestHandler(oidcAuth(issuer))
+
+	recorder := doTestRequest(handler, "GET", "/worker-2/", "", nil)
+	assert.Equal(t, http.StatusFound, recorder.Code)
+	stateCookies := recorder.Result().Cookies()
+	assert.Len(t, stateCookies, 1)
+
+	recorder = doTestRequest(handler, "GET", "/worker-2/", "", withCookies([]*http.Cookie{{
+		Name:  sessionCookieName,
+		Value: stateCookies[0].Value,
+	}}))
+	assert.Equal(t, http.StatusFound, recorder.Code)
+	assert.True(t, strings.HasPrefix(recorder.HeaderMap.Get("Location"), issuer.server.URL+"/auth?"))
+}
+
+func TestOIDCSessionWithoutUser(t *testing.T) {
+	authenticator := newOIDCAuthenticator(&config.OIDC{CookieSecret: "secret"})
+	request, _ := http.NewRequest("GET", "/worker-2/", nil)
+	request.AddCookie(&http.Cookie{
+		Name:  sessionCookieName,
+		Value: authenticator.sign(sessionPurpose, oidcSession{Expires: time.Now().Add(time.Hour).Unix()}),
+	})
+	assert.Nil(t, authenticator.authenticate(request))
+}
+
+func TestOIDCReturnTo(t *testing.T) {
+	assert.Equal(t, "/worker-2/path?query=1", localReturnTo("/worker-2/path?query=1"))
+	for _, returnTo := range []string{"", "worker-2/", "//evil.com", "/\\evil.com", "\\/evil.com", "https://evil.com/", "/\t/evil.com"} {
+		assert.Equal(t, "/", localReturnTo(returnTo), returnTo)
+	}
+}
+
+func TestOIDCUnverifiedEmail(t *testing.T) {
+	issuer := newFakeIssuer(t, "alice@example.com", nil)
+	issuer.claims = map[string]interface{}{"email_verified": false}
+	defer issuer.server.Close()
+	login := func(handler http.Handler) *httptest.ResponseRecorder {
+		recorder := doTestRequest(handler, "GET", "/master/", "", nil)
+		callbackURL := followIssuerRedirect(t, recorder.HeaderMap.Get("Location"))
+		return doTestRequest(handler, "GET", callbackURL.RequestURI(), "", withCookies(recorder.Result().Cookies()))
+	}
+
+	recorder := login(authTestHandler(oidcAuth(issuer)))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Empty(t, recorder.Result().Cookies())
+
+	issuer.claims = map[string]interface{}{"email_verified": "true"}
+	assert.Equal(t, http.StatusFound, login(authTestHandler(oidcAuth(issuer))).Code)
+
+	// other claim doesn't depend on verification of email
+	issuer.claims = map[string]interface{}{"email_verified": false}
+	handler := authTestHandler(func(auth *config.Auth) {
+		oidcAuth(issuer)(auth)
+		auth.OIDC.UserClaim = "sub"
+		auth.OIDC.Groups = nil
+	})
+	recorder = login(handler)
+	assert.Equal(t, http.StatusFound, recorder.Code)
+	recorder = doTestRequest(handler, "GET", "/master/", "", withCookies(recorder.Result().Cookies()))
+	assert.Equal(t, "user-id", recorder.Body.String())
+}
+
+func TestOIDCGroups(t *testing.T) {
+	authenticator := newOIDCAuthenticator(&config.OIDC{
+		Groups: map[string][]string{"developers": {"master"}, "admins": {"*"}},
+	})
+	assert.Equal(t, []string{"a", "b"}, authenticator.groupsFromClaims(map[string]interface{}{
+		"groups": []interface{}{"a", "b"},
+	}))
+	assert.Equal(t, []string{"a"}, authenticator.groupsFromClaims(map[string]interface{}{"groups": "a"}))
+	assert.Equal(t, []string{}, authenticator.allowedHosts(nil))
+	assert.Equal(t, []string{"master", "*"}, authenticator.allowedHosts([]string{"developers", "admins"}))
+
+	unrestricted := newOIDCAuthenticator(&config.OIDC{})
+	assert.Nil(t, unrestricted.allowedHosts([]string{"developers"}))
+}
+
+func oidcAuth(issuer *fakeIssuer) func(auth *config.Auth) {
+	return func(auth *config.Auth) {
+		auth.Htpasswd = nil
+		auth.OIDC.Issuer = issuer.server.URL
+	}
+}
+
+func followIssuerRedirect(t *testing.T, location string) *url.URL {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	response, err := client.Get(location)
+	assert.NoError(t, err)
+	defer response.Body.Close() // nolint
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	redirectURL, err := url.Parse(response.Header.Get("Location"))
+	assert.NoError(t, err)
+	return redirectURL
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+)
+
+const pacPath = reservedPathPrefix + "proxy.pac"
+
+var pacTemplate = template.Must(template.New("pac").Parse(`function FindProxyForURL(url, host) {
+    var port = urlPort(url);
+{{range .}}    if ({{.Condition}}) {
+        return {{.Action}};
+    }
+{{end}}    return "DIRECT";
+}
+
+function urlPort(url) {
+    var match = /^[a-z]+:\/\/[^\/]*:(\d+)(\/|$)/i.exec(url);
+    if (match) {
+        return match[1];
+    }
+    return url.substring(0, 6).toLowerCase() == "https:" ? "443" : "80";
+}
+`))
+
+// pacRoute : condition of PAC file and proxy used if it's true
+type pacRoute struct {
+	Condition string
+	Action    string
+}
+
+// pacHandler : serves PAC file sending to forward proxy (or SOCKS listener if it's the only one) destinations of its rules,
+// forwarded hosts and subnets of host patterns which the user is allowed to access, other destinations are opened directly
+func pacHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hostname := r.Host
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			hostname = host
+		}
+		var proxy string
+		var rules []config.ForwardRule
+		switch {
+		case cfg.ForwardProxy != nil:
+			proxy = "PROXY " + net.JoinHostPort(hostname, strconv.Itoa(cfg.ForwardProxy.Port))
+			rules = cfg.ForwardProxy.Rules
+		case cfg.Socks != nil:
+			proxy = "SOCKS5 " + net.JoinHostPort(hostname, strconv.Itoa(cfg.Socks.Port))
+			rules = cfg.Socks.Rules
+		default:
+			writeErrorResponse(w, r, errorResponse{
+				Code:    http.StatusNotFound,
+				Title:   http.StatusText(http.StatusNotFound),
+				Message: "Neither forward proxy nor SOCKS listener is configured",
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		if err := pacTemplate.Execute(w, pacRoutes(cfg, rules, strconv.Quote(proxy), requestIdentity(r))); err != nil {
+			log.Errorf("PAC file can't be written: %v", err)
+		}
+	}
+}
+
+// pacRoutes : conditions in the same order as destinations are routed by proxy, addresses of hosts match their ports only.
+// Hosts which the user isn't allowed to access are skipped so they aren't disclosed, anonymous user is allowed
+// only hosts without allowed users
+func pacRoutes(cfg *config.Config, rules []config.ForwardRule, proxy string, id *identity) []pacRoute {
+	var routes []pacRoute
+	for _, rule := range rules {
+		action := proxy
+		if rule.Host == "" {
+			action = strconv.Quote("DIRECT")
+		} else if id != nil && !isUserAllowed(cfg, rule.Host, id) {
+			continue
+		}
+		for _, destination := range rule.Destinations {
+			if condition := pacCondition(destination); condition != "" {
+				routes = append(routes, pacRoute{Condition: condition, Action: action})
+			}
+		}
+	}
+
+	var addresses []string
+	hosts := cfg.AllHosts()
+	for _, name := range cfg.HostNames() {
+		if hosts[name].Forwarding == nil || (id != nil && !isUserAllowed(cfg, name, id)) {
+			continue
+		}
+		for _, address := range hosts[name].AddressList() {
+			hostname, port, err := net.SplitHostPort(address)
+			if err == nil && !containsString(addresses, address) {
+				addresses = append(addresses, address)
+				routes = append(routes, pacRoute{
+					Condition: pacCondition(hostname) + " && port == " + strconv.Quote(port),
+					Action:    proxy,
+				})
+			}
+		}
+	}
+
+	patterns := make([]string, 0, len(cfg.HostPatterns))
+	for pattern := range cfg.HostPatterns {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if cfg.HostPatterns[pattern].Forwarding == nil || !isPatternAllowed(cfg.HostPatterns[pattern], id) {
+			continue
+		}
+		for _, subnet := range cfg.HostPatterns[pattern].Subnets {
+			if condition := pacCondition(subnet); condition != "" {
+				routes = append(routes, pacRoute{Condition: condition, Action: proxy})
+			}
+		}
+	}
+	return routes
+}
+
+// isPatternAllowed : checks allowed users of host pattern, user restricted to listed hosts could access hosts of pattern
+// only by their names so its subnets are skipped
+func isPatternAllowed(pattern config.HostPattern, id *identity) bool {
+	if id == nil {
+		return true
+	}
+	if id.hosts != nil && !containsString(id.hosts, "*") {
+		return false
+	}
+	return len(pattern.AllowedUsers) == 0 || containsString(pattern.AllowedUsers, id.user)
+}
+
+// pacCondition : PAC expression matching destination of rule, IPv6 subnets aren't supported by PAC functions and skipped
+func pacCondition(destination string) string {
+	if _, network, err := net.ParseCIDR(destination); err == nil {
+		if network.IP.To4() == nil || len(network.Mask) != net.IPv4len {
+			return ""
+		}
+		return "isInNet(host, " + strconv.Quote(network.IP.String()) + ", " + strconv.Quote(net.IP(network.Mask).String()) + ")"
+	}
+	if strings.HasPrefix(destination, "*.") {
+		return "dnsDomainIs(host, " + strconv.Quote(strings.ToLower(destination[1:])) + ")"
+	}
+	return "host == " + strconv.Quote(strings.ToLower(destination))
+}
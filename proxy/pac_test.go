@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/justinas/alice"
+	"github.com/nawa/http-ssh-proxy/config"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestPAC(t *testing.T) {
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	handler := pacHandler(cfg)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "http://localhost:8080"+pacPath, nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	cfg.ForwardProxy = &config.ForwardProxy{Port: 3128, Rules: []config.ForwardRule{
+		{Destinations: []string{"10.2.0.0/16", "*.Cluster.internal", "fd00::/8"}, Host: "worker-1"},
+		{Destinations: []string{"public.cluster.internal"}},
+	}}
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "http://localhost:8080"+pacPath, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/x-ns-proxy-autoconfig", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, `function FindProxyForURL(url, host) {
+    var port = urlPort(url);
+    if (isInNet(host, "10.2.0.0", "255.255.0.0")) {
+        return "PROXY localhost:3128";
+    }
+    if (dnsDomainIs(host, ".cluster.internal")) {
+        return "PROXY localhost:3128";
+    }
+    if (host == "public.cluster.internal") {
+        return "DIRECT";
+    }
+    if (host == "2.2.2.2" && port == "8081") {
+        return "PROXY localhost:3128";
+    }
+    if (isInNet(host, "10.1.1.0", "255.255.255.0")) {
+        return "PROXY localhost:3128";
+    }
+    return "DIRECT";
+}
+
+function urlPort(url) {
+    var match = /^[a-z]+:\/\/[^\/]*:(\d+)(\/|$)/i.exec(url);
+    if (match) {
+        return match[1];
+    }
+    return url.substring(0, 6).toLowerCase() == "https:" ? "443" : "80";
+}
+`, recorder.Body.String())
+
+	cfg.ForwardProxy = nil
+	cfg.Socks = &config.Socks{Port: 1080}
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "http://proxy.example.com"+pacPath, nil))
+	assert.Contains(t, recorder.Body.String(), `return "SOCKS5 proxy.example.com:1080";`)
+}
+
+func TestPACWithAuth(t *testing.T) {
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	htpasswd := "testdata/htpasswd"
+	cfg.Auth.Htpasswd = &htpasswd
+	cfg.Auth.OIDC = nil
+	cfg.ForwardProxy = &config.ForwardProxy{Port: 3128, Rules: []config.ForwardRule{
+		{Destinations: []string{"10.2.0.0/16"}, Host: "worker-1"},
+		{Destinations: []string{"10.3.0.0/16"}, Host: "master"},
+	}}
+	handler := alice.New(recoverHandler, authHandler(cfg)).Then(pacHandler(cfg))
+	doRequest := func(user, password string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://localhost:8080"+pacPath, nil)
+		if user != "" {
+			request.SetBasicAuth(user, password)
+		}
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// browsers don't send credentials, so anonymous request gets only routes of hosts allowed to everybody
+	recorder := doRequest("", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "10.3.0.0")
+	assert.NotContains(t, recorder.Body.String(), "2.2.2.2")
+	assert.NotContains(t, recorder.Body.String(), "10.2.0.0")
+	assert.NotContains(t, recorder.Body.String(), "10.1.1.0")
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest("alice", "wrong-password").Code)
+
+	// worker-1 and host pattern are allowed only to alice so their addresses and destinations of rule aren't disclosed to bob
+	recorder = doRequest("bob", "bob-password")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "2.2.2.2")
+	assert.NotContains(t, recorder.Body.String(), "10.2.0.0")
+	assert.NotContains(t, recorder.Body.String(), "10.1.1.0")
+
+	recorder = doRequest("alice", "alice-password")
+	assert.Contains(t, recorder.Body.String(), `host == "2.2.2.2" && port == "8081"`)
+	assert.Contains(t, recorder.Body.String(), "10.2.0.0")
+	assert.Contains(t, recorder.Body.String(), "10.1.1.0")
+}
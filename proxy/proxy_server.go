@@ -1,23 +1,64 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/justinas/alice"
 	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/metrics"
 	"github.com/nawa/http-ssh-proxy/ssh"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// reservedPathPrefix : paths under this prefix are served by proxy itself and never proxied
+const reservedPathPrefix = "/_proxy/"
+
+// timeouts used if they aren't configured for the host, response headers and the whole request aren't limited by default
+const (
+	defaultConnectTimeout      = 10 * time.Second
+	defaultSSHHandshakeTimeout = 10 * time.Second
+)
+
+// health checks of ssh servers used if they aren't configured
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
 )
 
 // HTTPServer : proxy http server - central point of application
 type HTTPServer struct {
-	Config      *config.Config
-	rootHandler http.Handler
+	Config              *config.Config
+	rootHandler         http.Handler
+	forwardProxyHandler http.Handler
+	server              *http.Server
+	forwardProxyServer  *http.Server
+	socksServer         *socksServer
+	tcpForwarders       []*tcpForwarder
+	remoteForwarders    []*remoteForwarder
+	pool                *ssh.Pool
+	upstreams           *upstreams
+
+	lock sync.Mutex
+	// listeners : listeners of socks server and tcp forwards closed by Shutdown
+	listeners []net.Listener
+	stopped   bool
 }
 
 // HTTPError : http error with message and code
@@ -28,18 +69,125 @@ type HTTPError struct {
 
 // NewProxyServer : proxy http server constructor
 func NewProxyServer(config *config.Config) *HTTPServer {
-	rootHandler := alice.New(recoverHandler).
-		Then(proxyHandler(config))
-	return &HTTPServer{Config: config, rootHandler: rootHandler}
+	pool := ssh.NewPool()
+	prompts := newPromptStore()
+	upstreams := newUpstreams(pool, prompts)
+	tcpForwarders := newTCPForwarders(config, upstreams)
+	remoteForwarders := newRemoteForwarders(config, pool, prompts)
+
+	internalHandler := http.NewServeMux()
+	internalHandler.Handle(reservedPathPrefix, statusPageHandler(config, upstreams, pool, tcpForwarders, remoteForwarders))
+	internalHandler.Handle(adminAPIPath, adminAPIHandler(config, upstreams, pool))
+	internalHandler.Handle(pacPath, pacHandler(config))
+	internalHandler.Handle(promptsPath, promptsHandler(config, prompts))
+
+	accessLog := accessLogHandler(config)
+	rootHandler := alice.New(accessLog, recoverHandler, authHandler(config)).
+		Then(routeHandler(config, internalHandler, proxyHandler(config, upstreams)))
+	httpServer := &HTTPServer{
+		Config:           config,
+		rootHandler:      rootHandler,
+		pool:             pool,
+		upstreams:        upstreams,
+		tcpForwarders:    tcpForwarders,
+		remoteForwarders: remoteForwarders,
+	}
+	httpServer.server = &http.Server{Addr: fmt.Sprintf("localhost:%v", config.AppPort), Handler: rootHandler}
+	if config.ForwardProxy != nil {
+		httpServer.forwardProxyHandler = alice.New(accessLog, recoverHandler).Then(forwardProxyHandler(config, upstreams))
+		httpServer.forwardProxyServer = &http.Server{
+			Addr:    fmt.Sprintf("localhost:%v", config.ForwardProxy.Port),
+			Handler: httpServer.forwardProxyHandler,
+		}
+	}
+	if config.Socks != nil {
+		httpServer.socksServer = newSocksServer(config, upstreams)
+	}
+	return httpServer
 }
 
-// Start : starts proxy http server
+// Start : starts proxy http server, returns after Shutdown is called
 func (httpServer *HTTPServer) Start() {
-	http.Handle("/", httpServer.rootHandler)
-	err := http.ListenAndServe(fmt.Sprintf("localhost:%v", httpServer.Config.AppPort), nil)
+	interval, timeout := defaultHealthCheckInterval, defaultHealthCheckTimeout
+	if healthCheck := httpServer.Config.HealthCheck; healthCheck != nil {
+		interval = durationOrDefault(healthCheck.Interval, interval)
+		timeout = durationOrDefault(healthCheck.Timeout, timeout)
+	}
+	stopHealthChecks := httpServer.pool.StartHealthChecks(interval, timeout)
+	defer stopHealthChecks()
+	stopDiscovery := startDiscovery(httpServer.Config, httpServer.upstreams)
+	defer stopDiscovery()
+	for _, forwarder := range httpServer.remoteForwarders {
+		stopRemoteForward := forwarder.start()
+		defer stopRemoteForward()
+	}
+
+	if httpServer.forwardProxyServer != nil {
+		go func() {
+			err := httpServer.forwardProxyServer.ListenAndServe()
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if httpServer.socksServer != nil {
+		httpServer.serveListener(fmt.Sprintf("localhost:%v", httpServer.Config.Socks.Port), httpServer.socksServer.serve)
+	}
+	for _, forwarder := range httpServer.tcpForwarders {
+		httpServer.serveListener(forwarder.forward.Listen, forwarder.serve)
+	}
+
+	err := httpServer.server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// serveListener : serves connections accepted on address until Shutdown closes the listener
+func (httpServer *HTTPServer) serveListener(address string, serve func(listener net.Listener) error) {
+	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatal(err)
 	}
+	httpServer.lock.Lock()
+	if httpServer.stopped {
+		listener.Close() // nolint
+	} else {
+		httpServer.listeners = append(httpServer.listeners, listener)
+	}
+	httpServer.lock.Unlock()
+	go func() {
+		if err := serve(listener); !errors.Is(err, net.ErrClosed) {
+			log.Fatal(err)
+		}
+	}()
+}
+
+// Shutdown : stops accepting requests and connections, waits until active http requests are finished or ctx is done.
+// All servers are stopped even if some of them fail, their errors are joined
+func (httpServer *HTTPServer) Shutdown(ctx context.Context) error {
+	httpServer.lock.Lock()
+	httpServer.stopped = true
+	listeners := httpServer.listeners
+	httpServer.listeners = nil
+	httpServer.lock.Unlock()
+
+	var errs []error
+	for _, listener := range listeners {
+		if err := listener.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	servers := []*http.Server{httpServer.server}
+	if httpServer.forwardProxyServer != nil {
+		servers = append(servers, httpServer.forwardProxyServer)
+	}
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("Server %s isn't shut down: %w", server.Addr, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 func (httpServer *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -52,14 +200,22 @@ func recoverHandler(next http.Handler) http.Handler {
 			if err := recover(); err != nil {
 				httpError, ok := err.(HTTPError)
 				if ok {
+					metrics.Panics.WithLabelValues("http_error").Inc()
 					log.Warnf("An error handled %s, %v", httpError.Message, httpError.Code)
-					http.Error(w, httpError.Message, httpError.Code)
+					writeErrorResponse(w, r, errorResponse{
+						Code:    httpError.Code,
+						Title:   http.StatusText(httpError.Code),
+						Message: httpError.Message,
+					})
 				} else {
+					metrics.Panics.WithLabelValues("unexpected").Inc()
 					log.Errorf("An unknown error was handled for [%s] %s: %v\n Stack trace:\n%s",
 						r.Method, r.RequestURI, err, debug.Stack())
-					http.Error(w,
-						fmt.Sprintf("%s: %v", http.StatusText(http.StatusInternalServerError), err),
-						http.StatusInternalServerError)
+					writeErrorResponse(w, r, errorResponse{
+						Code:    http.StatusInternalServerError,
+						Title:   http.StatusText(http.StatusInternalServerError),
+						Message: fmt.Sprint(err),
+					})
 				}
 			}
 		}()
@@ -69,16 +225,83 @@ func recoverHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
-func proxyHandler(config *config.Config) http.HandlerFunc {
+// routeHandler : passes requests to reserved paths to proxy itself and proxies all other requests
+func routeHandler(config *config.Config, internalHandler, proxyHandler http.Handler) http.HandlerFunc {
+	metricsHandler := promhttp.Handler()
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case isMetricsPath(config, r.URL.Path):
+			metricsHandler.ServeHTTP(w, r)
+		case r.URL.Path == strings.TrimSuffix(reservedPathPrefix, "/"):
+			http.Redirect(w, r, reservedPathPrefix, http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, reservedPathPrefix):
+			internalHandler.ServeHTTP(w, r)
+		case config.StartPage == "" && (r.URL.Path == "" || r.URL.Path == "/"):
+			// status page is the start page if the last one isn't configured
+			r.URL.Path = reservedPathPrefix
+			internalHandler.ServeHTTP(w, r)
+		default:
+			proxyHandler.ServeHTTP(w, r)
+		}
+	}
+}
+
+func isMetricsPath(config *config.Config, path string) bool {
+	return config.Metrics != nil && config.Metrics.Enabled && path == config.Metrics.MetricsPath()
+}
+
+// isInternalPath : checks that path is served by proxy itself
+func isInternalPath(config *config.Config, path string) bool {
+	return strings.HasPrefix(path, reservedPathPrefix) || isMetricsPath(config, path)
+}
+
+func proxyHandler(config *config.Config, upstreams *upstreams) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		hostName, tail := parseHostName(r.URL, config)
-		host, ok := config.Hosts[hostName]
+		host, ok := config.Host(hostName)
 		if !ok {
-			panic(HTTPError{Message: fmt.Sprintf("Host not found for '%s'", hostName), Code: http.StatusNotFound})
+			proxyError := unknownHostError(hostName)
+			metrics.Errors.WithLabelValues(string(proxyError.Kind)).Inc()
+			writeError(w, r, proxyError)
 		} else {
-			var reverseProxy = createReverseProxy(host)
+			entry := requestLogEntry(r)
+			if entry != nil {
+				entry.Host = hostName
+				if host.Forwarding != nil {
+					entry.Gateway = activeGateway(host.Forwarding, upstreams.pool)
+				}
+			}
+
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, "proxy "+hostName, trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("proxy.host", hostName),
+					attribute.String("http.request.method", r.Method),
+				))
+			defer span.End()
+			r = r.WithContext(ctx)
+
+			reverseProxy, err := upstreams.reverseProxy(ctx, hostName, host)
+			if err != nil {
+				proxyError := upstreamError(hostName, err)
+				span.SetStatus(codes.Error, err.Error())
+				metrics.Errors.WithLabelValues(string(proxyError.Kind)).Inc()
+				log.Errorf("Request to %s has been failed. Error: %v", hostName, err)
+				writeError(w, r, proxyError)
+				return
+			}
+			backends := upstreams.backends(hostName, host)
+			upstreams.refreshAliases(hostName, host)
+			chosen := backends.acquire(w, r, hostName)
+			span.SetAttributes(attribute.String("proxy.upstream", chosen.address))
+			if entry != nil {
+				entry.Upstream = chosen.address
+			}
+			ctx = withBackend(ctx, chosen)
+			r = r.WithContext(ctx)
+
 			var originalHost = r.Host
-			var remoteHost = host.Address
+			var remoteHost = ssh.HostHeader(chosen.address)
 			var rw = NewProxyRequest()
 
 			if len(tail) > 0 {
@@ -86,6 +309,7 @@ func proxyHandler(config *config.Config) http.HandlerFunc {
 				r.RequestURI = r.URL.RequestURI()
 			}
 			r.Host = remoteHost
+			otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
 
 			proxyBasePath := &url.URL{
 				Scheme: "http",
@@ -93,68 +317,258 @@ func proxyHandler(config *config.Config) http.HandlerFunc {
 				Path:   hostName,
 			}
 
-			var linksReplacements []Replacement
-			for hostName, desc := range config.Hosts {
-				linksReplacements = append(linksReplacements, Replacement{
-					From: desc.Address,
-					To:   originalHost + "/" + hostName,
-				})
+			replaceConfig := ReplacementConfig{
+				LinksBasePath:          proxyBasePath,
+				ExpectedLocationHeader: remoteHost,
+				ExternalLinks:          upstreams.linkReplacer(config),
+				PatternHostName:        config.PatternHostName,
 			}
 
-			replaceConfig := ReplacementConfig{
-				LinksBasePath:             proxyBasePath,
-				ExpectedLocationHeader:    remoteHost,
-				ExternalLinksReplacements: linksReplacements,
+			if host.OverallTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, host.OverallTimeout)
+				defer cancel()
+				r = r.WithContext(ctx)
 			}
 
-			err := rw.PerformRequest(reverseProxy, w, r, replaceConfig)
+			startedAt := time.Now()
+			err = rw.PerformRequest(reverseProxy, w, r, replaceConfig)
+			latency := time.Since(startedAt)
+			status := rw.responseRecorder.Code
+			var proxyError *Error
+			if errors.As(err, &proxyError) {
+				proxyError.Host = hostName
+				status = proxyError.Code()
+			}
+			backends.release(chosen, isBackendFailure(proxyError, status))
+			upstreams.observe(hostName, host, latency, status)
+			code := strconv.Itoa(status)
+			span.SetAttributes(attribute.Int("http.response.status_code", status))
+			metrics.Requests.WithLabelValues(metricsHostName(hostName, host), code).Inc()
+			metrics.RequestDuration.WithLabelValues(metricsHostName(hostName, host), code).Observe(latency.Seconds())
+			if entry != nil {
+				entry.UpstreamPath = r.URL.RequestURI()
+				entry.UpstreamLatency = milliseconds(rw.upstreamLatency)
+				entry.RewriteLatency = milliseconds(rw.rewriteLatency)
+			}
+			if proxyError != nil {
+				span.SetStatus(codes.Error, err.Error())
+				metrics.Errors.WithLabelValues(string(proxyError.Kind)).Inc()
+				log.Errorf("Request to %s has been failed. Error: %v", remoteHost, err)
+				writeError(w, r, proxyError)
+				return
+			}
 			if err != nil {
-				log.Errorf("Request to %s has been failed. Error: %v", host.Address, err)
-				panic(HTTPError{Message: err.Error(), Code: http.StatusInternalServerError})
+				log.Warnf("Response of %s can't be written: %v", remoteHost, err)
+				return
 			}
 
 			if host.Forwarding != nil {
-				log.Infof("Request to %s was successfully proxied using ssh through %s", host.Address, host.Forwarding.Server)
+				log.Infof("Request to %s was successfully proxied using ssh through %s", remoteHost,
+					activeGateway(host.Forwarding, upstreams.pool))
 			} else {
-				log.Infof("Request to %s was successfully performed", host.Address)
+				log.Infof("Request to %s was successfully performed", remoteHost)
 			}
 
 		}
 	}
 }
 
-func createReverseProxy(host config.Host) (reverseProxy *httputil.ReverseProxy) {
+// metricsHostName : hosts matched by host pattern share metrics of the pattern so any name doesn't create new series
+func metricsHostName(hostName string, host config.Host) string {
+	if pattern := host.Pattern(); pattern != "" {
+		return pattern
+	}
+	return hostName
+}
+
+func createReverseProxy(ctx context.Context, host config.Host, pool *ssh.Pool, prompts *promptStore) (reverseProxy *httputil.ReverseProxy, err error) {
+	addresses := host.AddressList()
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("Host address isn't configured")
+	}
+	_, span := tracer.Start(ctx, "create reverse proxy", trace.WithAttributes(attribute.StringSlice("proxy.upstreams", addresses)))
+	defer span.End()
 	if host.Forwarding != nil {
-		tunnel, err := createSSHTunnelFromConfig(host)
+		span.SetAttributes(attribute.StringSlice("ssh.servers", host.Forwarding.ServerList()))
+		tunnel, err := createTunnel(host, pool, prompts)
 		if err != nil {
-			log.Panicf("Can't create ssh tunnel for forwarding : %v", err)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
 		}
+		tunnel.ResponseHeaderTimeout = host.ResponseHeaderTimeout
 		reverseProxy, err = tunnel.CreateReverseProxy()
 		if err != nil {
-			log.Panicf("Can't forward request: %v", err)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
 		}
 	} else {
 		reverseProxy = httputil.NewSingleHostReverseProxy(&url.URL{
 			Scheme: "http",
-			Host:   host.Address,
+			Host:   ssh.URLHost(addresses[0]),
 		})
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		dial, sockets := directDialer(host), ssh.NewSocketPaths(addresses)
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			network, address = sockets.Resolve(network, address)
+			return dial(ctx, network, address)
+		}
+		transport.ResponseHeaderTimeout = host.ResponseHeaderTimeout
+		reverseProxy.Transport = transport
+	}
+	reverseProxy.Director = backendDirector(reverseProxy.Director)
+	reverseProxy.ErrorHandler = upstreamErrorHandler
+	return reverseProxy, nil
+}
+
+func durationOrDefault(duration, defaultDuration time.Duration) time.Duration {
+	if duration == 0 {
+		return defaultDuration
+	}
+	return duration
+}
+
+// createTunnel : pooled ssh tunnel to the host using its forwarding with configured timeouts
+func createTunnel(host config.Host, pool *ssh.Pool, prompts *promptStore) (*ssh.Tunnel, error) {
+	tunnel, err := createSSHTunnelFromConfig(host, prompts)
+	if err != nil {
+		return nil, &Error{Kind: ErrorForwardingConfig, Err: fmt.Errorf("Can't create ssh tunnel for forwarding: %v", err)}
+	}
+	tunnel.Pool = pool
+	tunnel.ConnectTimeout = durationOrDefault(host.Forwarding.ConnectTimeout, defaultConnectTimeout)
+	tunnel.HandshakeTimeout = durationOrDefault(host.Forwarding.SSHHandshakeTimeout, defaultSSHHandshakeTimeout)
+	tunnel.Interactive = len(host.Forwarding.KeyboardInteractive) > 0
+	if hasBrowserPrompts(host.Forwarding) {
+		// user needs time to enter answers during handshake
+		tunnel.HandshakeTimeout += promptTimeout
+	}
+	if hasTOTPAnswers(host.Forwarding) {
+		// one-time code of the next period could be waited for during handshake
+		tunnel.HandshakeTimeout += totpPeriod * time.Second
+	}
+	tunnel.DialTimeout = durationOrDefault(host.ConnectTimeout, defaultConnectTimeout)
+	tunnel.Nameserver = host.Forwarding.Nameserver
+	return tunnel, nil
+}
+
+// dialFunc : opens connection to the address
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// directDialer : opens connections to the host without ssh, address of unix network is path of local socket
+func directDialer(host config.Host) dialFunc {
+	dialer := &net.Dialer{
+		Timeout:   durationOrDefault(host.ConnectTimeout, defaultConnectTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	return dialer.DialContext
+}
+
+func createSSHTunnelFromConfig(configHost config.Host, prompts *promptStore) (tunnel *ssh.Tunnel, err error) {
+	servers := configHost.Forwarding.ServerList()
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("Forwarding server isn't configured")
+	}
+	var remote string
+	if addresses := configHost.AddressList(); len(addresses) > 0 {
+		remote = addresses[0]
 	}
-	return reverseProxy
+	methods, err := authMethods(configHost.Forwarding, prompts)
+	if err != nil {
+		return nil, err
+	}
+	tunnel = ssh.NewTunnelByAuthMethods(servers[0], remote, configHost.Forwarding.User, methods...)
+	if configHost.Forwarding.KnownHosts != nil {
+		if err = tunnel.VerifyHostKeys(*configHost.Forwarding.KnownHosts); err != nil {
+			return nil, err
+		}
+	}
+	tunnel.Servers = servers
+	tunnel.Remotes = configHost.AddressList()
+	tunnel.Identity = configHost.Forwarding.Identity()
+	return tunnel, nil
 }
 
-func createSSHTunnelFromConfig(configHost config.Host) (*ssh.Tunnel, error) {
-	if configHost.Forwarding.PrivateKey != nil {
-		tunnel, err := ssh.NewTunnelByUserKey(configHost.Forwarding.Server, configHost.Address,
-			configHost.Forwarding.User, *configHost.Forwarding.PrivateKey)
+// authMethods : methods of forwarding in order they are offered to ssh server
+func authMethods(forwarding *config.Forwarding, prompts *promptStore) ([]ssh.AuthMethod, error) {
+	names, err := forwarding.AuthMethodList()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("Unknown forwarding type")
+	}
+	methods := make([]ssh.AuthMethod, 0, len(names))
+	for _, name := range names {
+		var method ssh.AuthMethod
+		switch name {
+		case config.AuthAgent:
+			method = ssh.AgentAuth(forwarding.AgentSocket)
+		case config.AuthCertificate:
+			method, err = ssh.CertificateAuth(*forwarding.PrivateKey, *forwarding.Certificate)
+		case config.AuthPrivateKey:
+			method, err = ssh.PrivateKeyAuth(*forwarding.PrivateKey)
+		case config.AuthPassword:
+			method = ssh.PasswordAuth(*forwarding.Password)
+		case config.AuthKeyboardInteractive:
+			var challenge ssh.KeyboardInteractiveChallenge
+			if challenge, err = keyboardInteractiveChallenge(forwarding, prompts); err == nil {
+				method = ssh.KeyboardInteractiveAuth(challenge)
+			}
+		}
 		if err != nil {
 			return nil, err
 		}
-		return tunnel, nil
-	} else if configHost.Forwarding.Password != nil {
-		return ssh.NewTunnelByUserPassword(configHost.Forwarding.Server, configHost.Address,
-			configHost.Forwarding.User, *configHost.Forwarding.Password), nil
+		methods = append(methods, method)
+	}
+	return methods, nil
+}
+
+// isBackendFailure : checks that backend failed to serve request and should be ejected if it repeats
+func isBackendFailure(proxyError *Error, status int) bool {
+	if proxyError != nil {
+		return proxyError.Kind == ErrorBackendRefused || proxyError.Kind == ErrorBackendTimeout
+	}
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// activeGateway : returns ssh server used for new channels of the host
+func activeGateway(forwarding *config.Forwarding, pool *ssh.Pool) string {
+	servers := forwarding.ServerList()
+	if status, ok := pool.Active(forwarding.User, forwarding.Identity(), servers); ok {
+		return status.Server
+	}
+	if len(servers) > 0 {
+		return servers[0]
+	}
+	return ""
+}
+
+// releaseClients : closes pooled connections of the forwarding after host was changed or removed
+// if other hosts don't use them, so stale credentials aren't reconnected by health checks
+func releaseClients(cfg *config.Config, pool *ssh.Pool, forwarding *config.Forwarding) {
+	if forwarding == nil {
+		return
+	}
+	identity := forwarding.Identity()
+	used := make(map[string]bool)
+	useServers := func(other *config.Forwarding) {
+		if other != nil && other.User == forwarding.User && other.Identity() == identity {
+			for _, server := range other.ServerList() {
+				used[server] = true
+			}
+		}
+	}
+	for _, host := range cfg.AllHosts() {
+		useServers(host.Forwarding)
+	}
+	for _, hostPattern := range cfg.HostPatterns {
+		useServers(hostPattern.Forwarding)
+	}
+	for _, server := range forwarding.ServerList() {
+		if !used[server] {
+			pool.Remove(forwarding.User, server, identity)
+		}
 	}
-	return nil, fmt.Errorf("Unknown forwarding type")
 }
 
 func parseHostName(url *url.URL, config *config.Config) (hostName, tail string) {
@@ -166,7 +580,7 @@ func parseHostName(url *url.URL, config *config.Config) (hostName, tail string)
 		withoutFirstSlash := url.Path[1:]
 		parts := strings.Split(withoutFirstSlash, "/")
 		hostName = parts[0]
-		if _, ok := config.Hosts[hostName]; !ok {
+		if _, ok := config.Host(hostName); !ok {
 			hostName = config.StartPage
 			tail = strings.Join(parts, "/")
 		} else {
@@ -1,11 +1,34 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	"github.com/nawa/http-ssh-proxy/tracing"
 	assert "github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func TestParseHostName(t *testing.T) {
@@ -45,3 +68,483 @@ func TestParseHostName(t *testing.T) {
 	assert.Equal(t, "worker-2", hostName)
 	assert.Equal(t, "path/to/something", tail)
 }
+
+func TestMetricsEndpoint(t *testing.T) {
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	failingHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(HTTPError{Message: "failed", Code: http.StatusBadGateway})
+	})
+	handler := recoverHandler(routeHandler(cfg, http.NotFoundHandler(), failingHandler))
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/worker-2/", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/metrics", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `http_ssh_proxy_panics_total{type="http_error"}`)
+
+	cfg.Metrics.Enabled = false
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/metrics", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan struct{}, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+	freePort := func() int {
+		listener, err := net.Listen("tcp", "localhost:0")
+		assert.NoError(t, err)
+		defer listener.Close() // nolint
+		return listener.Addr().(*net.TCPAddr).Port
+	}
+	port, forwardProxyPort, socksPort, tcpForwardPort := freePort(), freePort(), freePort(), freePort()
+	cfg, err := config.NewConfig([]byte(fmt.Sprintf(`app-port: %v
+start-page: status
+hosts:
+    slow:
+        address: %s
+forward-proxy:
+    port: %v
+socks:
+    port: %v
+tcp-forwards:
+    - listen: localhost:%v
+      remote: %s
+      host: slow
+`, port, strings.TrimPrefix(upstream.URL, "http://"), forwardProxyPort, socksPort, tcpForwardPort, strings.TrimPrefix(upstream.URL, "http://"))))
+	assert.NoError(t, err)
+	httpServer := NewProxyServer(cfg)
+
+	stopped := make(chan struct{})
+	go func() {
+		httpServer.Start()
+		close(stopped)
+	}()
+	assert.Eventually(t, func() bool {
+		response, err := http.Get(fmt.Sprintf("http://localhost:%v/_proxy/", port))
+		if err != nil {
+			return false
+		}
+		response.Body.Close() // nolint
+		return response.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+	go http.Get(fmt.Sprintf("http://localhost:%v/slow/", port)) // nolint
+	<-received
+
+	// request isn't finished in time but every server and listener is stopped anyway
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Error(t, httpServer.Shutdown(ctx))
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after Shutdown")
+	}
+	for _, stoppedPort := range []int{port, forwardProxyPort, socksPort, tcpForwardPort} {
+		_, err = net.Dial("tcp", fmt.Sprintf("localhost:%v", stoppedPort))
+		assert.Error(t, err)
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body><a href=\"/path\">link</a></body></html>")) // nolint
+	}))
+	defer upstream.Close()
+
+	_, err := tracing.Setup(nil)
+	assert.NoError(t, err)
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background()) // nolint
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("upstream", config.Host{Address: strings.TrimPrefix(upstream.URL, "http://")})
+	handler := recoverHandler(proxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())))
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	request, _ := http.NewRequest("GET", "/upstream/", nil)
+	request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, upstreamTraceparent, traceID)
+
+	names := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		assert.Equal(t, traceID, span.SpanContext().TraceID().String())
+		names[span.Name()] = true
+	}
+	assert.True(t, names["proxy upstream"])
+	assert.True(t, names["create reverse proxy"])
+	assert.True(t, names["rewrite html"])
+}
+
+func TestGatewayFailover(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream")) // nolint
+	}))
+	defer upstream.Close()
+	first := newTestSSHServer(t)
+	second := newTestSSHServer(t)
+	unreachable := newTestSSHServer(t)
+	unreachable.Close()
+
+	forwarding := first.forwarding()
+	forwarding.Server = ""
+	forwarding.Servers = []string{unreachable.Address, first.Address, second.Address}
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("forwarded", config.Host{Address: strings.TrimPrefix(upstream.URL, "http://"), Forwarding: forwarding})
+	pool := ssh.NewPool()
+	upstreams := newUpstreams(pool, newPromptStore())
+	handler := recoverHandler(proxyHandler(cfg, upstreams))
+
+	doRequest := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/forwarded/", nil)
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+	recorder := doRequest()
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "upstream", recorder.Body.String())
+	host, _ := cfg.Host("forwarded")
+	status := newHostStatus("forwarded", host, cfg, upstreams, pool)
+	assert.Equal(t, first.Address, status.Gateway)
+	assert.Len(t, status.Gateways, 3)
+	assert.Equal(t, gatewayUnhealthy, status.Gateways[0].Health)
+	assert.Equal(t, gatewayHealthy, status.Gateways[1].Health)
+	// the last server wasn't needed so nothing is known about it
+	assert.Equal(t, gatewayUnknown, status.Gateways[2].Health)
+
+	first.Close()
+	recorder = doRequest()
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "upstream", recorder.Body.String())
+	pool.CheckHealth(time.Second)
+	status = newHostStatus("forwarded", host, cfg, upstreams, pool)
+	assert.Equal(t, second.Address, status.Gateway)
+	assert.Equal(t, gatewayUnhealthy, status.Gateways[1].Health)
+	assert.Equal(t, gatewayHealthy, status.Gateways[2].Health)
+}
+
+func TestInvalidRemoteKeepsSharedConnection(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer echo.Close() // nolint
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn) // nolint
+				conn.Close()        // nolint
+			}()
+		}
+	}()
+	gateway := newTestSSHServer(t)
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	dial, err := upstreams.dialer("gateway", config.Host{Forwarding: gateway.forwarding()})
+	assert.NoError(t, err)
+
+	conn, err := dial(context.Background(), "tcp", echo.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close() // nolint
+	ping := func() {
+		_, err := conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+		reply := make([]byte, 4)
+		_, err = io.ReadFull(conn, reply)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(reply))
+	}
+	ping()
+
+	// invalid remote of another request doesn't reset channels opened through the same ssh connection
+	for _, address := range []string{"127.0.0.1:99999", "127.0.0.1:abc", "127.0.0.1:0"} {
+		_, err = dial(context.Background(), "tcp", address)
+		var addressError *ssh.AddressError
+		assert.True(t, errors.As(err, &addressError), address)
+	}
+	ping()
+	assert.Equal(t, int64(1), upstreams.pool.Statuses()[0].OpenChannels)
+}
+
+func TestHostPatterns(t *testing.T) {
+	var otherAddress string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<a href="http://%s/logs">other node</a>`, otherAddress)
+	}))
+	defer upstream.Close()
+	otherAddress = "127.0.0.2:8081"
+	ip, port, _ := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+
+	cfg, err := config.NewConfig([]byte("start-page: status\nhost-patterns:\n    local-{ip}-{port}:\n        subnets: [127.0.0.0/8]\n"))
+	assert.NoError(t, err)
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	handler := recoverHandler(proxyHandler(cfg, upstreams))
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://proxy:8080/local-"+ip+"-"+port+"/", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `<a href="http://proxy:8080/local-127.0.0.2-8081/logs">other node</a>`, recorder.Body.String())
+	host, _ := cfg.Host("local-" + ip + "-" + port)
+	assert.Equal(t, "local-{ip}-{port}", metricsHostName("local-"+ip+"-"+port, host))
+
+	outOfSubnet, _ := url.Parse("http://proxy:8080/local-192.168.0.1-" + port + "/")
+	hostName, _ := parseHostName(outOfSubnet, cfg)
+	assert.Equal(t, cfg.StartPage, hostName)
+	invalidPort, _ := url.Parse("http://proxy:8080/local-" + ip + "-99999/")
+	hostName, _ = parseHostName(invalidPort, cfg)
+	assert.Equal(t, cfg.StartPage, hostName)
+
+	// walking subnet doesn't keep state of every name
+	for i := 0; i < patternUpstreamsLimit+10; i++ {
+		hostName := fmt.Sprintf("local-127.0.%d.%d-80", i/250, i%250+1)
+		host, ok := cfg.Host(hostName)
+		assert.True(t, ok)
+		upstreams.backends(hostName, host)
+	}
+	assert.Len(t, upstreams.items, patternUpstreamsLimit)
+	assert.Equal(t, patternUpstreamsLimit, upstreams.patternNames.Len())
+}
+
+func TestUnixSocketHost(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	upstream := &httptest.Server{Listener: listener, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.URL.Path)) // nolint
+	})}}
+	upstream.Start()
+	defer upstream.Close()
+	gateway := newTestSSHServer(t)
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("docker", config.Host{Address: "unix:" + socket, Forwarding: gateway.forwarding()})
+	cfg.SetHost("local-docker", config.Host{Address: "unix:" + socket})
+	handler := recoverHandler(proxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())))
+
+	for _, hostName := range []string{"docker", "local-docker"} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/"+hostName+"/v1.41/containers/json", nil)
+		handler.ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "localhost /v1.41/containers/json", recorder.Body.String())
+	}
+
+	// socket of forwarded host is dialed only through gateway
+	gateway.Close()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/docker/_ping", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+}
+
+func TestCertificateAuth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream")) // nolint
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	userCA, hostCA, otherCA := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	userKey, hostKey := newTestSigner(t), newTestSigner(t)
+	writeFile := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+		return path
+	}
+	privateKey := writeFile("id_ed25519", userKey.pem)
+	now := uint64(time.Now().Unix())
+	certificate := writeFile("id_ed25519-cert.pub", signTestCertificate(t, userCA, userKey, cryptossh.UserCert, testSSHUser, now-60, now+3600))
+	expired := writeFile("expired-cert.pub", signTestCertificate(t, userCA, userKey, cryptossh.UserCert, testSSHUser, now-7200, now-3600))
+
+	hostCert, _, _, _, _ := cryptossh.ParseAuthorizedKey(signTestCertificate(t, hostCA, hostKey, cryptossh.HostCert, "127.0.0.1", now-60, now+3600))
+	hostSigner, err := cryptossh.NewCertSigner(hostCert.(*cryptossh.Certificate), hostKey)
+	assert.NoError(t, err)
+	gateway := newTestSSHServer(t, func(config *cryptossh.ServerConfig) {
+		checker := &cryptossh.CertChecker{IsUserAuthority: func(auth cryptossh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), userCA.PublicKey().Marshal())
+		}}
+		config.PublicKeyCallback = checker.Authenticate
+		config.AddHostKey(hostSigner)
+	})
+	// patterns of known hosts match port 22 only if other port isn't set
+	pattern := knownhosts.Normalize(gateway.Address)
+	knownHosts := writeFile("known_hosts", []byte("@cert-authority "+pattern+" "+string(cryptossh.MarshalAuthorizedKey(hostCA.PublicKey()))))
+	otherKnownHosts := writeFile("other_known_hosts", []byte("@cert-authority "+pattern+" "+string(cryptossh.MarshalAuthorizedKey(otherCA.PublicKey()))))
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	get := func(hostName, certificate, knownHosts string) int {
+		// pool isn't shared as ssh connection is reused by the same user and server
+		handler := recoverHandler(proxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())))
+		cfg.SetHost(hostName, config.Host{
+			Address: strings.TrimPrefix(upstream.URL, "http://"),
+			Forwarding: &config.Forwarding{
+				User:        testSSHUser,
+				PrivateKey:  &privateKey,
+				Certificate: &certificate,
+				KnownHosts:  &knownHosts,
+				Server:      gateway.Address,
+			},
+		})
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/"+hostName+"/", nil)
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusOK, get("signed", certificate, knownHosts))
+	// user certificates are accepted by ssh server only if they aren't expired
+	assert.NotEqual(t, http.StatusOK, get("expired", expired, knownHosts))
+	// host certificate must be signed by CA of known hosts
+	assert.NotEqual(t, http.StatusOK, get("untrusted", certificate, otherKnownHosts))
+}
+
+func TestKnownHostsWithSharedGateway(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream")) // nolint
+	}))
+	defer upstream.Close()
+
+	gateway := newTestSSHServer(t)
+	// gateway key isn't listed in known hosts
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(gateway.Address)}, newTestSigner(t).PublicKey())
+	assert.NoError(t, ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600))
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	handler := recoverHandler(proxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())))
+	for _, hostName := range []string{"unverified", "verified"} {
+		forwarding := gateway.forwarding()
+		if hostName == "verified" {
+			forwarding.KnownHosts = &knownHosts
+		}
+		cfg.SetHost(hostName, config.Host{Address: strings.TrimPrefix(upstream.URL, "http://"), Forwarding: forwarding})
+	}
+	get := func(hostName string) int {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/"+hostName+"/", nil)
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusOK, get("unverified"))
+	// connection opened without host key verification isn't reused
+	assert.NotEqual(t, http.StatusOK, get("verified"))
+}
+
+func TestAuthMethods(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream")) // nolint
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	privateKey := filepath.Join(dir, "id_ed25519")
+	assert.NoError(t, ioutil.WriteFile(privateKey, newTestSigner(t).pem, 0600))
+	password := testSSHPassword
+
+	agentSocket := filepath.Join(dir, "agent.sock")
+	agentListener, err := net.Listen("unix", agentSocket)
+	assert.NoError(t, err)
+	defer agentListener.Close() // nolint
+	keyring := agent.NewKeyring()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	agentKey, err := cryptossh.NewPublicKey(key.Public())
+	assert.NoError(t, err)
+	assert.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+	go func() {
+		for {
+			conn, err := agentListener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn) // nolint
+		}
+	}()
+
+	// gateway accepts password and key of agent only
+	gateway := newTestSSHServer(t, func(config *cryptossh.ServerConfig) {
+		config.PublicKeyCallback = func(conn cryptossh.ConnMetadata, key cryptossh.PublicKey) (*cryptossh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), agentKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key")
+		}
+	})
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	get := func(hostName string, forwarding config.Forwarding) int {
+		handler := recoverHandler(proxyHandler(cfg, newUpstreams(ssh.NewPool(), newPromptStore())))
+		forwarding.User = testSSHUser
+		forwarding.Server = gateway.Address
+		cfg.SetHost(hostName, config.Host{
+			Address:    strings.TrimPrefix(upstream.URL, "http://"),
+			Forwarding: &forwarding,
+		})
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/"+hostName+"/", nil)
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	// password is offered after rejected key
+	assert.Equal(t, http.StatusOK, get("fallback", config.Forwarding{PrivateKey: &privateKey, Password: &password}))
+	assert.NotEqual(t, http.StatusOK, get("key-only", config.Forwarding{PrivateKey: &privateKey, Password: &password,
+		AuthMethods: []string{config.AuthPrivateKey}}))
+	// keys of agent are offered together with private key in any order
+	assert.Equal(t, http.StatusOK, get("agent", config.Forwarding{PrivateKey: &privateKey, AgentSocket: agentSocket,
+		AuthMethods: []string{config.AuthPrivateKey, config.AuthAgent}}))
+	assert.NotEqual(t, http.StatusOK, get("unknown-agent", config.Forwarding{PrivateKey: &privateKey, AgentSocket: filepath.Join(dir, "missing.sock"),
+		AuthMethods: []string{config.AuthAgent, config.AuthPrivateKey}}))
+}
+
+// testSigner : ed25519 key with its PEM encoding
+type testSigner struct {
+	cryptossh.Signer
+	pem []byte
+}
+
+func newTestSigner(t *testing.T) testSigner {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := cryptossh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+	block, err := cryptossh.MarshalPrivateKey(key, "")
+	assert.NoError(t, err)
+	return testSigner{Signer: signer, pem: pem.EncodeToMemory(block)}
+}
+
+// signTestCertificate : returns certificate of the key in authorized_keys format
+func signTestCertificate(t *testing.T, ca, key testSigner, certType uint32, principal string, validAfter, validBefore uint64) []byte {
+	cert := &cryptossh.Certificate{
+		Key:             key.PublicKey(),
+		CertType:        certType,
+		KeyId:           principal,
+		ValidPrincipals: []string{principal},
+		ValidAfter:      validAfter,
+		ValidBefore:     validBefore,
+	}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cryptossh.MarshalAuthorizedKey(cert)
+}
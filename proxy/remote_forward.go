@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+)
+
+// remoteForwardRetryInterval : delay before listening on ssh server again after failure or lost connection
+const remoteForwardRetryInterval = 5 * time.Second
+
+// remoteForwarder : relays connections accepted by ssh server to local address, listener is opened again
+// through pooled ssh connection after it's reestablished
+type remoteForwarder struct {
+	config        *config.Config
+	forward       config.RemoteForward
+	pool          *ssh.Pool
+	prompts       *promptStore
+	retryInterval time.Duration
+
+	active int64
+	total  int64
+	failed int64
+
+	lock       sync.Mutex
+	listener   net.Listener
+	listenedAt time.Time
+	lastError  error
+	done       chan struct{}
+}
+
+// remoteForwardStatus : state of remote forward listener shown on status page
+type remoteForwardStatus struct {
+	Listen     string
+	Local      string
+	Host       string
+	Gateway    string
+	Listening  bool
+	ListenedAt time.Time
+	LastError  string
+	Active     int64
+	Total      int64
+	Failed     int64
+}
+
+func newRemoteForwarders(cfg *config.Config, pool *ssh.Pool, prompts *promptStore) []*remoteForwarder {
+	forwarders := make([]*remoteForwarder, 0, len(cfg.RemoteForwards))
+	for _, forward := range cfg.RemoteForwards {
+		forwarders = append(forwarders, &remoteForwarder{
+			config:        cfg,
+			forward:       forward,
+			pool:          pool,
+			prompts:       prompts,
+			retryInterval: remoteForwardRetryInterval,
+			done:          make(chan struct{}),
+		})
+	}
+	return forwarders
+}
+
+// start : keeps listening on ssh server until returned function is called
+func (forwarder *remoteForwarder) start() (stop func()) {
+	go forwarder.run()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			forwarder.lock.Lock()
+			defer forwarder.lock.Unlock()
+			close(forwarder.done)
+			if forwarder.listener != nil {
+				forwarder.listener.Close() // nolint
+			}
+		})
+	}
+}
+
+func (forwarder *remoteForwarder) run() {
+	for {
+		listener, err := forwarder.listen()
+		if err != nil {
+			log.Warnf("Remote forward %s of %s can't be established: %v", forwarder.forward.Listen, forwarder.forward.Host, err)
+		} else {
+			log.Infof("Remote forward %s of %s to %s has been established", forwarder.forward.Listen, forwarder.forward.Host, forwarder.forward.Local)
+			err = forwarder.serve(listener)
+			if err == io.EOF {
+				err = fmt.Errorf("SSH connection has been lost")
+			}
+			log.Warnf("Remote forward %s of %s has been closed: %v", forwarder.forward.Listen, forwarder.forward.Host, err)
+		}
+		forwarder.lock.Lock()
+		forwarder.listener = nil
+		forwarder.lastError = err
+		forwarder.lock.Unlock()
+
+		select {
+		case <-time.After(forwarder.retryInterval):
+		case <-forwarder.done:
+			return
+		}
+	}
+}
+
+// listen : opens listener on ssh server through forwarding of the host, the host is looked up each time as it could be changed at runtime
+func (forwarder *remoteForwarder) listen() (net.Listener, error) {
+	host, ok := forwarder.config.Host(forwarder.forward.Host)
+	if !ok {
+		return nil, unknownHostError(forwarder.forward.Host)
+	}
+	if host.Forwarding == nil {
+		return nil, fmt.Errorf("Host '%s' has no forwarding", forwarder.forward.Host)
+	}
+	tunnel, err := createTunnel(host, forwarder.pool, forwarder.prompts)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tunnel.Listen("tcp", forwarder.forward.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	forwarder.lock.Lock()
+	defer forwarder.lock.Unlock()
+	select {
+	case <-forwarder.done:
+		listener.Close() // nolint
+		return nil, fmt.Errorf("Remote forward has been stopped")
+	default:
+	}
+	forwarder.listener = listener
+	forwarder.listenedAt = time.Now()
+	forwarder.lastError = nil
+	return listener, nil
+}
+
+// serve : accepts connections until listener is closed
+func (forwarder *remoteForwarder) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go forwarder.handle(conn)
+	}
+}
+
+func (forwarder *remoteForwarder) handle(conn net.Conn) {
+	defer conn.Close() // nolint
+	atomic.AddInt64(&forwarder.total, 1)
+	local, err := net.DialTimeout("tcp", forwarder.forward.Local, defaultConnectTimeout)
+	if err != nil {
+		atomic.AddInt64(&forwarder.failed, 1)
+		log.Errorf("Remote forward from %s to %s has been failed. Error: %v", forwarder.forward.Listen, forwarder.forward.Local, err)
+		return
+	}
+	defer local.Close() // nolint
+	atomic.AddInt64(&forwarder.active, 1)
+	defer atomic.AddInt64(&forwarder.active, -1)
+	relay(conn, conn, local)
+}
+
+func (forwarder *remoteForwarder) status() remoteForwardStatus {
+	status := remoteForwardStatus{
+		Listen: forwarder.forward.Listen,
+		Local:  forwarder.forward.Local,
+		Host:   forwarder.forward.Host,
+		Active: atomic.LoadInt64(&forwarder.active),
+		Total:  atomic.LoadInt64(&forwarder.total),
+		Failed: atomic.LoadInt64(&forwarder.failed),
+	}
+	if host, ok := forwarder.config.Host(forwarder.forward.Host); ok && host.Forwarding != nil {
+		status.Gateway = activeGateway(host.Forwarding, forwarder.pool)
+	}
+	forwarder.lock.Lock()
+	defer forwarder.lock.Unlock()
+	if forwarder.listener != nil {
+		status.Listening = true
+		status.ListenedAt = forwarder.listenedAt
+	}
+	if forwarder.lastError != nil {
+		status.LastError = forwarder.lastError.Error()
+	}
+	return status
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestRemoteForward(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("laptop")) // nolint
+	}))
+	defer local.Close()
+	gateway := newTestSSHServer(t)
+
+	// port on gateway is fixed to be listened again after reconnect
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	listen := free.Addr().String()
+	free.Close() // nolint
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("gateway", config.Host{Forwarding: gateway.forwarding()})
+	cfg.RemoteForwards = []config.RemoteForward{{Listen: listen, Local: strings.TrimPrefix(local.URL, "http://"), Host: "gateway"}}
+	pool := ssh.NewPool()
+	forwarders := newRemoteForwarders(cfg, pool, newPromptStore())
+	forwarders[0].retryInterval = 10 * time.Millisecond
+	stop := forwarders[0].start()
+	defer stop()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func() string {
+		var body []byte
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			response, err := client.Get("http://" + listen)
+			if err != nil {
+				continue
+			}
+			body, _ = ioutil.ReadAll(response.Body)
+			response.Body.Close() // nolint
+			break
+		}
+		return string(body)
+	}
+	assert.Equal(t, "laptop", get())
+	status := forwarders[0].status()
+	assert.True(t, status.Listening)
+	assert.Equal(t, gateway.Address, status.Gateway)
+
+	// listener is opened again through new ssh connection
+	gateway.Disconnect()
+	assert.Equal(t, "laptop", get())
+	assert.True(t, forwarders[0].status().Total >= 2)
+
+	recorder := httptest.NewRecorder()
+	statusPageHandler(cfg, newUpstreams(pool, newPromptStore()), pool, nil, forwarders).ServeHTTP(recorder, httptest.NewRequest("GET", "/_proxy/", nil))
+	assert.Contains(t, recorder.Body.String(), "listening since")
+
+	stop()
+	_, err = net.DialTimeout("tcp", listen, time.Second)
+	for deadline := time.Now().Add(5 * time.Second); err == nil && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		_, err = net.DialTimeout("tcp", listen, time.Second)
+	}
+	assert.Error(t, err)
+}
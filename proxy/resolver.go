@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+)
+
+const (
+	aliasesTTL     = 5 * time.Minute
+	aliasesTimeout = 10 * time.Second
+)
+
+// hostResolver : resolves names the same way as the host is reached, it's nil if names are resolved by ssh server
+// and can't be looked up because nameserver of forwarding isn't configured
+func hostResolver(host config.Host, pool *ssh.Pool, prompts *promptStore) (*net.Resolver, error) {
+	if host.Forwarding == nil {
+		return net.DefaultResolver, nil
+	}
+	if host.Forwarding.Nameserver == "" {
+		return nil, nil
+	}
+	tunnel, err := createTunnel(host, pool, prompts)
+	if err != nil {
+		return nil, err
+	}
+	return tunnel.Resolver(), nil
+}
+
+// resolveAliases : returns IPs of named addresses and names of IP addresses keeping their ports
+func resolveAliases(ctx context.Context, resolver *net.Resolver, addresses []string) []string {
+	aliases := []string{}
+	for _, address := range addresses {
+		name, port, err := net.SplitHostPort(address)
+		if err != nil {
+			name, port = address, ""
+		}
+		var resolved []string
+		if net.ParseIP(name) != nil {
+			resolved, err = resolver.LookupAddr(ctx, name)
+		} else {
+			resolved, err = resolver.LookupHost(ctx, name)
+		}
+		if err != nil {
+			log.Debugf("Aliases of %s can't be resolved: %v", address, err)
+			continue
+		}
+		for _, alias := range resolved {
+			alias = strings.TrimSuffix(alias, ".")
+			if port != "" {
+				alias = net.JoinHostPort(alias, port)
+			}
+			if !containsString(addresses, alias) && !containsString(aliases, alias) {
+				aliases = append(aliases, alias)
+			}
+		}
+	}
+	return aliases
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	assert "github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRemoteResolution(t *testing.T) {
+	var upstreamAddress string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<a href="http://%s/jobs">jobs</a>`, upstreamAddress)
+	}))
+	defer upstream.Close()
+	upstreamAddress = strings.TrimPrefix(upstream.URL, "http://")
+	_, port, _ := net.SplitHostPort(upstreamAddress)
+	nameserver := newTestDNSServer(t, map[string][]dnsmessage.ResourceBody{
+		"app.internal.": {&dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}},
+	})
+	gateway := newTestSSHServer(t)
+
+	forwarding := gateway.forwarding()
+	forwarding.Nameserver = nameserver
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("internal", config.Host{Address: "app.internal:" + port, Forwarding: forwarding})
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	handler := recoverHandler(proxyHandler(cfg, upstreams))
+	doRequest := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "http://proxy:8080/internal/", nil)
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// gateway can't resolve the name so it's looked up with internal nameserver
+	recorder := doRequest()
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Eventually(t, func() bool {
+		return containsString(upstreams.aliases("internal"), upstreamAddress)
+	}, 5*time.Second, 10*time.Millisecond)
+	recorder = doRequest()
+	assert.Contains(t, recorder.Body.String(), `href="http://proxy:8080/internal/jobs"`)
+
+	// other hosts weren't proxied so their aliases aren't resolved
+	upstreams.lock.Lock()
+	defer upstreams.lock.Unlock()
+	assert.Len(t, upstreams.items, 1)
+}
+
+func TestRemoteResolutionCache(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream")) // nolint
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+	// upstream listens on 127.0.0.1 only so connection to the first IP is refused
+	nameserver, queries := newCountingTestDNSServer(t, map[string][]dnsmessage.ResourceBody{
+		"app.internal.": {&dnsmessage.AResource{A: [4]byte{127, 0, 0, 2}}, &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}},
+	})
+	gateway := newTestSSHServer(t)
+
+	forwarding := gateway.forwarding()
+	forwarding.Nameserver = nameserver
+	host := config.Host{Address: "app.internal:" + port, Forwarding: forwarding}
+	tunnel, err := createTunnel(host, ssh.NewPool(), newPromptStore())
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		conn, err := tunnel.DialContext(context.Background(), "tcp", host.Address)
+		assert.NoError(t, err)
+		fmt.Fprint(conn, "GET / HTTP/1.0\r\n\r\n") // nolint
+		response, err := ioutil.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Contains(t, string(response), "upstream")
+		conn.Close() // nolint
+	}
+	// A and AAAA queries of the first dial only
+	assert.Equal(t, int32(2), atomic.LoadInt32(queries))
+}
+
+func TestResolveAliases(t *testing.T) {
+	aliases := resolveAliases(context.Background(), net.DefaultResolver, []string{"localhost:8080", "unknown.invalid:80"})
+	assert.Contains(t, aliases, "127.0.0.1:8080")
+	assert.NotContains(t, aliases, "localhost:8080")
+}
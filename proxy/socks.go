@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socksVersion         = 5
+	socksAuthVersion     = 1
+	socksMethodNoAuth    = 0
+	socksMethodPassword  = 2
+	socksMethodNone      = 0xff
+	socksCommandConnect  = 1
+	socksAddressIPv4     = 1
+	socksAddressDomain   = 3
+	socksAddressIPv6     = 4
+	socksReplySucceeded  = 0
+	socksReplyFailure    = 1
+	socksReplyNotAllowed = 2
+	socksReplyHost       = 4
+	socksReplyRefused    = 5
+	socksReplyTTLExpired = 6
+	socksReplyCommand    = 7
+	socksReplyAddress    = 8
+
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+// socksServer : SOCKS5 server supporting CONNECT command, destinations are dialed through ssh gateways chosen by rules
+type socksServer struct {
+	config        *config.Config
+	authenticator *authenticator
+	dialer        *ruleDialer
+}
+
+func newSocksServer(cfg *config.Config, upstreams *upstreams) *socksServer {
+	server := &socksServer{
+		config: cfg,
+		dialer: &ruleDialer{config: cfg, upstreams: upstreams, rules: cfg.Socks.Rules},
+	}
+	if cfg.Auth != nil {
+		server.authenticator = newAuthenticator(cfg.Auth)
+	}
+	return server
+}
+
+// serve : accepts connections until listener is closed
+func (server *socksServer) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *socksServer) handle(conn net.Conn) {
+	defer conn.Close()                                      // nolint
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout)) // nolint
+	id, err := server.negotiate(conn)
+	if err != nil {
+		log.Warnf("SOCKS client %s has been rejected: %v", conn.RemoteAddr(), err)
+		return
+	}
+	address, err := readSocksRequest(conn)
+	if err != nil {
+		log.Warnf("SOCKS request of %s is invalid: %v", conn.RemoteAddr(), err)
+		return
+	}
+	hostName, gateway, err := server.dialer.route(address)
+	if err != nil {
+		log.Errorf("SOCKS connection to %s has been failed. Error: %v", address, err)
+		writeSocksReply(conn, socksReplyCode(upstreamError(address, err))) // nolint
+		return
+	}
+	if id != nil && hostName != "" && !isUserAllowed(server.config, hostName, id) {
+		log.Warnf("User '%s' isn't allowed to access '%s' using SOCKS", id.user, address)
+		writeSocksReply(conn, socksReplyNotAllowed) // nolint
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), socksHandshakeTimeout)
+	remote, err := server.dialer.DialContext(ctx, "tcp", address)
+	cancel()
+	if err != nil {
+		log.Errorf("SOCKS connection to %s has been failed. Error: %v", address, err)
+		writeSocksReply(conn, socksReplyCode(upstreamError(address, err))) // nolint
+		return
+	}
+	defer remote.Close() // nolint
+	if err = writeSocksReply(conn, socksReplySucceeded); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{}) // nolint
+	if gateway.Forwarding != nil {
+		log.Debugf("SOCKS connection of %s to %s is opened through %s", conn.RemoteAddr(), address,
+			activeGateway(gateway.Forwarding, server.dialer.upstreams.pool))
+	}
+	relay(conn, conn, remote)
+}
+
+// negotiate : chooses authentication method and checks username and password if authentication is enabled
+func (server *socksServer) negotiate(conn net.Conn) (*identity, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("Unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socksMethodNoAuth)
+	if server.authenticator != nil {
+		method = socksMethodPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		conn.Write([]byte{socksVersion, socksMethodNone}) // nolint
+		return nil, fmt.Errorf("Client doesn't support required authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	if server.authenticator == nil {
+		return nil, nil
+	}
+
+	user, password, err := readSocksCredentials(conn)
+	if err != nil {
+		return nil, err
+	}
+	var id *identity
+	if server.authenticator.loadError == nil {
+		id = server.authenticator.authenticatePassword(user, password)
+	}
+	if id == nil {
+		conn.Write([]byte{socksAuthVersion, 1}) // nolint
+		return nil, fmt.Errorf("Wrong password of user '%s'", user)
+	}
+	_, err = conn.Write([]byte{socksAuthVersion, 0})
+	return id, err
+}
+
+// readSocksCredentials : reads username/password subnegotiation request
+func readSocksCredentials(conn net.Conn) (user, password string, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[0] != socksAuthVersion {
+		err = fmt.Errorf("Unsupported authentication version %d", header[0])
+		return
+	}
+	if user, err = readSocksString(conn, int(header[1])); err != nil {
+		return
+	}
+	length := make([]byte, 1)
+	if _, err = io.ReadFull(conn, length); err != nil {
+		return
+	}
+	password, err = readSocksString(conn, int(length[0]))
+	return
+}
+
+// readSocksRequest : reads CONNECT request and returns its destination address
+func readSocksRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("Unsupported SOCKS version %d", header[0])
+	}
+	if header[1] != socksCommandConnect {
+		writeSocksReply(conn, socksReplyCommand) // nolint
+		return "", fmt.Errorf("Unsupported command %d", header[1])
+	}
+	var host string
+	switch header[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socksAddressIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		domain, err := readSocksString(conn, int(length[0]))
+		if err != nil {
+			return "", err
+		}
+		host = domain
+	default:
+		writeSocksReply(conn, socksReplyAddress) // nolint
+		return "", fmt.Errorf("Unsupported address type %d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func readSocksString(conn net.Conn, length int) (string, error) {
+	value := make([]byte, length)
+	_, err := io.ReadFull(conn, value)
+	return string(value), err
+}
+
+// writeSocksReply : writes reply to CONNECT request, bound address isn't reported
+func writeSocksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReplyCode : reply code of dial error
+func socksReplyCode(err *Error) byte {
+	switch err.Kind {
+	case ErrorBackendTimeout:
+		return socksReplyTTLExpired
+	case ErrorBackendRefused:
+		return socksReplyRefused
+	case ErrorSSHUnreachable, ErrorUnknownHost:
+		return socksReplyHost
+	case ErrorBadRequest:
+		return socksReplyAddress
+	}
+	return socksReplyFailure
+}
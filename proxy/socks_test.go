@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	assert "github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestSocks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream")) // nolint
+	}))
+	defer upstream.Close()
+	gateway := newTestSSHServer(t)
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.Auth = nil
+	cfg.SetHost("gateway", config.Host{Forwarding: gateway.forwarding()})
+	cfg.Socks = &config.Socks{Rules: []config.ForwardRule{{Destinations: []string{"127.0.0.0/8"}, Host: "gateway"}}}
+	address := startTestSocksServer(t, cfg)
+
+	get := func(auth *proxy.Auth, url string) (*http.Response, error) {
+		dialer, err := proxy.SOCKS5("tcp", address, auth, proxy.Direct)
+		assert.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{Dial: dialer.Dial}}
+		return client.Get(url)
+	}
+	response, err := get(nil, upstream.URL)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close() // nolint
+	assert.Equal(t, "upstream", string(body))
+
+	// destinations of the rule are dialed only through gateway, others are dialed directly
+	gateway.Close()
+	_, err = get(nil, upstream.URL)
+	assert.Error(t, err)
+	response, err = get(nil, strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1))
+	assert.NoError(t, err)
+	response.Body.Close() // nolint
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func TestSocksAuth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream")) // nolint
+	}))
+	defer upstream.Close()
+
+	htpasswd := "testdata/htpasswd"
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.Auth = &config.Auth{Htpasswd: &htpasswd}
+	cfg.SetHost("restricted", config.Host{AllowedUsers: []string{"alice"}})
+	cfg.Socks = &config.Socks{Rules: []config.ForwardRule{{Destinations: []string{"127.0.0.1"}, Host: "restricted"}}}
+	address := startTestSocksServer(t, cfg)
+
+	dial := func(auth *proxy.Auth) error {
+		dialer, err := proxy.SOCKS5("tcp", address, auth, proxy.Direct)
+		assert.NoError(t, err)
+		conn, err := dialer.Dial("tcp", strings.TrimPrefix(upstream.URL, "http://"))
+		if err == nil {
+			conn.Close() // nolint
+		}
+		return err
+	}
+	assert.Error(t, dial(nil))
+	assert.Error(t, dial(&proxy.Auth{User: "alice", Password: "wrong-password"}))
+	assert.Error(t, dial(&proxy.Auth{User: "bob", Password: "bob-password"}))
+	assert.NoError(t, dial(&proxy.Auth{User: "alice", Password: "alice-password"}))
+}
+
+func TestSocksUnixSocketAddress(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	defer listener.Close() // nolint
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close() // nolint
+		}
+	}()
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.Auth = nil
+	cfg.Socks = &config.Socks{}
+	address := startTestSocksServer(t, cfg)
+
+	// escaped path of socket is a name of the client, it isn't dialed as unix socket
+	dialer, err := proxy.SOCKS5("tcp", address, nil, proxy.Direct)
+	assert.NoError(t, err)
+	_, err = dialer.Dial("tcp", url.QueryEscape(socket)+":80")
+	assert.Error(t, err)
+}
+
+func TestSocksInvalidPort(t *testing.T) {
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.Auth = nil
+	cfg.Socks = &config.Socks{}
+	address := startTestSocksServer(t, cfg)
+
+	// SOCKS clients don't send port 0, so request is written manually
+	conn, err := net.Dial("tcp", address)
+	assert.NoError(t, err)
+	defer conn.Close() // nolint
+	_, err = conn.Write([]byte{socksVersion, 1, socksMethodNoAuth})
+	assert.NoError(t, err)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(conn, method)
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte{socksVersion, socksCommandConnect, 0, socksAddressIPv4, 127, 0, 0, 1, 0, 0})
+	assert.NoError(t, err)
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(socksReplyAddress), reply[1])
+}
+
+func startTestSocksServer(t *testing.T, cfg *config.Config) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() }) // nolint
+	server := newSocksServer(cfg, newUpstreams(ssh.NewPool(), newPromptStore()))
+	go server.serve(listener) // nolint
+	return listener.Addr().String()
+}
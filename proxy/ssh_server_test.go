@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	testSSHUser     = "ssh-user"
+	testSSHPassword = "ssh-password"
+)
+
+// testSSHServer : ssh server forwarding direct-tcpip, direct-streamlocal channels and tcpip-forward requests to be used as gateway in tests
+type testSSHServer struct {
+	Address string
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+	lock     sync.Mutex
+	conns    []net.Conn
+}
+
+// newTestSSHServer : starts server accepting testSSHUser with testSSHPassword, options could change its config before it's started
+func newTestSSHServer(t *testing.T, options ...func(config *ssh.ServerConfig)) *testSSHServer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == testSSHUser && string(password) == testSSHPassword {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(signer)
+	for _, option := range options {
+		option(config)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testSSHServer{Address: listener.Addr().String(), listener: listener, config: config}
+	go server.serve()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// forwarding : forwarding through the server authenticated with testSSHPassword
+func (server *testSSHServer) forwarding() *config.Forwarding {
+	password := testSSHPassword
+	return &config.Forwarding{User: testSSHUser, Password: &password, Server: server.Address}
+}
+
+func (server *testSSHServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.lock.Lock()
+		server.conns = append(server.conns, conn)
+		server.lock.Unlock()
+		go server.handle(conn)
+	}
+}
+
+func (server *testSSHServer) handle(conn net.Conn) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, server.config)
+	if err != nil {
+		return
+	}
+	var listeners []net.Listener
+	defer func() {
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		for _, listener := range listeners {
+			listener.Close() // nolint
+		}
+	}()
+	go func() {
+		for request := range requests {
+			switch request.Type {
+			case "tcpip-forward":
+				listener, err := forwardPort(sshConn, request.Payload)
+				if err != nil {
+					request.Reply(false, nil) // nolint
+					continue
+				}
+				server.lock.Lock()
+				listeners = append(listeners, listener)
+				server.lock.Unlock()
+				port := uint32(listener.Addr().(*net.TCPAddr).Port)
+				request.Reply(true, ssh.Marshal(struct{ Port uint32 }{port})) // nolint
+			case "cancel-tcpip-forward":
+				var cancel struct {
+					Addr string
+					Port uint32
+				}
+				ssh.Unmarshal(request.Payload, &cancel) // nolint
+				server.lock.Lock()
+				for _, listener := range listeners {
+					if listener.Addr().(*net.TCPAddr).Port == int(cancel.Port) {
+						listener.Close() // nolint
+					}
+				}
+				server.lock.Unlock()
+				request.Reply(true, nil) // nolint
+			default:
+				if request.WantReply {
+					request.Reply(request.Type == "keepalive@openssh.com", nil) // nolint
+				}
+			}
+		}
+	}()
+	for newChannel := range channels {
+		var remote net.Conn
+		switch newChannel.ChannelType() {
+		case "direct-tcpip":
+			var target struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}
+			if err = ssh.Unmarshal(newChannel.ExtraData(), &target); err == nil {
+				remote, err = net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+			}
+		case "direct-streamlocal@openssh.com":
+			var target struct {
+				SocketPath string
+				Reserved0  string
+				Reserved1  uint32
+			}
+			if err = ssh.Unmarshal(newChannel.ExtraData(), &target); err == nil {
+				remote, err = net.Dial("unix", target.SocketPath)
+			}
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type") // nolint
+			continue
+		}
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error()) // nolint
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			remote.Close() // nolint
+			continue
+		}
+		go ssh.DiscardRequests(channelRequests)
+		go pipe(channel, remote)
+	}
+}
+
+// Close : stops accepting connections and breaks opened ones
+func (server *testSSHServer) Close() {
+	server.listener.Close() // nolint
+	server.Disconnect()
+}
+
+// Disconnect : breaks opened connections, new ones are still accepted
+func (server *testSSHServer) Disconnect() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for _, conn := range server.conns {
+		conn.Close() // nolint
+	}
+	server.conns = nil
+}
+
+// forwardPort : listens on requested address and opens forwarded-tcpip channel for each accepted connection
+func forwardPort(sshConn *ssh.ServerConn, payload []byte) (net.Listener, error) {
+	var request struct {
+		Addr string
+		Port uint32
+	}
+	if err := ssh.Unmarshal(payload, &request); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(request.Addr, fmt.Sprint(request.Port)))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			origin := conn.RemoteAddr().(*net.TCPAddr)
+			channel, channelRequests, err := sshConn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+				Addr       string
+				Port       uint32
+				OriginAddr string
+				OriginPort uint32
+			}{request.Addr, uint32(listener.Addr().(*net.TCPAddr).Port), origin.IP.String(), uint32(origin.Port)}))
+			if err != nil {
+				conn.Close() // nolint
+				continue
+			}
+			go ssh.DiscardRequests(channelRequests)
+			go pipe(channel, conn)
+		}
+	}()
+	return listener, nil
+}
+
+func pipe(channel ssh.Channel, remote net.Conn) {
+	go func() {
+		io.Copy(remote, channel) // nolint
+		remote.Close()           // nolint
+	}()
+	io.Copy(channel, remote) // nolint
+	channel.Close()          // nolint
+}
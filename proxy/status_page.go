@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+)
+
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>http-ssh-proxy</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.4em 1em; border-bottom: 1px solid #ddd; }
+.connected { color: #2a7a2a; }
+.disconnected { color: #b22222; }
+.idle { color: #888; }
+ul.gateways, ul.backends { margin: 0; padding-left: 1em; }
+</style>
+</head>
+<body>
+{{if .Prompts}}<p class="disconnected"><a href="prompts">{{len .Prompts}} ssh prompts are waiting for answers</a></p>
+{{end}}<h1>Proxied hosts</h1>
+<table>
+<tr><th>Host</th><th>Address</th><th>Gateway</th><th>SSH connection</th><th>Last response</th></tr>
+{{range .Hosts}}<tr>
+<td><a href="/{{.Name}}/">{{.Name}}</a>{{if .StartPage}} (start page){{end}}</td>
+<td>{{if .Backends}}<ul class="backends">{{range .Backends}}<li>{{.Address}} {{if .Ejected}}<span class="disconnected">ejected until {{.EjectedUntil.Format "15:04:05"}}</span>{{else}}<span class="idle">{{.Active}} active</span>{{end}}</li>{{end}}</ul>{{else}}{{.Address}}{{end}}</td>
+<td>{{if .Gateways}}<ul class="gateways">{{range .Gateways}}<li>{{.Server}} {{if eq .Health "healthy"}}<span class="connected">healthy</span>{{else if eq .Health "unhealthy"}}<span class="disconnected">unhealthy</span>{{else}}<span class="idle">not connected yet</span>{{end}}</li>{{end}}</ul>{{else if .Gateway}}{{.Gateway}}{{else}}direct{{end}}</td>
+<td>{{if not .Gateway}}<span class="idle">not used</span>{{else if .SSH.Connected}}<span class="connected">connected since {{.SSH.ConnectedAt.Format "2006-01-02 15:04:05"}}</span>{{else if .SSH.LastError}}<span class="disconnected">disconnected: {{.SSH.LastError}}</span>{{else}}<span class="idle">not connected yet</span>{{end}}</td>
+<td>{{if .Stats.LastStatus}}{{.Stats.LastStatus}} in {{.Stats.LastLatency}} at {{.Stats.LastRequestAt.Format "15:04:05"}}{{else}}<span class="idle">no requests yet</span>{{end}}</td>
+</tr>
+{{end}}</table>
+{{if .Forwards}}<h1>TCP forwards</h1>
+<table>
+<tr><th>Listen</th><th>Remote</th><th>Host</th><th>Gateway</th><th>Connections</th></tr>
+{{range .Forwards}}<tr>
+<td>{{.Listen}}</td>
+<td>{{.Remote}}</td>
+<td>{{.Host}}</td>
+<td>{{if .Gateway}}{{.Gateway}}{{else}}direct{{end}}</td>
+<td>{{.Active}} active, {{.Total}} total{{if .Failed}}, <span class="disconnected">{{.Failed}} failed</span>{{end}}</td>
+</tr>
+{{end}}</table>
+{{end}}{{if .RemoteForwards}}<h1>Remote forwards</h1>
+<table>
+<tr><th>Listen</th><th>Local</th><th>Host</th><th>Gateway</th><th>State</th><th>Connections</th></tr>
+{{range .RemoteForwards}}<tr>
+<td>{{.Listen}}</td>
+<td>{{.Local}}</td>
+<td>{{.Host}}</td>
+<td>{{.Gateway}}</td>
+<td>{{if .Listening}}<span class="connected">listening since {{.ListenedAt.Format "2006-01-02 15:04:05"}}</span>{{else if .LastError}}<span class="disconnected">{{.LastError}}</span>{{else}}<span class="idle">not listening yet</span>{{end}}</td>
+<td>{{.Active}} active, {{.Total}} total{{if .Failed}}, <span class="disconnected">{{.Failed}} failed</span>{{end}}</td>
+</tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// hostStatus : state of proxied host shown on status page
+type hostStatus struct {
+	Name      string          `json:"name"`
+	Address   string          `json:"address"`
+	Backends  []backendStatus `json:"backends,omitempty"`
+	Gateway   string          `json:"gateway,omitempty"`
+	StartPage bool            `json:"start-page"`
+	SSH       ssh.Status      `json:"ssh"`
+	Gateways  []gatewayStatus `json:"gateways,omitempty"`
+	Stats     upstreamStats   `json:"last-response"`
+}
+
+// health of ssh server, it's unknown until the pool connects to the server or checks it
+const (
+	gatewayHealthy   = "healthy"
+	gatewayUnhealthy = "unhealthy"
+	gatewayUnknown   = "unknown"
+)
+
+// gatewayStatus : state of one of equivalent ssh servers of the host
+type gatewayStatus struct {
+	ssh.Status
+	Health string `json:"health"`
+}
+
+func newGatewayStatus(status ssh.Status, known bool) gatewayStatus {
+	gateway := gatewayStatus{Status: status, Health: gatewayUnknown}
+	if known && (status.Connected || !status.CheckedAt.IsZero() || status.LastError != "") {
+		gateway.Health = gatewayUnhealthy
+		if status.Healthy {
+			gateway.Health = gatewayHealthy
+		}
+	}
+	return gateway
+}
+
+func statusPageHandler(config *config.Config, upstreams *upstreams, pool *ssh.Pool,
+	tcpForwarders []*tcpForwarder, remoteForwarders []*remoteForwarder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != reservedPathPrefix {
+			http.NotFound(w, r)
+			return
+		}
+		id := requestIdentity(r)
+		hosts := []hostStatus{}
+		for hostName, host := range config.AllHosts() {
+			if id != nil && !isUserAllowed(config, hostName, id) {
+				continue
+			}
+			hosts = append(hosts, newHostStatus(hostName, host, config, upstreams, pool))
+		}
+		sortHostStatuses(hosts)
+		forwards := make([]tcpForwardStatus, 0, len(tcpForwarders))
+		for _, forwarder := range tcpForwarders {
+			if id != nil && !isUserAllowed(config, forwarder.forward.Host, id) {
+				continue
+			}
+			forwards = append(forwards, forwarder.status())
+		}
+		remoteForwards := make([]remoteForwardStatus, 0, len(remoteForwarders))
+		for _, forwarder := range remoteForwarders {
+			if id != nil && !isUserAllowed(config, forwarder.forward.Host, id) {
+				continue
+			}
+			remoteForwards = append(remoteForwards, forwarder.status())
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := statusPageTemplate.Execute(w, struct {
+			Hosts          []hostStatus
+			Forwards       []tcpForwardStatus
+			RemoteForwards []remoteForwardStatus
+			Prompts        []*prompt
+		}{hosts, forwards, remoteForwards, visiblePrompts(config, upstreams.prompts, id)})
+		if err != nil {
+			log.Errorf("Can't render status page: %v", err)
+		}
+	}
+}
+
+func newHostStatus(hostName string, host config.Host, config *config.Config, upstreams *upstreams, pool *ssh.Pool) hostStatus {
+	status := hostStatus{
+		Name:      hostName,
+		StartPage: hostName == config.StartPage,
+		Stats:     upstreams.stats(hostName),
+	}
+	if addresses := host.AddressList(); len(addresses) > 0 {
+		status.Address = addresses[0]
+		if len(addresses) > 1 {
+			status.Backends = upstreams.backends(hostName, host).statuses()
+		}
+	}
+	if host.Forwarding != nil {
+		status.Gateway = activeGateway(host.Forwarding, pool)
+		status.SSH, _ = pool.Status(host.Forwarding.User, status.Gateway, host.Forwarding.Identity())
+		if servers := host.Forwarding.ServerList(); len(servers) > 1 {
+			for _, server := range servers {
+				gateway, ok := pool.Status(host.Forwarding.User, server, host.Forwarding.Identity())
+				if !ok {
+					gateway = ssh.Status{Server: server, User: host.Forwarding.User}
+				}
+				status.Gateways = append(status.Gateways, newGatewayStatus(gateway, ok))
+			}
+		}
+	}
+	status.Stats.LastLatency = status.Stats.LastLatency.Round(time.Millisecond)
+	return status
+}
+
+func sortHostStatuses(hosts []hostStatus) {
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Name < hosts[j].Name
+	})
+}
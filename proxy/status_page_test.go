@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestStatusPage(t *testing.T) {
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	upstreams.observe("worker-2", config.Host{}, 15*time.Millisecond, http.StatusOK)
+	handler := routeHandler(cfg, statusPageHandler(cfg, upstreams, upstreams.pool, nil, nil), http.NotFoundHandler())
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/_proxy/", nil)
+	handler.ServeHTTP(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	body := recorder.Body.String()
+	assert.Contains(t, body, `<a href="/master/">master</a> (start page)`)
+	assert.Contains(t, body, "1.1.1.1:8080")
+	assert.Contains(t, body, "3.3.3.3:22")
+	assert.Contains(t, body, "not connected yet")
+	assert.Contains(t, body, "200 in 15ms")
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/_proxy", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusMovedPermanently, recorder.Code)
+	assert.Equal(t, "/_proxy/", recorder.HeaderMap.Get("Location"))
+}
+
+func TestStatusPageAsStartPage(t *testing.T) {
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.StartPage = ""
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	handler := routeHandler(cfg, statusPageHandler(cfg, upstreams, upstreams.pool, nil, nil), http.NotFoundHandler())
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/", nil)
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `<a href="/worker-1/">worker-1</a>`)
+}
+
+func TestStatusPageHidesForbiddenHosts(t *testing.T) {
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	handler := statusPageHandler(cfg, upstreams, upstreams.pool, nil, nil)
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/_proxy/", nil)
+	request = request.WithContext(withIdentity(request, &identity{user: "bob"}))
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `<a href="/worker-2/">worker-2</a>`)
+	assert.NotContains(t, recorder.Body.String(), `<a href="/worker-1/">worker-1</a>`)
+}
+
+func TestStatusPageHidesForbiddenForwards(t *testing.T) {
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.TCPForwards = []config.TCPForward{
+		{Listen: "localhost:15432", Remote: "10.1.1.5:5432", Host: "worker-1"},
+		{Listen: "localhost:15433", Remote: "10.1.1.6:5432", Host: "worker-2"},
+	}
+	cfg.RemoteForwards = []config.RemoteForward{
+		{Listen: "localhost:18080", Local: "localhost:8080", Host: "worker-1"},
+		{Listen: "localhost:18081", Local: "localhost:8081", Host: "worker-2"},
+	}
+	pool := ssh.NewPool()
+	upstreams := newUpstreams(pool, newPromptStore())
+	handler := statusPageHandler(cfg, upstreams, pool, newTCPForwarders(cfg, upstreams), newRemoteForwarders(cfg, pool, newPromptStore()))
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/_proxy/", nil)
+	request = request.WithContext(withIdentity(request, &identity{user: "bob"}))
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "localhost:15433")
+	assert.NotContains(t, recorder.Body.String(), "localhost:15432")
+	assert.Contains(t, recorder.Body.String(), "localhost:18081")
+	assert.NotContains(t, recorder.Body.String(), "localhost:18080")
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+)
+
+// tcpForwarder : relays connections of tcp forward listener to its remote, ssh connections are shared with proxied hosts
+type tcpForwarder struct {
+	config    *config.Config
+	forward   config.TCPForward
+	upstreams *upstreams
+
+	active int64
+	total  int64
+	failed int64
+}
+
+// tcpForwardStatus : connection counts of tcp forward shown on status page
+type tcpForwardStatus struct {
+	Listen  string
+	Remote  string
+	Host    string
+	Gateway string
+	Active  int64
+	Total   int64
+	Failed  int64
+}
+
+func newTCPForwarders(cfg *config.Config, upstreams *upstreams) []*tcpForwarder {
+	forwarders := make([]*tcpForwarder, 0, len(cfg.TCPForwards))
+	for _, forward := range cfg.TCPForwards {
+		forwarders = append(forwarders, &tcpForwarder{config: cfg, forward: forward, upstreams: upstreams})
+	}
+	return forwarders
+}
+
+// serve : accepts connections until listener is closed
+func (forwarder *tcpForwarder) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go forwarder.handle(conn)
+	}
+}
+
+func (forwarder *tcpForwarder) handle(conn net.Conn) {
+	defer conn.Close() // nolint
+	atomic.AddInt64(&forwarder.total, 1)
+	remote, err := forwarder.dial()
+	if err != nil {
+		atomic.AddInt64(&forwarder.failed, 1)
+		log.Errorf("TCP forward from %s to %s has been failed. Error: %v", forwarder.forward.Listen, forwarder.forward.Remote, err)
+		return
+	}
+	defer remote.Close() // nolint
+	atomic.AddInt64(&forwarder.active, 1)
+	defer atomic.AddInt64(&forwarder.active, -1)
+	relay(conn, conn, remote)
+}
+
+// dial : opens connection to remote through forwarding of the host, the host is looked up each time as it could be changed at runtime
+func (forwarder *tcpForwarder) dial() (net.Conn, error) {
+	host, ok := forwarder.config.Host(forwarder.forward.Host)
+	if !ok {
+		return nil, unknownHostError(forwarder.forward.Host)
+	}
+	dial, err := forwarder.upstreams.dialer(forwarder.forward.Host, host)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), durationOrDefault(host.ConnectTimeout, defaultConnectTimeout))
+	defer cancel()
+	network, remote := forwarder.forward.RemoteNetwork()
+	return dial(ctx, network, remote)
+}
+
+func (forwarder *tcpForwarder) status() tcpForwardStatus {
+	status := tcpForwardStatus{
+		Listen: forwarder.forward.Listen,
+		Remote: forwarder.forward.Remote,
+		Host:   forwarder.forward.Host,
+		Active: atomic.LoadInt64(&forwarder.active),
+		Total:  atomic.LoadInt64(&forwarder.total),
+		Failed: atomic.LoadInt64(&forwarder.failed),
+	}
+	if host, ok := forwarder.config.Host(forwarder.forward.Host); ok && host.Forwarding != nil {
+		status.Gateway = activeGateway(host.Forwarding, forwarder.upstreams.pool)
+	}
+	return status
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestTCPForward(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream")) // nolint
+	}))
+	defer upstream.Close()
+	gateway := newTestSSHServer(t)
+
+	cfg, _ := config.FromFile("../config/testdata/config.yml")
+	cfg.SetHost("gateway", config.Host{Forwarding: gateway.forwarding()})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close() // nolint
+	forward := config.TCPForward{Listen: listener.Addr().String(), Remote: strings.TrimPrefix(upstream.URL, "http://"), Host: "gateway"}
+	cfg.TCPForwards = []config.TCPForward{forward}
+	upstreams := newUpstreams(ssh.NewPool(), newPromptStore())
+	forwarders := newTCPForwarders(cfg, upstreams)
+	go forwarders[0].serve(listener) // nolint
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	response, err := client.Get("http://" + forward.Listen)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close() // nolint
+	assert.Equal(t, "upstream", string(body))
+
+	status := forwarders[0].status()
+	assert.Equal(t, int64(1), status.Total)
+	assert.Equal(t, int64(0), status.Failed)
+	assert.Equal(t, gateway.Address, status.Gateway)
+
+	recorder := httptest.NewRecorder()
+	statusPageHandler(cfg, upstreams, upstreams.pool, forwarders, nil).ServeHTTP(recorder, httptest.NewRequest("GET", "/_proxy/", nil))
+	assert.Contains(t, recorder.Body.String(), "<td>"+forward.Remote+"</td>")
+
+	// remote is dialed only through gateway
+	gateway.Close()
+	_, err = client.Get("http://" + forward.Listen)
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), forwarders[0].status().Failed)
+}
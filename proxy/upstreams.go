@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"net/http/httputil"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/config"
+	"github.com/nawa/http-ssh-proxy/ssh"
+)
+
+// patternUpstreamsLimit : upstreams of hosts matched by host patterns which are kept, the least recently used one is forgotten above it
+const patternUpstreamsLimit = 256
+
+// upstreams : reverse proxies to configured hosts shared between requests together with their statistics
+type upstreams struct {
+	pool *ssh.Pool
+	// prompts : questions of ssh servers waiting for answers from browser, they are shared by all tunnels
+	prompts *promptStore
+
+	lock  sync.Mutex
+	items map[string]*upstream
+	// patternNames : names of hosts matched by host patterns from the most recently used one
+	patternNames *list.List
+
+	replacerLock sync.Mutex
+	// replacer : link replacer of addresses and aliases of hosts, it's created again only when they change
+	replacer *LinkReplacer
+}
+
+// upstream : reverse proxy to the host and results of the last request to it
+type upstream struct {
+	reverseProxy *httputil.ReverseProxy
+	backends     *backends
+	stats        upstreamStats
+
+	// aliases : other forms of host addresses which links of backends could use
+	aliases   []string
+	aliasesAt time.Time
+	resolving bool
+
+	// patternName : element of patternNames if the host is matched by host pattern
+	patternName *list.Element
+
+	// tunnel : ssh tunnel of forwarding shared by connections dialed through the host, it's created again for changed forwarding
+	tunnel           *ssh.Tunnel
+	tunnelForwarding *config.Forwarding
+}
+
+// upstreamStats : results of the last request to the host
+type upstreamStats struct {
+	LastRequestAt time.Time     `json:"time"`
+	LastLatency   time.Duration `json:"latency"`
+	LastStatus    int           `json:"status"`
+}
+
+func newUpstreams(pool *ssh.Pool, prompts *promptStore) *upstreams {
+	return &upstreams{
+		pool:         pool,
+		prompts:      prompts,
+		items:        make(map[string]*upstream),
+		patternNames: list.New(),
+	}
+}
+
+// item : returns state of the host creating it on first use, lock must be held.
+// Any name could match host pattern so only the most recently used of such hosts are kept
+func (upstreams *upstreams) item(hostName string, host config.Host) *upstream {
+	item, ok := upstreams.items[hostName]
+	if !ok {
+		item = &upstream{}
+		upstreams.items[hostName] = item
+		if host.Pattern() != "" {
+			item.patternName = upstreams.patternNames.PushFront(hostName)
+			if upstreams.patternNames.Len() > patternUpstreamsLimit {
+				oldest := upstreams.patternNames.Remove(upstreams.patternNames.Back()).(string)
+				delete(upstreams.items, oldest)
+			}
+		}
+	} else if item.patternName != nil {
+		upstreams.patternNames.MoveToFront(item.patternName)
+	}
+	return item
+}
+
+// reverseProxy : returns reverse proxy for the host creating it on first use, failed creation is retried by next request
+func (upstreams *upstreams) reverseProxy(ctx context.Context, hostName string, host config.Host) (*httputil.ReverseProxy, error) {
+	upstreams.lock.Lock()
+	if item, ok := upstreams.items[hostName]; ok && item.reverseProxy != nil {
+		reverseProxy := item.reverseProxy
+		upstreams.lock.Unlock()
+		return reverseProxy, nil
+	}
+	upstreams.lock.Unlock()
+
+	reverseProxy, err := createReverseProxy(ctx, host, upstreams.pool, upstreams.prompts)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams.lock.Lock()
+	defer upstreams.lock.Unlock()
+	item := upstreams.item(hostName, host)
+	if item.reverseProxy == nil {
+		item.reverseProxy = reverseProxy
+	}
+	return item.reverseProxy, nil
+}
+
+// dialer : opens connections the same way as requests to the host are sent, through its forwarding if it's configured.
+// Tunnel of forwarding is created on first use and kept until config of the host is changed
+func (upstreams *upstreams) dialer(hostName string, host config.Host) (dialFunc, error) {
+	if host.Forwarding == nil {
+		return directDialer(host), nil
+	}
+	upstreams.lock.Lock()
+	item, ok := upstreams.items[hostName]
+	if ok && item.tunnel != nil && item.tunnelForwarding == host.Forwarding {
+		tunnel := item.tunnel
+		upstreams.lock.Unlock()
+		return tunnel.DialContext, nil
+	}
+	upstreams.lock.Unlock()
+
+	tunnel, err := createTunnel(host, upstreams.pool, upstreams.prompts)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams.lock.Lock()
+	defer upstreams.lock.Unlock()
+	item = upstreams.item(hostName, host)
+	if item.tunnel == nil || item.tunnelForwarding != host.Forwarding {
+		item.tunnel, item.tunnelForwarding = tunnel, host.Forwarding
+	}
+	return item.tunnel.DialContext, nil
+}
+
+// backends : returns addresses of the host with their state creating them on first use
+func (upstreams *upstreams) backends(hostName string, host config.Host) *backends {
+	upstreams.lock.Lock()
+	defer upstreams.lock.Unlock()
+	item := upstreams.item(hostName, host)
+	if item.backends == nil {
+		item.backends = newBackends(host)
+	}
+	return item.backends
+}
+
+// refreshAliases : starts resolving IPs of named addresses of the proxied host and names of its IP addresses
+// in background on first use and after they become outdated
+func (upstreams *upstreams) refreshAliases(hostName string, host config.Host) {
+	upstreams.lock.Lock()
+	defer upstreams.lock.Unlock()
+	item := upstreams.item(hostName, host)
+	if !item.resolving && time.Since(item.aliasesAt) > aliasesTTL {
+		item.resolving = true
+		go upstreams.resolveAliases(hostName, item, host)
+	}
+}
+
+// aliases : returns aliases of the host known so far, they are resolved only for hosts which were proxied
+func (upstreams *upstreams) aliases(hostName string) []string {
+	upstreams.lock.Lock()
+	defer upstreams.lock.Unlock()
+	if item, ok := upstreams.items[hostName]; ok {
+		return item.aliases
+	}
+	return nil
+}
+
+// linkReplacer : returns replacer of links to addresses and aliases of all hosts,
+// if the same address belongs to several hosts the first one in alphabetical order is used
+func (upstreams *upstreams) linkReplacer(cfg *config.Config) *LinkReplacer {
+	hostNames := make(map[string]string)
+	hosts := cfg.AllHosts()
+	for _, name := range cfg.HostNames() {
+		for _, address := range append(hosts[name].AddressList(), upstreams.aliases(name)...) {
+			if _, ok := hostNames[address]; !ok {
+				hostNames[address] = name
+			}
+		}
+	}
+	upstreams.replacerLock.Lock()
+	defer upstreams.replacerLock.Unlock()
+	if upstreams.replacer == nil || !reflect.DeepEqual(upstreams.replacer.hostNames, hostNames) {
+		upstreams.replacer = NewLinkReplacer(hostNames)
+	}
+	return upstreams.replacer
+}
+
+func (upstreams *upstreams) resolveAliases(hostName string, item *upstream, host config.Host) {
+	var aliases []string
+	resolver, err := hostResolver(host, upstreams.pool, upstreams.prompts)
+	if err != nil {
+		log.Debugf("Aliases of %s can't be resolved: %v", hostName, err)
+	} else if resolver != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), aliasesTimeout)
+		defer cancel()
+		aliases = resolveAliases(ctx, resolver, host.AddressList())
+	}
+	upstreams.lock.Lock()
+	defer upstreams.lock.Unlock()
+	item.aliases = aliases
+	item.aliasesAt = time.Now()
+	item.resolving = false
+}
+
+// remove : forgets reverse proxy, tunnel and statistics of the host after its config was changed
+func (upstreams *upstreams) remove(hostName string) {
+	upstreams.lock.Lock()
+	defer upstreams.lock.Unlock()
+	if item, ok := upstreams.items[hostName]; ok && item.patternName != nil {
+		upstreams.patternNames.Remove(item.patternName)
+	}
+	delete(upstreams.items, hostName)
+}
+
+// observe : records result of request to the host
+func (upstreams *upstreams) observe(hostName string, host config.Host, latency time.Duration, status int) {
+	upstreams.lock.Lock()
+	defer upstreams.lock.Unlock()
+	item := upstreams.item(hostName, host)
+	item.stats = upstreamStats{
+		LastRequestAt: time.Now(),
+		LastLatency:   latency,
+		LastStatus:    status,
+	}
+}
+
+// stats : returns results of the last request to the host
+func (upstreams *upstreams) stats(hostName string) upstreamStats {
+	upstreams.lock.Lock()
+	defer upstreams.lock.Unlock()
+	if item, ok := upstreams.items[hostName]; ok {
+		return item.stats
+	}
+	return upstreamStats{}
+}
@@ -0,0 +1,150 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AuthMethod : authentication method of tunnel, methods offering keys are merged into one publickey method
+// because ssh client doesn't try publickey again after server rejects it
+type AuthMethod struct {
+	name    string
+	signers func() ([]ssh.Signer, error)
+	method  ssh.AuthMethod
+}
+
+// AgentAuth : keys of ssh-agent listening on socket, SSH_AUTH_SOCK is used if socket is empty
+func AgentAuth(socket string) AuthMethod {
+	keys := &agentKeys{socket: socket}
+	return AuthMethod{name: "agent", signers: keys.signers}
+}
+
+// PrivateKeyAuth : private key read once
+func PrivateKeyAuth(key string) (AuthMethod, error) {
+	signer, err := publicKeySigner(key, "")
+	if err != nil {
+		return AuthMethod{}, fmt.Errorf("Can't import private key: %v", err)
+	}
+	return AuthMethod{name: "private key " + key, signers: func() ([]ssh.Signer, error) {
+		return []ssh.Signer{signer}, nil
+	}}, nil
+}
+
+// CertificateAuth : private key signed with certificate of trusted CA, files are read again on each connection
+// as short-lived certificates are renewed
+func CertificateAuth(key, certificate string) (AuthMethod, error) {
+	if _, err := publicKeySigner(key, certificate); err != nil {
+		return AuthMethod{}, fmt.Errorf("Can't import private key and certificate: %v", err)
+	}
+	return AuthMethod{name: "certificate " + certificate, signers: func() ([]ssh.Signer, error) {
+		signer, err := publicKeySigner(key, certificate)
+		if err != nil {
+			return nil, err
+		}
+		logCertificateValidity(certificate, signer.PublicKey().(*ssh.Certificate))
+		return []ssh.Signer{signer}, nil
+	}}, nil
+}
+
+// PasswordAuth : user password
+func PasswordAuth(password string) AuthMethod {
+	return AuthMethod{method: ssh.Password(password)}
+}
+
+// KeyboardInteractiveAuth : answers to questions of ssh server
+func KeyboardInteractiveAuth(challenge KeyboardInteractiveChallenge) AuthMethod {
+	return AuthMethod{method: ssh.KeyboardInteractive(ssh.KeyboardInteractiveChallenge(challenge))}
+}
+
+// NewTunnelByAuthMethods : tunnel constructor offering methods to ssh server in the given order like OpenSSH does,
+// keys of agent, certificate and private key are offered together in their order at place of the first of them
+func NewTunnelByAuthMethods(server, remote, user string, methods ...AuthMethod) *Tunnel {
+	return &Tunnel{
+		Server: server,
+		Remote: remote,
+		SSHClientConfig: &ssh.ClientConfig{
+			User:            user,
+			Auth:            clientAuthMethods(methods),
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		},
+	}
+}
+
+func clientAuthMethods(methods []AuthMethod) []ssh.AuthMethod {
+	var keys []AuthMethod
+	var auth []ssh.AuthMethod
+	for _, method := range methods {
+		if method.signers == nil {
+			auth = append(auth, method.method)
+			continue
+		}
+		if keys == nil {
+			auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				return publicKeySigners(keys)
+			}))
+		}
+		keys = append(keys, method)
+	}
+	return auth
+}
+
+// publicKeySigners : keys of all methods, failed method is skipped so others are still offered
+func publicKeySigners(methods []AuthMethod) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	var lastErr error
+	for _, method := range methods {
+		methodSigners, err := method.signers()
+		if err != nil {
+			log.Warnf("Keys of %s can't be offered to ssh server: %v", method.name, err)
+			lastErr = err
+			continue
+		}
+		signers = append(signers, methodSigners...)
+	}
+	if len(signers) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return signers, nil
+}
+
+// agentKeys : connection to ssh-agent is kept open as keys are signed by agent, it's opened again after failure
+type agentKeys struct {
+	socket string
+
+	lock   sync.Mutex
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+func (keys *agentKeys) signers() ([]ssh.Signer, error) {
+	keys.lock.Lock()
+	defer keys.lock.Unlock()
+	if keys.client == nil {
+		socket := keys.socket
+		if socket == "" {
+			socket = os.Getenv("SSH_AUTH_SOCK")
+		}
+		if socket == "" {
+			return nil, fmt.Errorf("SSH_AUTH_SOCK isn't set")
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		keys.conn = conn
+		keys.client = agent.NewClient(conn)
+	}
+	signers, err := keys.client.Signers()
+	if err != nil {
+		keys.conn.Close() // nolint
+		keys.conn, keys.client = nil, nil
+		return nil, err
+	}
+	return signers, nil
+}
@@ -0,0 +1,78 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	// StageDial : TCP connection to ssh server
+	StageDial = "dial"
+	// StageHandshake : ssh key exchange and verification of server host key
+	StageHandshake = "handshake"
+	// StageAuth : user authentication after server host key was accepted
+	StageAuth = "auth"
+)
+
+// ConnectError : failure to establish ssh connection to server
+type ConnectError struct {
+	Server string
+	Stage  string
+	Err    error
+}
+
+func (err *ConnectError) Error() string {
+	return fmt.Sprintf("Server %s error: %v", err.Stage, err.Err)
+}
+
+func (err *ConnectError) Unwrap() error {
+	return err.Err
+}
+
+// AuthFailed : reports that server rejected configured authentication methods or closed connection during authentication
+func (err *ConnectError) AuthFailed() bool {
+	return err.Stage == StageAuth
+}
+
+// AddressError : remote address which can't be dialed, it's rejected before channel is requested
+// so shared ssh connection isn't affected
+type AddressError struct {
+	Address string
+	Err     error
+}
+
+func (err *AddressError) Error() string {
+	return fmt.Sprintf("Invalid remote address %s: %v", err.Address, err.Err)
+}
+
+func (err *AddressError) Unwrap() error {
+	return err.Err
+}
+
+// ValidateAddress : checks that addr is host:port with port 1-65535 or path of unix socket for unix network
+func ValidateAddress(network, addr string) error {
+	if network == "unix" {
+		if addr == "" {
+			return &AddressError{Address: addr, Err: fmt.Errorf("Socket path is empty")}
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &AddressError{Address: addr, Err: err}
+	}
+	if _, err = ParsePort(port); err != nil {
+		return &AddressError{Address: addr, Err: err}
+	}
+	return nil
+}
+
+// ParsePort : parses TCP port 1-65535
+func ParsePort(port string) (uint16, error) {
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || number == 0 {
+		return 0, fmt.Errorf("Port '%s' isn't in range 1-65535", port)
+	}
+	return uint16(number), nil
+}
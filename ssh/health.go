@@ -0,0 +1,189 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Active : returns state of the server which is used for new channels among equivalent servers,
+// it's the first healthy one or the first one if all of them failed. False is returned if the pool never used them
+func (pool *Pool) Active(user, identity string, servers []string) (Status, bool) {
+	var fallback *Status
+	for _, server := range servers {
+		status, ok := pool.Status(user, server, identity)
+		if !ok {
+			continue
+		}
+		if status.Healthy {
+			return status, true
+		}
+		if fallback == nil {
+			fallback = &status
+		}
+	}
+	if fallback == nil {
+		return Status{}, false
+	}
+	return *fallback, true
+}
+
+// StartHealthChecks : checks all pooled connections with interval until returned function is called.
+// Connections are checked independently, so slow server doesn't delay checks of others
+func (pool *Pool) StartHealthChecks(interval, timeout time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pool.startHealthChecks(timeout)
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// CheckHealth : sends keepalive request through opened connections and reconnects broken ones,
+// it waits for checks which it started, connections still checked by previous round are skipped
+func (pool *Pool) CheckHealth(timeout time.Duration) {
+	pool.startHealthChecks(timeout).Wait()
+}
+
+func (pool *Pool) startHealthChecks(timeout time.Duration) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for _, client := range pool.Clients() {
+		if !client.startCheck() {
+			continue
+		}
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+			client.checkHealth(timeout)
+		}(client)
+	}
+	return &wg
+}
+
+// startCheck : marks that check of the client is in progress, false is returned if it's already checked
+func (client *Client) startCheck() bool {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.checking {
+		return false
+	}
+	client.checking = true
+	return true
+}
+
+func (client *Client) checkHealth(timeout time.Duration) {
+	sshClient := client.current()
+	var err error
+	if sshClient == nil && client.interactive {
+		// login isn't started in background as it would prompt user or use one-time code, next request reconnects
+		client.lock.Lock()
+		defer client.lock.Unlock()
+		client.checking = false
+		client.checkedAt = time.Now()
+		client.unhealthy = true
+		return
+	}
+	if sshClient == nil {
+		_, err = client.Connect()
+	} else if err = keepalive(sshClient, timeout); err != nil {
+		client.drop(sshClient, err)
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.checking = false
+	client.checkedAt = time.Now()
+	if err != nil {
+		client.unhealthy = true
+		client.lastError = err
+		log.Warnf("Health check of %s@%s has been failed: %v", client.User, client.Server, err)
+	} else {
+		client.unhealthy = false
+	}
+}
+
+func keepalive(sshClient *ssh.Client, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("Keepalive request has been expired")
+	}
+}
+
+// failoverDialer : opens channels through the first healthy server of equivalent ones
+// and fails over to the next servers if it's unreachable
+type failoverDialer struct {
+	clients []*Client
+}
+
+func (dialer failoverDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var lastErr error
+	for _, client := range dialer.ordered() {
+		conn, err := client.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		var addressError *AddressError
+		if _, ok := err.(*ssh.OpenChannelError); ok || errors.As(err, &addressError) || ctx.Err() != nil {
+			// server is alive but remote isn't available through it, remote is invalid or request is over
+			return nil, err
+		}
+		log.Warnf("Can't open channel through %s@%s, trying next server: %v", client.User, client.Server, err)
+	}
+	return nil, lastErr
+}
+
+// ordered : returns healthy clients first keeping configured order
+func (dialer failoverDialer) ordered() []*Client {
+	healthy := make([]*Client, 0, len(dialer.clients))
+	var unhealthy []*Client
+	for _, client := range dialer.clients {
+		if client.Status().Healthy {
+			healthy = append(healthy, client)
+		} else {
+			unhealthy = append(unhealthy, client)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// connect : establishes connection through the first available server
+func (dialer failoverDialer) connect() error {
+	var lastErr error
+	for _, client := range dialer.ordered() {
+		if _, lastErr = client.Connect(); lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
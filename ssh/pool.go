@@ -0,0 +1,379 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/metrics"
+	"golang.org/x/crypto/ssh"
+)
+
+// dialKeepaliveTimeout : how long ssh connection is checked after failed dial before it's considered broken
+const dialKeepaliveTimeout = 5 * time.Second
+
+// Pool : keeps ssh connections opened and shares them between tunnels to the same server
+type Pool struct {
+	lock    sync.Mutex
+	clients map[string]*Client
+}
+
+// Client : pooled ssh connection which is reestablished on demand after failures
+type Client struct {
+	// counters are accessed atomically and kept first for 64-bit alignment
+	openChannels  int64
+	bytesSent     int64
+	bytesReceived int64
+
+	Server string
+	User   string
+
+	config           *ssh.ClientConfig
+	interactive      bool
+	connectTimeout   time.Duration
+	handshakeTimeout time.Duration
+	dialLock         sync.Mutex
+	lock             sync.Mutex
+	client           *ssh.Client
+	connectedAt      time.Time
+	lastError        error
+	// unhealthy : the last connection attempt or health check failed
+	unhealthy bool
+	checkedAt time.Time
+	// checking : health check is in progress, the next one isn't started until it's done
+	checking bool
+}
+
+// Status : state of pooled ssh connection
+type Status struct {
+	Server        string    `json:"server"`
+	User          string    `json:"user"`
+	Connected     bool      `json:"connected"`
+	Healthy       bool      `json:"healthy"`
+	CheckedAt     time.Time `json:"checked-at,omitempty"`
+	ConnectedAt   time.Time `json:"connected-at,omitempty"`
+	LastError     string    `json:"last-error,omitempty"`
+	OpenChannels  int64     `json:"open-channels"`
+	BytesSent     int64     `json:"bytes-sent"`
+	BytesReceived int64     `json:"bytes-received"`
+}
+
+// NewPool : pool constructor
+func NewPool() *Pool {
+	return &Pool{clients: make(map[string]*Client)}
+}
+
+// Client : returns pooled connection for tunnel, tunnels with the same server, user and identity should have the same timeouts
+func (pool *Pool) Client(tunnel *Tunnel) *Client {
+	return pool.client(tunnel, tunnel.Server)
+}
+
+// poolKey : connections aren't shared by tunnels with different authentication or host key verification
+func poolKey(user, server, identity string) string {
+	return user + "@" + server + "#" + identity
+}
+
+func (pool *Pool) client(tunnel *Tunnel, server string) *Client {
+	key := poolKey(tunnel.SSHClientConfig.User, server, tunnel.Identity)
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	client, ok := pool.clients[key]
+	if !ok {
+		client = &Client{
+			Server:           server,
+			User:             tunnel.SSHClientConfig.User,
+			config:           tunnel.SSHClientConfig,
+			interactive:      tunnel.Interactive,
+			connectTimeout:   tunnel.ConnectTimeout,
+			handshakeTimeout: tunnel.HandshakeTimeout,
+		}
+		pool.clients[key] = client
+	}
+	return client
+}
+
+// Clients : returns all pooled connections
+func (pool *Pool) Clients() []*Client {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	clients := make([]*Client, 0, len(pool.clients))
+	for _, client := range pool.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Remove : closes connection to server and forgets it, so it isn't checked and reconnected anymore
+func (pool *Pool) Remove(user, server, identity string) {
+	key := poolKey(user, server, identity)
+	pool.lock.Lock()
+	client, ok := pool.clients[key]
+	delete(pool.clients, key)
+	pool.lock.Unlock()
+	if ok {
+		log.Infof("SSH connection to %s@%s isn't used anymore", user, server)
+		client.Close()
+	}
+}
+
+// Status : returns state of connection to server or false if the pool never connected to it
+func (pool *Pool) Status(user, server, identity string) (Status, bool) {
+	pool.lock.Lock()
+	client, ok := pool.clients[poolKey(user, server, identity)]
+	pool.lock.Unlock()
+	if !ok {
+		return Status{}, false
+	}
+	return client.Status(), true
+}
+
+// Statuses : returns state of all pooled connections sorted by server
+func (pool *Pool) Statuses() []Status {
+	pool.lock.Lock()
+	statuses := make([]Status, 0, len(pool.clients))
+	for _, client := range pool.clients {
+		statuses = append(statuses, client.Status())
+	}
+	pool.lock.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Server == statuses[j].Server {
+			return statuses[i].User < statuses[j].User
+		}
+		return statuses[i].Server < statuses[j].Server
+	})
+	return statuses
+}
+
+// Status : returns state of connection
+func (client *Client) Status() Status {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	status := Status{
+		Server:        client.Server,
+		User:          client.User,
+		Connected:     client.client != nil,
+		Healthy:       !client.unhealthy,
+		CheckedAt:     client.checkedAt,
+		OpenChannels:  atomic.LoadInt64(&client.openChannels),
+		BytesSent:     atomic.LoadInt64(&client.bytesSent),
+		BytesReceived: atomic.LoadInt64(&client.bytesReceived),
+	}
+	if client.client != nil {
+		status.ConnectedAt = client.connectedAt
+	}
+	if client.lastError != nil {
+		status.LastError = client.lastError.Error()
+	}
+	return status
+}
+
+// Connect : returns opened ssh connection establishing it if it's needed
+func (client *Client) Connect() (*ssh.Client, error) {
+	client.dialLock.Lock()
+	defer client.dialLock.Unlock()
+	if sshClient := client.current(); sshClient != nil {
+		return sshClient, nil
+	}
+	sshClient, err := connect(client.Server, client.config, client.connectTimeout, client.handshakeTimeout)
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if err != nil {
+		client.lastError = err
+		client.unhealthy = true
+		return nil, err
+	}
+	log.Infof("SSH connection to %s@%s has been established", client.User, client.Server)
+	client.client = sshClient
+	client.connectedAt = time.Now()
+	client.lastError = nil
+	client.unhealthy = false
+	go client.watch(sshClient)
+	return sshClient, nil
+}
+
+// connect : establishes ssh connection to server, zero timeouts mean waiting forever
+func connect(server string, config *ssh.ClientConfig, connectTimeout, handshakeTimeout time.Duration) (*ssh.Client, error) {
+	startedAt := time.Now()
+	conn, err := net.DialTimeout("tcp", server, connectTimeout)
+	if err != nil {
+		metrics.SSHConnectFailures.WithLabelValues(server, StageDial).Inc()
+		return nil, &ConnectError{Server: server, Stage: StageDial, Err: err}
+	}
+	metrics.SSHDialDuration.WithLabelValues(server).Observe(time.Since(startedAt).Seconds())
+
+	startedAt = time.Now()
+	if handshakeTimeout > 0 {
+		conn.SetDeadline(startedAt.Add(handshakeTimeout)) // nolint
+	}
+	// authentication starts after host key is accepted, so failure after that is authentication failure
+	var hostKeyAccepted atomic.Bool
+	handshakeConfig := *config
+	handshakeConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := config.HostKeyCallback(hostname, remote, key); err != nil {
+			return err
+		}
+		hostKeyAccepted.Store(true)
+		return nil
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, server, &handshakeConfig)
+	if err != nil {
+		conn.Close() // nolint
+		stage := StageHandshake
+		if hostKeyAccepted.Load() {
+			stage = StageAuth
+		}
+		metrics.SSHConnectFailures.WithLabelValues(server, stage).Inc()
+		return nil, &ConnectError{Server: server, Stage: stage, Err: err}
+	}
+	conn.SetDeadline(time.Time{}) // nolint
+	metrics.SSHHandshakeDuration.WithLabelValues(server).Observe(time.Since(startedAt).Seconds())
+	return ssh.NewClient(sshConn, channels, requests), nil
+}
+
+func (client *Client) current() *ssh.Client {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.client
+}
+
+// Dial : opens connection to addr from ssh server, broken ssh connection is reestablished once.
+// Connection is shared by channels of other requests so it's dropped only if it doesn't answer keepalive request
+func (client *Client) Dial(network, addr string) (net.Conn, error) {
+	if err := ValidateAddress(network, addr); err != nil {
+		return nil, err
+	}
+	sshClient, err := client.Connect()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sshClient.Dial(network, addr)
+	if err != nil {
+		if _, ok := err.(*ssh.OpenChannelError); ok {
+			// server is alive but refused to open the channel
+			return nil, err
+		}
+		if keepalive(sshClient, dialKeepaliveTimeout) == nil {
+			// channel failed for other reason than broken connection
+			return nil, err
+		}
+		client.drop(sshClient, err)
+		if sshClient, err = client.Connect(); err != nil {
+			return nil, err
+		}
+		if conn, err = sshClient.Dial(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	atomic.AddInt64(&client.openChannels, 1)
+	metrics.SSHOpenChannels.WithLabelValues(client.Server, client.User).Inc()
+	return &countingConn{Conn: conn, client: client}, nil
+}
+
+// DialContext : opens connection to addr from ssh server giving up when ctx is done
+func (client *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialContext(ctx, client.Dial, network, addr)
+}
+
+// dialContext : makes blocking dial cancelable, connection opened after cancellation is closed
+func dialContext(ctx context.Context, dial func(network, addr string) (net.Conn, error), network, addr string) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, 1)
+	go func() {
+		conn, err := dial(network, addr)
+		results <- dialResult{conn: conn, err: err}
+	}()
+	select {
+	case result := <-results:
+		return result.conn, result.err
+	case <-ctx.Done():
+		go func() {
+			if result := <-results; result.conn != nil {
+				result.conn.Close() // nolint
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Listen : asks ssh server to listen on addr and to forward accepted connections back,
+// listener is closed together with ssh connection so it should be opened again after reconnect
+func (client *Client) Listen(network, addr string) (net.Listener, error) {
+	sshClient, err := client.Connect()
+	if err != nil {
+		return nil, err
+	}
+	return sshClient.Listen(network, addr)
+}
+
+// Reconnect : closes ssh connection and establishes it again
+func (client *Client) Reconnect() error {
+	client.Close()
+	_, err := client.Connect()
+	return err
+}
+
+// Close : closes ssh connection, it will be reestablished on next dial
+func (client *Client) Close() {
+	if sshClient := client.current(); sshClient != nil {
+		client.drop(sshClient, nil)
+	}
+}
+
+func (client *Client) watch(sshClient *ssh.Client) {
+	err := sshClient.Wait()
+	if err == nil {
+		err = fmt.Errorf("Connection closed")
+	}
+	client.drop(sshClient, err)
+}
+
+func (client *Client) drop(sshClient *ssh.Client, err error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.client != sshClient {
+		return
+	}
+	client.client = nil
+	if err != nil {
+		client.lastError = err
+		client.unhealthy = true
+		log.Warnf("SSH connection to %s@%s has been lost: %v", client.User, client.Server, err)
+	}
+	sshClient.Close() // nolint
+}
+
+// countingConn : channel opened through pooled connection which counts transferred bytes
+type countingConn struct {
+	net.Conn
+	client    *Client
+	closeOnce sync.Once
+}
+
+func (conn *countingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(&conn.client.bytesReceived, int64(n))
+	return n, err
+}
+
+func (conn *countingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddInt64(&conn.client.bytesSent, int64(n))
+	return n, err
+}
+
+func (conn *countingConn) Close() error {
+	conn.closeOnce.Do(func() {
+		atomic.AddInt64(&conn.client.openChannels, -1)
+		metrics.SSHOpenChannels.WithLabelValues(conn.client.Server, conn.client.User).Dec()
+	})
+	return conn.Conn.Close()
+}
@@ -8,80 +8,303 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/nawa/http-ssh-proxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
+var tracer = tracing.Tracer("ssh")
+
+// resolvedTTL : how long IPs looked up with Nameserver are reused, TTL of records isn't exposed by resolver
+const resolvedTTL = time.Minute
+
 // Tunnel : ssh tunnel
 type Tunnel struct {
 	Server string
 	Remote string
+	// Servers : optional equivalent ssh servers, channels are opened through the first healthy one if Pool is set
+	Servers []string
+	// Remotes : optional addresses which requests of reverse proxy are balanced between, only Remote is used if it's empty
+	Remotes []string
 
 	SSHClientConfig *ssh.ClientConfig
+	// Pool : optional pool to share ssh connection with other tunnels, connection is opened per reverse proxy if it's nil
+	Pool *Pool
+	// Identity : authentication and host key settings of SSHClientConfig and timeouts, tunnels share pooled connection
+	// only if they have the same user and identity
+	Identity string
+
+	// Interactive : authentication answers prompts of ssh server, pooled connection is reestablished
+	// only on demand as each login could ask user or use one-time code
+	Interactive bool
+
+	// ConnectTimeout, HandshakeTimeout : limits of connection to ssh server
+	ConnectTimeout   time.Duration
+	HandshakeTimeout time.Duration
+	// DialTimeout : limits opening of channel to remote through ssh connection
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout : limits waiting for response headers from remote
+	ResponseHeaderTimeout time.Duration
+	// Nameserver : optional internal DNS server queried through ssh connection, remote names are resolved with it before dialing
+	Nameserver string
+
+	resolvedLock sync.Mutex
+	resolved     map[string]resolvedName
 }
 
-// NewTunnelByUserPassword : tunnel constructor using user/password
-func NewTunnelByUserPassword(server, remote, user, password string) *Tunnel {
-	return &Tunnel{
-		Server: server,
-		Remote: remote,
-		SSHClientConfig: &ssh.ClientConfig{
-			User:            user,
-			Auth:            []ssh.AuthMethod{ssh.Password(password)},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		},
-	}
+// resolvedName : IPs of name looked up with Nameserver, next is index of IP which the following dial starts with
+type resolvedName struct {
+	ips     []string
+	expires time.Time
+	next    int
 }
 
-// NewTunnelByUserKey : tunnel constructor using user/key
-func NewTunnelByUserKey(server, remote, user, key string) (*Tunnel, error) {
-	authByCertificate, err := publicKeyFile(key)
+// VerifyHostKeys : checks keys of ssh servers with known_hosts file instead of accepting any key,
+// host certificates are validated against its @cert-authority lines
+func (tunnel *Tunnel) VerifyHostKeys(knownHostsFile string) error {
+	callback, err := knownhosts.New(knownHostsFile)
 	if err != nil {
-		return nil, fmt.Errorf("Can't import private key: %v", err)
-	}
-	tunnel := &Tunnel{
-		Server: server,
-		Remote: remote,
-		SSHClientConfig: &ssh.ClientConfig{
-			User:            user,
-			Auth:            []ssh.AuthMethod{authByCertificate},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		},
+		return fmt.Errorf("Can't load known hosts: %v", err)
 	}
-	return tunnel, nil
+	tunnel.SSHClientConfig.HostKeyCallback = callback
+	return nil
 }
 
+// KeyboardInteractiveChallenge : returns answers to questions of ssh server, it's called on each connection
+type KeyboardInteractiveChallenge func(name, instruction string, questions []string, echos []bool) ([]string, error)
+
 // CreateReverseProxy : creates http reverse proxy that serves your http requests through configured ssh connection
 func (tunnel *Tunnel) CreateReverseProxy() (*httputil.ReverseProxy, error) {
-	serverConn, err := ssh.Dial("tcp", tunnel.Server, tunnel.SSHClientConfig)
+	serverConn, err := tunnel.dialer()
 	if err != nil {
-		return nil, fmt.Errorf("Server dial error: %v", err)
+		return nil, err
 	}
 
 	reverseProxy := httputil.NewSingleHostReverseProxy(&url.URL{
 		Scheme: "http",
-		Host:   tunnel.Remote,
+		Host:   URLHost(tunnel.Remote),
 	})
 
+	remotes := tunnel.Remotes
+	if len(remotes) == 0 {
+		remotes = []string{tunnel.Remote}
+	}
+	sockets := NewSocketPaths(remotes)
 	reverseProxy.Transport = &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
 		MaxIdleConns:          100,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: tunnel.ResponseHeaderTimeout,
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			remoteConn, err := serverConn.Dial(network, addr)
-			if err != nil {
-				return nil, fmt.Errorf("Remote dial error: %v", err)
-			}
-			return remoteConn, err
+			network, addr = sockets.Resolve(network, addr)
+			return tunnel.dial(ctx, serverConn, network, addr)
 		},
 	}
 	return reverseProxy, nil
 }
 
-func publicKeyFile(file string) (ssh.AuthMethod, error) {
+// DialContext : opens connection to addr through ssh server of the tunnel, addr is path of remote socket for unix network.
+// Pool should be set to share ssh connection between calls, otherwise it's opened per connection
+func (tunnel *Tunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	serverConn, err := tunnel.dialer()
+	if err != nil {
+		return nil, err
+	}
+	remoteConn, err := tunnel.dial(ctx, serverConn, network, addr)
+	if client, ok := serverConn.(clientDialer); ok {
+		if err != nil {
+			client.Close() // nolint
+			return nil, err
+		}
+		return &clientConn{Conn: remoteConn, client: client.Client}, nil
+	}
+	return remoteConn, err
+}
+
+func (tunnel *Tunnel) dial(ctx context.Context, serverConn dialer, network, addr string) (net.Conn, error) {
+	if err := ValidateAddress(network, addr); err != nil {
+		return nil, err
+	}
+	if tunnel.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tunnel.DialTimeout)
+		defer cancel()
+	}
+	ctx, span := tracer.Start(ctx, "ssh dial", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.StringSlice("ssh.servers", tunnel.servers()),
+			attribute.String("server.address", addr),
+		))
+	defer span.End()
+	addrs := []string{addr}
+	if network != "unix" && tunnel.Nameserver != "" {
+		resolved, err := tunnel.resolve(ctx, serverConn, addr)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, fmt.Errorf("Remote lookup error: %w", err)
+		}
+		addrs = resolved
+	}
+	var err error
+	for _, addr := range addrs {
+		var remoteConn net.Conn
+		// the next IP of name is tried if connection to the previous one fails
+		if remoteConn, err = serverConn.DialContext(ctx, network, addr); err == nil {
+			span.SetAttributes(attribute.String("network.peer.address", addr))
+			return remoteConn, nil
+		}
+	}
+	span.SetStatus(codes.Error, err.Error())
+	return nil, fmt.Errorf("Remote dial error: %w", err)
+}
+
+// Listen : listens on addr of the first available ssh server of the tunnel, Pool is required to share ssh connection.
+// Listener is closed when ssh connection is lost
+func (tunnel *Tunnel) Listen(network, addr string) (net.Listener, error) {
+	if tunnel.Pool == nil {
+		return nil, fmt.Errorf("Pool is required to listen on ssh server")
+	}
+	dialer := tunnel.failoverDialer()
+	var lastErr error
+	for _, client := range dialer.ordered() {
+		listener, err := client.Listen(network, addr)
+		if err == nil {
+			return listener, nil
+		}
+		lastErr = err
+		log.Warnf("Can't listen on %s of %s@%s: %v", addr, client.User, client.Server, err)
+	}
+	return nil, lastErr
+}
+
+// Resolver : resolves names with Nameserver through ssh connection
+func (tunnel *Tunnel) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		// channels of ssh connection are streams so DNS over TCP is used
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return tunnel.DialContext(ctx, "tcp", tunnel.Nameserver)
+		},
+	}
+}
+
+// resolve : returns addresses of IPs of addr name looked up using Nameserver through the same ssh connection.
+// IPs are cached for resolvedTTL and rotated so connections are spread over all of them
+func (tunnel *Tunnel) resolve(ctx context.Context, serverConn dialer, addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+	ips, ok := tunnel.cachedIPs(host)
+	if !ok {
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return serverConn.DialContext(ctx, "tcp", tunnel.Nameserver)
+			},
+		}
+		if ips, err = resolver.LookupHost(ctx, host); err != nil {
+			return nil, err
+		}
+		tunnel.resolvedLock.Lock()
+		if tunnel.resolved == nil {
+			tunnel.resolved = make(map[string]resolvedName)
+		}
+		tunnel.resolved[host] = resolvedName{ips: ips, expires: time.Now().Add(resolvedTTL), next: 1}
+		tunnel.resolvedLock.Unlock()
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return addrs, nil
+}
+
+// cachedIPs : not expired IPs of name starting with the next one
+func (tunnel *Tunnel) cachedIPs(name string) ([]string, bool) {
+	tunnel.resolvedLock.Lock()
+	defer tunnel.resolvedLock.Unlock()
+	resolved, ok := tunnel.resolved[name]
+	if !ok || time.Now().After(resolved.expires) {
+		return nil, false
+	}
+	next := resolved.next % len(resolved.ips)
+	resolved.next = next + 1
+	tunnel.resolved[name] = resolved
+	return append(append([]string{}, resolved.ips[next:]...), resolved.ips[:next]...), true
+}
+
+// clientConn : connection through not pooled ssh connection which is closed together with it
+type clientConn struct {
+	net.Conn
+	client *ssh.Client
+}
+
+func (conn *clientConn) Close() error {
+	err := conn.Conn.Close()
+	conn.client.Close() // nolint
+	return err
+}
+
+type dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// clientDialer : not pooled ssh connection
+type clientDialer struct {
+	*ssh.Client
+}
+
+func (client clientDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialContext(ctx, client.Dial, network, addr)
+}
+
+func (tunnel *Tunnel) dialer() (dialer, error) {
+	if tunnel.Pool != nil {
+		dialer := tunnel.failoverDialer()
+		if err := dialer.connect(); err != nil {
+			return nil, err
+		}
+		return dialer, nil
+	}
+	var err error
+	for _, server := range tunnel.servers() {
+		var serverConn *ssh.Client
+		serverConn, err = connect(server, tunnel.SSHClientConfig, tunnel.ConnectTimeout, tunnel.HandshakeTimeout)
+		if err == nil {
+			return clientDialer{serverConn}, nil
+		}
+	}
+	return nil, err
+}
+
+// failoverDialer : pooled connections to ssh servers of the tunnel
+func (tunnel *Tunnel) failoverDialer() failoverDialer {
+	dialer := failoverDialer{}
+	for _, server := range tunnel.servers() {
+		dialer.clients = append(dialer.clients, tunnel.Pool.client(tunnel, server))
+	}
+	return dialer
+}
+
+func (tunnel *Tunnel) servers() []string {
+	if len(tunnel.Servers) > 0 {
+		return tunnel.Servers
+	}
+	return []string{tunnel.Server}
+}
+
+// publicKeySigner : signer of private key, it's combined with signed user certificate if it's set
+func publicKeySigner(file, certificate string) (ssh.Signer, error) {
 	buffer, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
@@ -91,5 +314,32 @@ func publicKeyFile(file string) (ssh.AuthMethod, error) {
 	if err != nil {
 		return nil, err
 	}
-	return ssh.PublicKeys(key), nil
+	if certificate == "" {
+		return key, nil
+	}
+
+	buffer, err = ioutil.ReadFile(certificate)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse certificate: %v", err)
+	}
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't ssh certificate", certificate)
+	}
+	return ssh.NewCertSigner(cert, key)
+}
+
+// logCertificateValidity : reports certificate which servers reject because of its validity period
+func logCertificateValidity(certificate string, cert *ssh.Certificate) {
+	if now := uint64(time.Now().Unix()); cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore {
+		log.Errorf("SSH certificate %s (key id '%s') has expired at %v, servers will reject it until it's renewed",
+			certificate, cert.KeyId, time.Unix(int64(cert.ValidBefore), 0))
+	} else if now < cert.ValidAfter {
+		log.Errorf("SSH certificate %s (key id '%s') isn't valid until %v",
+			certificate, cert.KeyId, time.Unix(int64(cert.ValidAfter), 0))
+	}
 }
@@ -0,0 +1,62 @@
+package ssh
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/nawa/http-ssh-proxy/config"
+)
+
+// unixSocketHost : Host header of requests to unix sockets, the same as curl --unix-socket sends
+const unixSocketHost = "localhost"
+
+// URLHost : host of http URL addressing remote, path of unix socket is escaped to be valid host
+func URLHost(address string) string {
+	if path, ok := unixSocketPath(address); ok {
+		return url.QueryEscape(path)
+	}
+	return address
+}
+
+// HostHeader : Host header of requests to remote
+func HostHeader(address string) string {
+	if strings.HasPrefix(address, config.UnixAddressPrefix) {
+		return unixSocketHost
+	}
+	return address
+}
+
+// SocketPaths : paths of unix sockets by URL hosts of configured addresses referring to them
+type SocketPaths map[string]string
+
+// NewSocketPaths : returns paths of unix sockets of the configured addresses
+func NewSocketPaths(addresses []string) SocketPaths {
+	paths := make(SocketPaths)
+	for _, address := range addresses {
+		if path, ok := unixSocketPath(address); ok {
+			paths[URLHost(address)] = path
+		}
+	}
+	return paths
+}
+
+// Resolve : returns unix network and path of socket if addr dialed for URL host refers to configured socket.
+// Dialed addresses aren't parsed otherwise so clients can't open unix sockets which aren't configured
+func (paths SocketPaths) Resolve(network, addr string) (string, string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if path, ok := paths[host]; ok {
+		return "unix", path
+	}
+	return network, addr
+}
+
+func unixSocketPath(address string) (string, bool) {
+	if !strings.HasPrefix(address, config.UnixAddressPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(address, config.UnixAddressPrefix), true
+}
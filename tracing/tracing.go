@@ -0,0 +1,87 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/nawa/http-ssh-proxy/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	exporterOTLP = "otlp"
+	exporterFile = "file"
+
+	defaultServiceName = "http-ssh-proxy"
+)
+
+// Tracer : returns tracer for instrumented package, it does nothing until Setup is called
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer("github.com/nawa/http-ssh-proxy/" + name)
+}
+
+// Setup : configures global tracer provider and W3C trace context propagation,
+// returned function flushes spans which aren't exported yet
+func Setup(tracing *config.Tracing) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	if tracing == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := newExporter(tracing)
+	if err != nil {
+		return nil, err
+	}
+	serviceName := tracing.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	sampleRatio := 1.0
+	if tracing.SampleRatio != nil {
+		sampleRatio = *tracing.SampleRatio
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func newExporter(tracing *config.Tracing) (sdktrace.SpanExporter, error) {
+	switch tracing.Exporter {
+	case exporterOTLP:
+		options := []otlptracehttp.Option{}
+		if tracing.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(tracing.Endpoint))
+		}
+		if tracing.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		if len(tracing.Headers) > 0 {
+			options = append(options, otlptracehttp.WithHeaders(tracing.Headers))
+		}
+		return otlptracehttp.New(context.Background(), options...)
+	case exporterFile:
+		if tracing.File == "" {
+			return nil, fmt.Errorf("Tracing file isn't configured")
+		}
+		file, err := os.OpenFile(tracing.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Can't open tracing file: %v", err)
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("Unknown tracing exporter '%s'", tracing.Exporter)
+	}
+}